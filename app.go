@@ -1,6 +1,7 @@
 package candy
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
@@ -8,16 +9,214 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type App struct {
 	Host string
 	Addr string
+	// Protocol is the HTTP version spoken to the upstream, UpstreamHTTP1 if empty
+	Protocol string
+	// TLSInsecureSkipVerify skips verifying the certificate of an
+	// UpstreamH2 upstream
+	TLSInsecureSkipVerify bool
+	TLS                   TLS
+	HTTPS                 HTTPS
+	ClientAuth            ClientAuth
+	// TCP proxies raw TCP connections to the app instead of HTTP if set
+	TCP TCP
+}
+
+// TCP is how TCP connections reach an app, e.g. a database. The
+// connections are passed through as is.
+type TCP struct {
+	// Port is a dedicated port that is proxied to the app
+	Port int `json:"port,omitempty"`
+	// SNI routes TLS connections to the app by their server name
+	SNI bool `json:"sni,omitempty"`
+}
+
+func (t TCP) IsZero() bool {
+	return t == TCP{}
+}
+
+func (t TCP) Validate() error {
+	if t.Port < 0 || t.Port > 65535 {
+		return fmt.Errorf("invalid port %d", t.Port)
+	}
+
+	return nil
+}
+
+// Upstream protocols
+const (
+	// UpstreamHTTP1 is HTTP/1.1 in plain text
+	UpstreamHTTP1 = "h1"
+	// UpstreamH2C is HTTP/2 in plain text, e.g. for gRPC services
+	UpstreamH2C = "h2c"
+	// UpstreamH2 is HTTP/2 over TLS
+	UpstreamH2 = "h2"
+)
+
+func validateProtocol(protocol string) error {
+	switch protocol {
+	case "", UpstreamHTTP1, UpstreamH2C, UpstreamH2:
+		return nil
+	default:
+		return fmt.Errorf("invalid protocol %q, must be %s, %s or %s", protocol, UpstreamHTTP1, UpstreamH2C, UpstreamH2)
+	}
+}
+
+// TLS is where the certificate of an app comes from. The certificate is
+// issued by Candy's local CA if it's empty.
+type TLS struct {
+	// CertFile and KeyFile are a certificate and its key that are served as is
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// CACertFile and CAKeyFile are a CA certificate and its key that
+	// issue the certificate instead of the local CA
+	CACertFile string `json:"ca_cert_file,omitempty"`
+	CAKeyFile  string `json:"ca_key_file,omitempty"`
+}
+
+func (t TLS) IsZero() bool {
+	return t == TLS{}
+}
+
+func (t TLS) Validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("both a certificate and a key file are required")
+	}
+
+	if (t.CACertFile == "") != (t.CAKeyFile == "") {
+		return fmt.Errorf("both a CA certificate and a CA key file are required")
+	}
+
+	if t.CertFile != "" && t.CACertFile != "" {
+		return fmt.Errorf("either a certificate or a CA can be used, not both")
+	}
+
+	return nil
+}
+
+// resolve makes the file paths relative to dir absolute
+func (t TLS) resolve(dir string) TLS {
+	for _, file := range []*string{&t.CertFile, &t.KeyFile, &t.CACertFile, &t.CAKeyFile} {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(dir, *file)
+		}
+	}
+
+	return t
+}
+
+// What plain HTTP requests to an app get
+const (
+	// HTTPServe serves the app over HTTP as well as HTTPS
+	HTTPServe = "serve"
+	// HTTPRedirect redirects HTTP requests to HTTPS
+	HTTPRedirect = "redirect"
+	// HTTPReject serves the app over HTTPS only
+	HTTPReject = "reject"
+)
+
+// HTTPS is how an app enforces HTTPS. It's served over both HTTP and HTTPS
+// if empty.
+type HTTPS struct {
+	// HTTP is what plain HTTP requests get, HTTPServe if empty
+	HTTP string `json:"http,omitempty"`
+	// HSTSMaxAge sends a Strict-Transport-Security header with the max-age in
+	// seconds over HTTPS if set
+	HSTSMaxAge int `json:"hsts_max_age,omitempty"`
+}
+
+func (h HTTPS) IsZero() bool {
+	return h == HTTPS{}
+}
+
+func (h HTTPS) Validate() error {
+	switch h.HTTP {
+	case "", HTTPServe, HTTPRedirect, HTTPReject:
+	default:
+		return fmt.Errorf("invalid http %q, must be %s, %s or %s", h.HTTP, HTTPServe, HTTPRedirect, HTTPReject)
+	}
+
+	if h.HSTSMaxAge < 0 {
+		return fmt.Errorf("invalid HSTS max-age %d", h.HSTSMaxAge)
+	}
+
+	return nil
+}
+
+// Client authentication modes
+const (
+	// ClientAuthRequire rejects clients without a valid certificate
+	ClientAuthRequire = "require"
+	// ClientAuthRequest verifies the certificate of the clients that send one
+	ClientAuthRequest = "request"
+)
+
+// ClientAuth is the TLS client authentication of an app. It's disabled if empty.
+type ClientAuth struct {
+	Mode string `json:"mode,omitempty"`
+	// CACertFile is the CA that signs the client certificates, Candy's
+	// local CA if empty
+	CACertFile string `json:"ca_cert_file,omitempty"`
+}
+
+func (c ClientAuth) IsZero() bool {
+	return c == ClientAuth{}
+}
+
+func (c ClientAuth) Validate() error {
+	switch c.Mode {
+	case ClientAuthRequire, ClientAuthRequest:
+		return nil
+	case "":
+		if c.CACertFile != "" {
+			return fmt.Errorf("client auth mode is required")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid client auth mode %q, must be %s or %s", c.Mode, ClientAuthRequire, ClientAuthRequest)
+	}
+}
+
+// appFile is the JSON format of an app file in the host root
+type appFile struct {
+	// Addr is any of the plain text formats, e.g. a port or ip:port
+	Addr     string `json:"addr"`
+	Protocol string `json:"protocol"`
+	// TLSInsecureSkipVerify defaults to true for UpstreamH2, since the
+	// upstreams are development servers, typically with self-signed
+	// certificates for 127.0.0.1
+	TLSInsecureSkipVerify *bool      `json:"tls_insecure_skip_verify"`
+	TLS                   TLS        `json:"tls"`
+	HTTPS                 HTTPS      `json:"https"`
+	ClientAuth            ClientAuth `json:"client_auth"`
+	TCP                   TCP        `json:"tcp"`
+}
+
+// AppFileError is an app file in the host root that can't be parsed, so
+// its apps are left out
+type AppFileError struct {
+	// File is the name of the file, which is the name of its apps
+	File string
+	Err  error
+}
+
+func (e AppFileError) Error() string {
+	return e.Err.Error()
 }
 
 type AppServiceConfig struct {
 	TLDs     []string
 	HostRoot string
+	// TLS is where the certificates of the apps that don't configure
+	// their own come from
+	TLS TLS
+	// HTTPS is how the apps that don't configure their own enforce HTTPS
+	HTTPS HTTPS
 }
 
 func NewAppService(cfg AppServiceConfig) *AppService {
@@ -25,16 +224,30 @@ func NewAppService(cfg AppServiceConfig) *AppService {
 }
 
 type AppService struct {
-	cfg AppServiceConfig
+	cfg   AppServiceConfig
+	mutex sync.RWMutex
+}
+
+// SetTLDs changes the top-level domains that apps are served under
+func (f *AppService) SetTLDs(tlds []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.cfg.TLDs = tlds
 }
 
-func (f *AppService) FindApps() ([]App, error) {
+// FindApps returns the apps in the host root along with the files that
+// can't be parsed
+func (f *AppService) FindApps() ([]App, []AppFileError, error) {
 	files, err := os.ReadDir(f.cfg.HostRoot)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	var result []App
+	var (
+		result  []App
+		invalid []AppFileError
+	)
 
 	for _, file := range files {
 		if file.IsDir() {
@@ -43,50 +256,125 @@ func (f *AppService) FindApps() ([]App, error) {
 
 		b, err := os.ReadFile(filepath.Join(f.cfg.HostRoot, file.Name()))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		apps, err := f.parseApps(file.Name(), strings.TrimSpace(string(b)))
 		if err != nil {
+			invalid = append(invalid, AppFileError{File: file.Name(), Err: err})
 			continue
 		}
 
 		result = append(result, apps...)
 	}
 
-	return result, nil
+	return result, invalid, nil
 }
 
 func (f *AppService) parseApps(domain, data string) ([]App, error) {
+	// {"addr": "8080", "protocol": "h2c", "tls": {...}}
+	if strings.HasPrefix(data, "{") {
+		var file appFile
+		if err := json.Unmarshal([]byte(data), &file); err != nil {
+			return nil, fmt.Errorf("invalid JSON for file %s: %w", filepath.Join(f.cfg.HostRoot, domain), err)
+		}
+
+		if err := validateProtocol(file.Protocol); err != nil {
+			return nil, fmt.Errorf("invalid upstream for file %s: %w", filepath.Join(f.cfg.HostRoot, domain), err)
+		}
+
+		skipVerify := file.Protocol == UpstreamH2
+		if file.TLSInsecureSkipVerify != nil {
+			if file.Protocol != UpstreamH2 {
+				return nil, fmt.Errorf("invalid upstream for file %s: tls_insecure_skip_verify requires protocol %s", filepath.Join(f.cfg.HostRoot, domain), UpstreamH2)
+			}
+			skipVerify = *file.TLSInsecureSkipVerify
+		}
+
+		if err := file.TCP.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid TCP for file %s: %w", filepath.Join(f.cfg.HostRoot, domain), err)
+		}
+
+		if err := file.TLS.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid TLS for file %s: %w", filepath.Join(f.cfg.HostRoot, domain), err)
+		}
+
+		if err := file.HTTPS.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid HTTPS for file %s: %w", filepath.Join(f.cfg.HostRoot, domain), err)
+		}
+
+		if err := file.ClientAuth.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid client auth for file %s: %w", filepath.Join(f.cfg.HostRoot, domain), err)
+		}
+
+		addr, err := f.parseAddr(domain, strings.TrimSpace(file.Addr))
+		if err != nil {
+			return nil, err
+		}
+
+		clientAuth := file.ClientAuth
+		if clientAuth.CACertFile != "" && !filepath.IsAbs(clientAuth.CACertFile) {
+			clientAuth.CACertFile = filepath.Join(f.cfg.HostRoot, clientAuth.CACertFile)
+		}
+
+		return f.buildApps(domain, App{
+			Addr:                  addr,
+			Protocol:              file.Protocol,
+			TLSInsecureSkipVerify: skipVerify,
+			TLS:                   file.TLS.resolve(f.cfg.HostRoot),
+			HTTPS:                 file.HTTPS,
+			ClientAuth:            clientAuth,
+			TCP:                   file.TCP,
+		}), nil
+	}
+
+	addr, err := f.parseAddr(domain, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.buildApps(domain, App{Addr: addr}), nil
+}
+
+func (f *AppService) parseAddr(domain, data string) (string, error) {
 	// port
 	port, err := strconv.Atoi(data)
 	if err == nil {
-		return f.buildApps(domain, fmt.Sprintf("127.0.0.1:%d", port)), nil
+		return fmt.Sprintf("127.0.0.1:%d", port), nil
 	}
 
 	// http://ip:port
 	u, err := url.ParseRequestURI(data)
 	if err == nil {
-		return f.buildApps(domain, u.Host), nil
+		return u.Host, nil
 	}
 
 	// ip:port
 	host, sport, err := net.SplitHostPort(data)
 	if err == nil {
-		return f.buildApps(domain, host+":"+sport), nil
+		return host + ":" + sport, nil
 	}
 
-	// TODO: json
-	return nil, fmt.Errorf("invalid domain for file: %s", filepath.Join(f.cfg.HostRoot, domain))
+	return "", fmt.Errorf("invalid domain for file: %s", filepath.Join(f.cfg.HostRoot, domain))
 }
 
-func (f *AppService) buildApps(domain, addr string) []App {
+// buildApps serves app under domain for each top-level domain
+func (f *AppService) buildApps(domain string, app App) []App {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	if app.TLS.IsZero() {
+		app.TLS = f.cfg.TLS
+	}
+
+	if app.HTTPS.IsZero() {
+		app.HTTPS = f.cfg.HTTPS
+	}
+
 	var apps []App
 	for _, tld := range f.cfg.TLDs {
-		apps = append(apps, App{
-			Host: domain + "." + tld, // e.g., app.test
-			Addr: addr,
-		})
+		app.Host = domain + "." + tld // e.g., app.test
+		apps = append(apps, app)
 	}
 
 	return apps
@@ -3,9 +3,11 @@ package candy
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func Test_AppService_FindApps(t *testing.T) {
@@ -13,8 +15,12 @@ func Test_AppService_FindApps(t *testing.T) {
 		Name     string
 		Hosts    map[string]string
 		TLDs     []string
+		TLS      TLS
+		HTTPS    HTTPS
 		WantApps []App
-		WantErr  error
+		// WantFiles are the files that can't be parsed
+		WantFiles []string
+		WantErr   error
 	}{
 		{
 			Name: "valid hosts",
@@ -75,9 +81,10 @@ func Test_AppService_FindApps(t *testing.T) {
 			Hosts: map[string]string{
 				"app1": "invalid",
 			},
-			TLDs:     []string{"test"},
-			WantApps: nil,
-			WantErr:  nil,
+			TLDs:      []string{"test"},
+			WantApps:  nil,
+			WantFiles: []string{"app1"},
+			WantErr:   nil,
 		},
 		{
 			Name: "ignore invalid hosts",
@@ -92,7 +99,140 @@ func Test_AppService_FindApps(t *testing.T) {
 					Addr: "127.0.0.1:8080",
 				},
 			},
-			WantErr: nil,
+			WantFiles: []string{"app1"},
+			WantErr:   nil,
+		},
+		{
+			Name: "json hosts",
+			Hosts: map[string]string{
+				"app1":  `{"addr": "8080", "tls": {"cert_file": "/certs/app1.crt", "key_file": "/certs/app1.key"}}`,
+				"app2":  `{"addr": "https://192.168.0.2:9091", "tls": {"ca_cert_file": "ca.crt", "ca_key_file": "ca.key"}}`,
+				"app3":  `{"addr": "192.168.0.1:9090", "client_auth": {"mode": "request", "ca_cert_file": "clients.crt"}}`,
+				"app4":  `{"addr": "8080", "tls": {"cert_file": "/certs/app4.crt"}}`,
+				"app5":  `{"addr": "8080"`,
+				"app6":  `{"addr": "8080", "client_auth": {"mode": "optional"}}`,
+				"app7":  `{"addr": "50051", "protocol": "h2c"}`,
+				"app8":  `{"addr": "8443", "protocol": "h3"}`,
+				"app9":  `{"addr": "15432", "tcp": {"port": 5432, "sni": true}}`,
+				"app10": `{"addr": "15432", "tcp": {"port": 65536}}`,
+			},
+			TLDs: []string{"test"},
+			TLS: TLS{
+				CACertFile: "/certs/corp.crt",
+				CAKeyFile:  "/certs/corp.key",
+			},
+			WantApps: []App{
+				{
+					Host: "app1.test",
+					Addr: "127.0.0.1:8080",
+					TLS: TLS{
+						CertFile: "/certs/app1.crt",
+						KeyFile:  "/certs/app1.key",
+					},
+				},
+				{
+					Host: "app2.test",
+					Addr: "192.168.0.2:9091",
+					TLS: TLS{
+						CACertFile: "{{dir}}/ca.crt",
+						CAKeyFile:  "{{dir}}/ca.key",
+					},
+				},
+				{
+					Host: "app3.test",
+					Addr: "192.168.0.1:9090",
+					TLS: TLS{
+						CACertFile: "/certs/corp.crt",
+						CAKeyFile:  "/certs/corp.key",
+					},
+					ClientAuth: ClientAuth{
+						Mode:       ClientAuthRequest,
+						CACertFile: "{{dir}}/clients.crt",
+					},
+				},
+				{
+					Host:     "app7.test",
+					Addr:     "127.0.0.1:50051",
+					Protocol: UpstreamH2C,
+					TLS: TLS{
+						CACertFile: "/certs/corp.crt",
+						CAKeyFile:  "/certs/corp.key",
+					},
+				},
+				{
+					Host: "app9.test",
+					Addr: "127.0.0.1:15432",
+					TLS: TLS{
+						CACertFile: "/certs/corp.crt",
+						CAKeyFile:  "/certs/corp.key",
+					},
+					TCP: TCP{Port: 5432, SNI: true},
+				},
+			},
+			WantFiles: []string{"app10", "app4", "app5", "app6", "app8"},
+			WantErr:   nil,
+		},
+		{
+			Name: "upstream protocols",
+			Hosts: map[string]string{
+				"grpc":      `{"addr": "50051", "protocol": "h2c"}`,
+				"h2":        `{"addr": "8443", "protocol": "h2"}`,
+				"h2-verify": `{"addr": "8444", "protocol": "h2", "tls_insecure_skip_verify": false}`,
+				"web":       `{"addr": "8080", "tls_insecure_skip_verify": true}`,
+			},
+			TLDs: []string{"test"},
+			WantApps: []App{
+				{
+					Host:     "grpc.test",
+					Addr:     "127.0.0.1:50051",
+					Protocol: UpstreamH2C,
+				},
+				{
+					Host:                  "h2.test",
+					Addr:                  "127.0.0.1:8443",
+					Protocol:              UpstreamH2,
+					TLSInsecureSkipVerify: true,
+				},
+				{
+					Host:     "h2-verify.test",
+					Addr:     "127.0.0.1:8444",
+					Protocol: UpstreamH2,
+				},
+			},
+			WantFiles: []string{"web"},
+		},
+		{
+			Name: "https",
+			Hosts: map[string]string{
+				"app1": "8080",
+				"app2": `{"addr": "8081", "https": {"http": "serve"}}`,
+				"app3": `{"addr": "8082", "https": {"http": "reject"}}`,
+				"app4": `{"addr": "8083", "https": {"http": "upgrade"}}`,
+				"app5": `{"addr": "8084", "https": {"hsts_max_age": -1}}`,
+			},
+			TLDs: []string{"test"},
+			HTTPS: HTTPS{
+				HTTP:       HTTPRedirect,
+				HSTSMaxAge: 3600,
+			},
+			WantApps: []App{
+				{
+					Host:  "app1.test",
+					Addr:  "127.0.0.1:8080",
+					HTTPS: HTTPS{HTTP: HTTPRedirect, HSTSMaxAge: 3600},
+				},
+				{
+					Host:  "app2.test",
+					Addr:  "127.0.0.1:8081",
+					HTTPS: HTTPS{HTTP: HTTPServe},
+				},
+				{
+					Host:  "app3.test",
+					Addr:  "127.0.0.1:8082",
+					HTTPS: HTTPS{HTTP: HTTPReject},
+				},
+			},
+			WantFiles: []string{"app4", "app5"},
 		},
 	}
 
@@ -112,17 +252,39 @@ func Test_AppService_FindApps(t *testing.T) {
 			svc := NewAppService(AppServiceConfig{
 				TLDs:     cc.TLDs,
 				HostRoot: dir,
+				TLS:      cc.TLS,
+				HTTPS:    cc.HTTPS,
 			})
 
-			gotApps, gotErr := svc.FindApps()
+			gotApps, gotInvalid, gotErr := svc.FindApps()
+
+			// Relative files are in the host root
+			wantApps := make([]App, 0, len(cc.WantApps))
+			for _, app := range cc.WantApps {
+				for _, file := range []*string{&app.TLS.CertFile, &app.TLS.KeyFile, &app.TLS.CACertFile, &app.TLS.CAKeyFile, &app.ClientAuth.CACertFile} {
+					*file = strings.ReplaceAll(*file, "{{dir}}", dir)
+				}
+				wantApps = append(wantApps, app)
+			}
 
 			if !cmp.Equal(cc.WantErr, gotErr) {
 				t.Fatalf("mismatch error: want=%s got=%s", cc.WantErr, gotErr)
 			}
 
-			if diff := cmp.Diff(cc.WantApps, gotApps); diff != "" {
+			if diff := cmp.Diff(wantApps, gotApps, cmpopts.EquateEmpty()); diff != "" {
 				t.Fatalf("mismatch apps (-want +got): %s", diff)
 			}
+
+			var gotFiles []string
+			for _, f := range gotInvalid {
+				if !strings.Contains(f.Error(), filepath.Join(dir, f.File)) {
+					t.Fatalf("error of %s doesn't name the file: %s", f.File, f.Error())
+				}
+				gotFiles = append(gotFiles, f.File)
+			}
+			if diff := cmp.Diff(cc.WantFiles, gotFiles, cmpopts.EquateEmpty()); diff != "" {
+				t.Fatalf("mismatch invalid files (-want +got): %s", diff)
+			}
 		})
 	}
 
@@ -0,0 +1,174 @@
+// Package ca reads and removes the local CA that Caddy's internal issuer
+// signs the app certificates with, e.g. to install it into trust stores.
+package ca
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddypki"
+)
+
+// Certificates of the CA
+const (
+	CertRoot         = "root"
+	CertIntermediate = "intermediate"
+	CertAll          = "all"
+)
+
+// Authority is the local CA stored in a Caddy storage directory
+type Authority struct {
+	Root         *x509.Certificate
+	Intermediate *x509.Certificate
+
+	dir string
+}
+
+// Load loads the local CA from storageDir, or from Caddy's default
+// location if storageDir is empty
+func Load(storageDir string) (*Authority, error) {
+	dir := authorityDir(storageDir)
+
+	root, err := loadCertificate(RootFile(storageDir))
+	if err != nil {
+		return nil, err
+	}
+
+	inter, err := loadCertificate(filepath.Join(dir, "intermediate.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authority{
+		Root:         root,
+		Intermediate: inter,
+		dir:          dir,
+	}, nil
+}
+
+// DefaultStorageDir returns Caddy's default storage, which depends on the
+// user running Candy
+func DefaultStorageDir() string {
+	return caddy.AppDataDir()
+}
+
+// RootFile returns the path of the root certificate in storageDir
+func RootFile(storageDir string) string {
+	return filepath.Join(authorityDir(storageDir), "root.crt")
+}
+
+// Remove removes the local CA and the certificates it issued from
+// storageDir so that Caddy generates new ones the next time it loads
+func Remove(storageDir string) error {
+	for _, dir := range []string{authorityDir(storageDir), certificatesDir(storageDir)} {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("error removing %s: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// Certificates returns the root, the intermediate or all of them
+func (a *Authority) Certificates(which string) ([]*x509.Certificate, error) {
+	switch which {
+	case CertRoot:
+		return []*x509.Certificate{a.Root}, nil
+	case CertIntermediate:
+		return []*x509.Certificate{a.Intermediate}, nil
+	case CertAll, "":
+		return []*x509.Certificate{a.Root, a.Intermediate}, nil
+	default:
+		return nil, fmt.Errorf("unknown certificate %q, must be one of %s, %s or %s", which, CertRoot, CertIntermediate, CertAll)
+	}
+}
+
+// Info describes a certificate of the CA
+type Info struct {
+	Name        string    `json:"name"`
+	Subject     string    `json:"subject"`
+	Fingerprint string    `json:"sha256_fingerprint"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+// Info returns the description of the root and the intermediate
+func (a *Authority) Info() []Info {
+	return []Info{
+		certInfo(CertRoot, a.Root),
+		certInfo(CertIntermediate, a.Intermediate),
+	}
+}
+
+func certInfo(name string, cert *x509.Certificate) Info {
+	return Info{
+		Name:        name,
+		Subject:     cert.Subject.String(),
+		Fingerprint: Fingerprint(cert),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+	}
+}
+
+// Fingerprint returns the SHA-256 fingerprint of cert in the colon
+// separated form of e.g. `openssl x509 -fingerprint -sha256`
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+func loadCertificate(file string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("CA certificate %s not found, has Candy been started? %w", file, err)
+		}
+
+		return nil, fmt.Errorf("error reading CA certificate: %w", err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("error decoding CA certificate %s: no PEM certificate found", file)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CA certificate %s: %w", file, err)
+	}
+
+	return cert, nil
+}
+
+// authorityDir is where the internal issuer keeps the local CA,
+// see caddypki's storage keys
+func authorityDir(storageDir string) string {
+	return filepath.Join(storageRoot(storageDir), "pki", "authorities", caddypki.DefaultCAID)
+}
+
+// certificatesDir is where certmagic keeps the certificates issued by the local CA
+func certificatesDir(storageDir string) string {
+	return filepath.Join(storageRoot(storageDir), "certificates", caddypki.DefaultCAID)
+}
+
+func storageRoot(storageDir string) string {
+	if storageDir == "" {
+		return caddy.AppDataDir()
+	}
+
+	return storageDir
+}
@@ -0,0 +1,272 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func Test_Authority(t *testing.T) {
+	storageDir := t.TempDir()
+	root, inter := writeAuthority(t, storageDir)
+
+	leafDir := filepath.Join(storageDir, "certificates", "local", "app.test")
+	if err := os.MkdirAll(leafDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	authority, err := Load(storageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !authority.Root.Equal(root) || !authority.Intermediate.Equal(inter) {
+		t.Fatal("Unexpected CA certificates")
+	}
+
+	var got []string
+	for _, info := range authority.Info() {
+		got = append(got, info.Name+" "+info.Subject)
+	}
+	if diff := cmp.Diff([]string{"root CN=Test Root", "intermediate CN=Test Intermediate"}, got); diff != "" {
+		t.Fatalf("Unexpected info (-want +got): %s", diff)
+	}
+
+	cert, key, err := authority.IssueClient("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatalf("Unexpected client certificate: %v", err)
+	}
+	if cert.Subject.CommonName != "alice" || !key.Public().(*ecdsa.PublicKey).Equal(cert.PublicKey) {
+		t.Fatalf("Unexpected client certificate: %s", cert.Subject)
+	}
+
+	if err := Remove(storageDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(storageDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Unexpected error loading removed CA: %v", err)
+	}
+	if _, err := os.Stat(leafDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Unexpected issued certificates: %v", err)
+	}
+}
+
+func Test_Export(t *testing.T) {
+	root, inter, _ := newAuthority(t)
+	authority := &Authority{Root: root, Intermediate: inter}
+
+	cases := []struct {
+		Name    string
+		Format  string
+		Cert    string
+		Decode  func(t *testing.T, b []byte) []*x509.Certificate
+		WantErr bool
+	}{
+		{
+			Name:   "pem",
+			Format: FormatPEM,
+			Cert:   CertAll,
+			Decode: func(t *testing.T, b []byte) []*x509.Certificate {
+				var certs []*x509.Certificate
+				for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+					certs = append(certs, parseCertificate(t, block.Bytes))
+				}
+
+				return certs
+			},
+		},
+		{
+			Name:   "der",
+			Format: FormatDER,
+			Cert:   CertRoot,
+			Decode: func(t *testing.T, b []byte) []*x509.Certificate {
+				return []*x509.Certificate{parseCertificate(t, b)}
+			},
+		},
+		{
+			Name:    "der all",
+			Format:  FormatDER,
+			Cert:    CertAll,
+			WantErr: true,
+		},
+		{
+			Name:   "jks",
+			Format: FormatJKS,
+			Cert:   CertAll,
+			Decode: func(t *testing.T, b []byte) []*x509.Certificate {
+				ks := keystore.New()
+				if err := ks.Load(bytes.NewReader(b), []byte(DefaultPassword)); err != nil {
+					t.Fatal(err)
+				}
+
+				var certs []*x509.Certificate
+				for _, alias := range []string{"candy-root", "candy-intermediate"} {
+					entry, err := ks.GetTrustedCertificateEntry(alias)
+					if err != nil {
+						t.Fatal(err)
+					}
+					certs = append(certs, parseCertificate(t, entry.Certificate.Content))
+				}
+
+				return certs
+			},
+		},
+		{
+			Name:   "pkcs12",
+			Format: FormatPKCS12,
+			Cert:   CertAll,
+			Decode: func(t *testing.T, b []byte) []*x509.Certificate {
+				certs, err := pkcs12.DecodeTrustStore(b, DefaultPassword)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return certs
+			},
+		},
+		{
+			Name:    "unknown format",
+			Format:  "p7b",
+			Cert:    CertAll,
+			WantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			certs, err := authority.Certificates(cc.Cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			err = Export(&buf, certs, cc.Format, DefaultPassword)
+			if cc.WantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := cc.Decode(t, buf.Bytes())
+			if len(got) != len(certs) {
+				t.Fatalf("Unexpected number of certificates: want=%d got=%d", len(certs), len(got))
+			}
+			for i := range certs {
+				if !certs[i].Equal(got[i]) {
+					t.Fatalf("Unexpected certificate %d: %s", i, got[i].Subject)
+				}
+			}
+		})
+	}
+}
+
+// writeAuthority writes a CA where Caddy's internal issuer stores it
+func writeAuthority(t *testing.T, storageDir string) (*x509.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	root, inter, rootKey := newAuthority(t)
+
+	dir := filepath.Join(storageDir, "pki", "authorities", "local")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*pem.Block{
+		"root.crt":         {Type: "CERTIFICATE", Bytes: root.Raw},
+		"root.key":         {Type: "EC PRIVATE KEY", Bytes: keyDER},
+		"intermediate.crt": {Type: "CERTIFICATE", Bytes: inter.Raw},
+	}
+	for name, block := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root, inter
+}
+
+func newAuthority(t *testing.T) (*x509.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := newCertificate(t, "Test Root", 1, nil, rootKey, rootKey)
+
+	interKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inter := newCertificate(t, "Test Intermediate", 2, root, interKey, rootKey)
+
+	return root, inter, rootKey
+}
+
+func newCertificate(t *testing.T, cn string, serial int64, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent = tmpl
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parseCertificate(t, der)
+}
+
+func parseCertificate(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
@@ -0,0 +1,123 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// DefaultClientLifetime is how long client certificates are valid by default
+const DefaultClientLifetime = 30 * 24 * time.Hour
+
+// IssueClient issues a client certificate for name. It's signed by the root
+// rather than the intermediate, which Caddy renews every few days, so that
+// it stays valid for its whole lifetime.
+func (a *Authority) IssueClient(name string, lifetime time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	rootKey, err := loadKey(filepath.Join(a.dir, "root.key"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating serial number: %w", err)
+	}
+
+	notBefore := time.Now().Add(-time.Minute) // tolerate clock skew
+	notAfter := notBefore.Add(lifetime)
+	if notAfter.After(a.Root.NotAfter) {
+		notAfter = a.Root.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.Root, key.Public(), rootKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error issuing client certificate for %s: %w", name, err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing client certificate: %w", err)
+	}
+
+	return cert, key, nil
+}
+
+// ExportKey writes the PEM encoded key to w
+func ExportKey(w io.Writer, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("error encoding key: %w", err)
+	}
+
+	return pem.Encode(w, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// ExportPKCS12 writes cert and key to w as a PKCS#12 bundle, e.g. to import
+// into a browser
+func ExportPKCS12(w io.Writer, cert *x509.Certificate, key crypto.Signer, password string) error {
+	b, err := pkcs12.Modern.Encode(key, cert, nil, password)
+	if err != nil {
+		return fmt.Errorf("error encoding PKCS#12: %w", err)
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func loadKey(file string) (crypto.Signer, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA key: %w", err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("error decoding CA key %s: no PEM key found", file)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CA key %s: %w", file, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", key)
+	}
+
+	return signer, nil
+}
@@ -0,0 +1,101 @@
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Export formats
+const (
+	FormatPEM    = "pem"
+	FormatDER    = "der"
+	FormatJKS    = "jks"
+	FormatPKCS12 = "pkcs12"
+)
+
+// DefaultPassword is the password of exported trust stores, the default of the JVM's cacerts
+const DefaultPassword = "changeit"
+
+// Export writes certs to w in format. The password protects the JKS and
+// PKCS#12 trust stores.
+func Export(w io.Writer, certs []*x509.Certificate, format, password string) error {
+	switch format {
+	case FormatPEM, "":
+		for _, cert := range certs {
+			if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+				return fmt.Errorf("error encoding PEM: %w", err)
+			}
+		}
+
+		return nil
+	case FormatDER:
+		// DER holds a single certificate
+		if len(certs) != 1 {
+			return fmt.Errorf("%s format holds a single certificate, choose either %s or %s", FormatDER, CertRoot, CertIntermediate)
+		}
+
+		_, err := w.Write(certs[0].Raw)
+		return err
+	case FormatJKS:
+		return exportJKS(w, certs, password)
+	case FormatPKCS12:
+		return exportPKCS12(w, certs, password)
+	default:
+		return fmt.Errorf("unknown format %q, must be one of %s, %s, %s or %s", format, FormatPEM, FormatDER, FormatJKS, FormatPKCS12)
+	}
+}
+
+func exportJKS(w io.Writer, certs []*x509.Certificate, password string) error {
+	ks := keystore.New()
+	for _, cert := range certs {
+		entry := keystore.TrustedCertificateEntry{
+			CreationTime: time.Now(),
+			Certificate: keystore.Certificate{
+				Type:    "X509",
+				Content: cert.Raw,
+			},
+		}
+		if err := ks.SetTrustedCertificateEntry(alias(cert), entry); err != nil {
+			return fmt.Errorf("error adding %s to JKS: %w", cert.Subject, err)
+		}
+	}
+
+	if err := ks.Store(w, []byte(password)); err != nil {
+		return fmt.Errorf("error encoding JKS: %w", err)
+	}
+
+	return nil
+}
+
+func exportPKCS12(w io.Writer, certs []*x509.Certificate, password string) error {
+	entries := make([]pkcs12.TrustStoreEntry, 0, len(certs))
+	for _, cert := range certs {
+		entries = append(entries, pkcs12.TrustStoreEntry{
+			Cert:         cert,
+			FriendlyName: alias(cert),
+		})
+	}
+
+	b, err := pkcs12.Modern.EncodeTrustStoreEntries(entries, password)
+	if err != nil {
+		return fmt.Errorf("error encoding PKCS#12: %w", err)
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// alias names a certificate in a trust store, e.g. "candy-root"
+func alias(cert *x509.Certificate) string {
+	if cert.IsCA && cert.CheckSignatureFrom(cert) == nil {
+		return "candy-" + CertRoot
+	}
+
+	return "candy-" + CertIntermediate
+}
@@ -0,0 +1,57 @@
+package caddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	// Registers admin.api.metrics, the admin API module whose handler serves
+	// the Prometheus metrics at /metrics
+	_ "github.com/caddyserver/caddy/v2/modules/metrics"
+	"github.com/owenthereal/candy/status"
+)
+
+const (
+	statusPath = "/candy/status"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI serves the status of Candy on the Caddy admin API
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.candy",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: statusPath,
+			Handler: caddy.AdminHandlerFunc(a.handleStatus),
+		},
+	}
+}
+
+func (a *adminAPI) handleStatus(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	return json.NewEncoder(w).Encode(status.Report())
+}
+
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,123 @@
+package caddy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddypki"
+)
+
+var (
+	leafLifetime = 12 * time.Hour
+
+	leafCache      = make(map[string]*tls.Certificate)
+	leafCacheMutex sync.Mutex
+)
+
+// GetCertificate returns a certificate for the requested server name issued
+// by the local CA of the running Caddy server. It lets listeners outside of
+// Caddy, e.g. DNS-over-TLS, be trusted the same way as the proxied apps.
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" {
+		return nil, fmt.Errorf("missing server name")
+	}
+
+	ca, err := localCA()
+	if err != nil {
+		return nil, err
+	}
+
+	leafCacheMutex.Lock()
+	defer leafCacheMutex.Unlock()
+
+	inter := ca.IntermediateCertificate()
+
+	if cert, ok := leafCache[name]; ok {
+		// Reissue when it's about to expire or the CA has been renewed
+		if time.Until(cert.Leaf.NotAfter) > leafLifetime/3 && cert.Leaf.CheckSignatureFrom(inter) == nil {
+			return cert, nil
+		}
+	}
+
+	cert, err := issueLeaf(name, inter, ca.IntermediateKey())
+	if err != nil {
+		return nil, fmt.Errorf("error issuing certificate for %s: %w", name, err)
+	}
+
+	leafCache[name] = cert
+
+	return cert, nil
+}
+
+func localCA() (*caddypki.CA, error) {
+	pki, ok := caddy.ActiveContext().AppIfConfigured("pki").(*caddypki.PKI)
+	if !ok {
+		return nil, fmt.Errorf("PKI app is not running")
+	}
+
+	ca, ok := pki.CAs[caddypki.DefaultCAID]
+	if !ok {
+		return nil, fmt.Errorf("local CA is not provisioned")
+	}
+
+	return ca, nil
+}
+
+func issueLeaf(name string, issuer *x509.Certificate, issuerKey any) (*tls.Certificate, error) {
+	signer, ok := issuerKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", issuerKey)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := time.Now().Add(leafLifetime)
+	if notAfter.After(issuer.NotAfter) {
+		notAfter = issuer.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, issuer.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
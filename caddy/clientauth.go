@@ -0,0 +1,133 @@
+package caddy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/ca"
+)
+
+// Headers passing the verified client certificate to the upstream
+const (
+	headerClientVerified    = "X-Client-Verified"
+	headerClientCert        = "X-Client-Cert"
+	headerClientSubject     = "X-Client-Cert-Subject"
+	headerClientFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+func init() {
+	caddy.RegisterModule(clientCertHeaders{})
+}
+
+// clientCertHeaders passes the identity of the verified client certificate
+// to the upstream and removes the headers if a client sends them itself
+type clientCertHeaders struct {
+	// Require rejects requests without a verified certificate, e.g. over HTTP
+	Require bool `json:"require,omitempty"`
+}
+
+func (clientCertHeaders) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.candy_client_cert",
+		New: func() caddy.Module { return new(clientCertHeaders) },
+	}
+}
+
+func (h clientCertHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	for _, name := range []string{headerClientVerified, headerClientCert, headerClientSubject, headerClientFingerprint} {
+		r.Header.Del(name)
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		if h.Require {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("client certificate required"))
+		}
+
+		r.Header.Set(headerClientVerified, "NONE")
+		return next.ServeHTTP(w, r)
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+
+	r.Header.Set(headerClientVerified, "SUCCESS")
+	r.Header.Set(headerClientCert, base64.StdEncoding.EncodeToString(cert.Raw))
+	r.Header.Set(headerClientSubject, cert.Subject.String())
+	r.Header.Set(headerClientFingerprint, hex.EncodeToString(sum[:]))
+
+	return next.ServeHTTP(w, r)
+}
+
+// clientAuthHandler returns the handler that checks the client certificate
+// of app, or nil if it doesn't authenticate clients
+func clientAuthHandler(app candy.App) json.RawMessage {
+	if app.ClientAuth.IsZero() {
+		return nil
+	}
+
+	h := clientCertHeaders{Require: app.ClientAuth.Mode == candy.ClientAuthRequire}
+
+	return caddyconfig.JSONModuleObject(h, "handler", "candy_client_cert", nil)
+}
+
+// connPolicies builds the TLS connection policies that authenticate the
+// clients of apps by their hostname. It returns nil if no app does.
+func (c *caddyServer) connPolicies(apps []candy.App) caddytls.ConnectionPolicies {
+	var (
+		modes   []candy.ClientAuth
+		byModes = make(map[candy.ClientAuth][]string)
+	)
+	for _, app := range apps {
+		if app.ClientAuth.IsZero() {
+			continue
+		}
+
+		if _, ok := byModes[app.ClientAuth]; !ok {
+			modes = append(modes, app.ClientAuth)
+		}
+		byModes[app.ClientAuth] = append(byModes[app.ClientAuth], app.Host)
+	}
+
+	if len(modes) == 0 {
+		return nil
+	}
+
+	var policies caddytls.ConnectionPolicies
+	for _, auth := range modes {
+		caFile := auth.CACertFile
+		if caFile == "" {
+			caFile = ca.RootFile(c.cfg.StorageDir)
+		}
+
+		mode := "require_and_verify"
+		if auth.Mode == candy.ClientAuthRequest {
+			mode = "verify_if_given"
+		}
+
+		policies = append(policies, &caddytls.ConnectionPolicy{
+			MatchersRaw: caddy.ModuleMap{
+				"sni": caddyconfig.JSON(caddytls.MatchServerName(byModes[auth]), nil),
+			},
+			ClientAuthentication: &caddytls.ClientAuthentication{
+				TrustedCACertPEMFiles: []string{caFile},
+				Mode:                  mode,
+			},
+		})
+	}
+
+	// The other hosts don't authenticate clients
+	return append(policies, &caddytls.ConnectionPolicy{})
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*clientCertHeaders)(nil)
+)
@@ -0,0 +1,247 @@
+package caddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// maxConfigOps is the most admin API calls a config change is applied
+// with, e.g. adding an app adds its HTTP and HTTPS routes and TLS subject
+const maxConfigOps = 4
+
+// apiOp is a targeted change made through the Caddy admin API
+type apiOp struct {
+	Method string
+	Path   string
+	Body   interface{}
+}
+
+func (o apiOp) String() string {
+	return o.Method + " " + o.Path
+}
+
+// diffConfig computes the admin API calls that turn the running config
+// oldCfg into newCfg by changing routes and TLS policy subjects only.
+// It returns false if anything else changed, e.g. listener settings,
+// and the full config must be loaded instead.
+func diffConfig(oldCfg, newCfg interface{}) ([]apiOp, bool) {
+	oldTree, err := jsonTree(oldCfg)
+	if err != nil {
+		return nil, false
+	}
+	newTree, err := jsonTree(newCfg)
+	if err != nil {
+		return nil, false
+	}
+
+	var ops []apiOp
+
+	oldServers := lookupMap(oldTree, "apps", "http", "servers")
+	newServers := lookupMap(newTree, "apps", "http", "servers")
+	if len(oldServers) != len(newServers) {
+		return nil, false
+	}
+
+	for _, name := range sortedKeys(newServers) {
+		oldServer, ok1 := oldServers[name].(map[string]interface{})
+		newServer, ok2 := newServers[name].(map[string]interface{})
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+
+		path := fmt.Sprintf("/config/apps/http/servers/%s/routes", name)
+		routeOps, ok := diffRoutes(path, oldServer["routes"], newServer["routes"])
+		if !ok {
+			return nil, false
+		}
+		ops = append(ops, routeOps...)
+
+		delete(oldServer, "routes")
+		delete(newServer, "routes")
+	}
+
+	oldPolicies, _ := lookup(oldTree, "apps", "tls", "automation", "policies").([]interface{})
+	newPolicies, _ := lookup(newTree, "apps", "tls", "automation", "policies").([]interface{})
+	if len(oldPolicies) != len(newPolicies) {
+		return nil, false
+	}
+
+	for i := range newPolicies {
+		oldPolicy, ok1 := oldPolicies[i].(map[string]interface{})
+		newPolicy, ok2 := newPolicies[i].(map[string]interface{})
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+
+		path := fmt.Sprintf("/config/apps/tls/automation/policies/%d/subjects", i)
+		ops = append(ops, diffValue(path, oldPolicy["subjects"], newPolicy["subjects"])...)
+
+		delete(oldPolicy, "subjects")
+		delete(newPolicy, "subjects")
+	}
+
+	// Anything else must be unchanged
+	if !reflect.DeepEqual(oldTree, newTree) {
+		return nil, false
+	}
+
+	return ops, true
+}
+
+// diffRoutes computes the changes of a route list. Routes are identified
+// by their matchers and must keep their relative order.
+func diffRoutes(path string, oldVal, newVal interface{}) ([]apiOp, bool) {
+	oldRoutes, ok1 := oldVal.([]interface{})
+	newRoutes, ok2 := newVal.([]interface{})
+	if !ok1 || !ok2 || len(oldRoutes) == 0 || len(newRoutes) == 0 {
+		// The routes key is added or removed as a whole
+		return diffValue(path, oldVal, newVal), true
+	}
+
+	oldKeys, ok := routeKeys(oldRoutes)
+	if !ok {
+		return nil, false
+	}
+	newKeys, ok := routeKeys(newRoutes)
+	if !ok {
+		return nil, false
+	}
+
+	newIndex := make(map[string]int, len(newKeys))
+	for i, key := range newKeys {
+		newIndex[key] = i
+	}
+
+	var (
+		ops  []apiOp
+		cur  []string
+		prev = -1
+	)
+
+	// Removals from the end so that the indexes stay valid
+	for i := len(oldKeys) - 1; i >= 0; i-- {
+		if _, ok := newIndex[oldKeys[i]]; !ok {
+			ops = append(ops, apiOp{Method: http.MethodDelete, Path: fmt.Sprintf("%s/%d", path, i)})
+		}
+	}
+	oldIndex := make(map[string]int, len(oldKeys))
+	for i, key := range oldKeys {
+		if j, ok := newIndex[key]; ok {
+			if j < prev {
+				return nil, false // reordered
+			}
+			prev = j
+
+			oldIndex[key] = i
+			cur = append(cur, key)
+		}
+	}
+
+	// Replacements and insertions in the new order
+	for i, key := range newKeys {
+		if i < len(cur) && cur[i] == key {
+			if !reflect.DeepEqual(oldRoutes[oldIndex[key]], newRoutes[i]) {
+				ops = append(ops, apiOp{Method: http.MethodPatch, Path: fmt.Sprintf("%s/%d", path, i), Body: newRoutes[i]})
+			}
+			continue
+		}
+
+		if i == len(cur) {
+			// Caddy only inserts before existing elements, appending is a POST to the list
+			ops = append(ops, apiOp{Method: http.MethodPost, Path: path, Body: newRoutes[i]})
+		} else {
+			ops = append(ops, apiOp{Method: http.MethodPut, Path: fmt.Sprintf("%s/%d", path, i), Body: newRoutes[i]})
+		}
+		cur = append(cur[:i], append([]string{key}, cur[i:]...)...)
+	}
+
+	return ops, true
+}
+
+// diffValue replaces, creates or deletes the value at path
+func diffValue(path string, oldVal, newVal interface{}) []apiOp {
+	switch {
+	case reflect.DeepEqual(oldVal, newVal):
+		return nil
+	case oldVal == nil:
+		return []apiOp{{Method: http.MethodPut, Path: path, Body: newVal}}
+	case newVal == nil:
+		return []apiOp{{Method: http.MethodDelete, Path: path}}
+	default:
+		return []apiOp{{Method: http.MethodPatch, Path: path, Body: newVal}}
+	}
+}
+
+// routeKeys identifies routes by their matchers, which are unique per app
+func routeKeys(routes []interface{}) ([]string, bool) {
+	var (
+		keys = make([]string, 0, len(routes))
+		seen = make(map[string]bool, len(routes))
+	)
+
+	for _, r := range routes {
+		route, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		b, err := json.Marshal(route["match"])
+		if err != nil {
+			return nil, false
+		}
+
+		key := string(b)
+		if seen[key] {
+			return nil, false
+		}
+		seen[key] = true
+
+		keys = append(keys, key)
+	}
+
+	return keys, true
+}
+
+func jsonTree(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+	if err := json.Unmarshal(b, &tree); err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+func lookup(tree interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := tree.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		tree = m[key]
+	}
+
+	return tree
+}
+
+func lookupMap(tree interface{}, keys ...string) map[string]interface{} {
+	m, _ := lookup(tree, keys...).(map[string]interface{})
+	return m
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
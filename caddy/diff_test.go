@@ -0,0 +1,218 @@
+package caddy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/owenthereal/candy"
+	"go.uber.org/zap"
+)
+
+func Test_diffConfig(t *testing.T) {
+	cfg := Config{
+		HTTPAddr:  "127.0.0.1:28080",
+		HTTPSAddr: "127.0.0.1:28443",
+		AdminAddr: "127.0.0.1:22019",
+		TLDs:      []string{"test"},
+	}
+
+	cases := []struct {
+		Name    string
+		OldApps []candy.App
+		NewApps []candy.App
+		NewCfg  Config
+		WantOps []string
+		WantOK  bool
+	}{
+		{
+			Name:    "unchanged",
+			OldApps: []candy.App{{Host: "app1.test", Addr: "127.0.0.1:8080"}},
+			NewApps: []candy.App{{Host: "app1.test", Addr: "127.0.0.1:8080"}},
+			NewCfg:  cfg,
+			WantOps: nil,
+			WantOK:  true,
+		},
+		{
+			Name:    "add app",
+			OldApps: []candy.App{{Host: "app1.test", Addr: "127.0.0.1:8080"}, {Host: "app3.test", Addr: "127.0.0.1:8082"}},
+			NewApps: []candy.App{{Host: "app1.test", Addr: "127.0.0.1:8080"}, {Host: "app2.test", Addr: "127.0.0.1:8081"}, {Host: "app3.test", Addr: "127.0.0.1:8082"}, {Host: "app4.test", Addr: "127.0.0.1:8083"}},
+			NewCfg:  cfg,
+			WantOps: []string{
+				"PUT /config/apps/http/servers/http/routes/1",
+				"POST /config/apps/http/servers/http/routes",
+				"PUT /config/apps/http/servers/https/routes/1",
+				"POST /config/apps/http/servers/https/routes",
+				"PATCH /config/apps/tls/automation/policies/0/subjects",
+			},
+			WantOK: true,
+		},
+		{
+			Name:    "remove and change apps",
+			OldApps: []candy.App{{Host: "app1.test", Addr: "127.0.0.1:8080"}, {Host: "app2.test", Addr: "127.0.0.1:8081"}, {Host: "app3.test", Addr: "127.0.0.1:8082"}},
+			NewApps: []candy.App{{Host: "app2.test", Addr: "127.0.0.1:9091"}},
+			NewCfg:  cfg,
+			WantOps: []string{
+				"DELETE /config/apps/http/servers/http/routes/2",
+				"DELETE /config/apps/http/servers/http/routes/0",
+				"PATCH /config/apps/http/servers/http/routes/0",
+				"DELETE /config/apps/http/servers/https/routes/2",
+				"DELETE /config/apps/http/servers/https/routes/0",
+				"PATCH /config/apps/http/servers/https/routes/0",
+				"PATCH /config/apps/tls/automation/policies/0/subjects",
+			},
+			WantOK: true,
+		},
+		{
+			Name:    "first app",
+			OldApps: nil,
+			NewApps: []candy.App{{Host: "app1.test", Addr: "127.0.0.1:8080"}},
+			NewCfg:  cfg,
+			WantOps: []string{
+				"PUT /config/apps/http/servers/http/routes",
+				"PUT /config/apps/http/servers/https/routes",
+				"PUT /config/apps/tls/automation/policies/0/subjects",
+			},
+			WantOK: true,
+		},
+		{
+			Name:    "listener changed",
+			OldApps: []candy.App{{Host: "app1.test", Addr: "127.0.0.1:8080"}},
+			NewApps: []candy.App{{Host: "app1.test", Addr: "127.0.0.1:8080"}},
+			NewCfg: Config{
+				HTTPAddr:  "127.0.0.1:38080",
+				HTTPSAddr: cfg.HTTPSAddr,
+				AdminAddr: cfg.AdminAddr,
+				TLDs:      cfg.TLDs,
+			},
+			WantOps: nil,
+			WantOK:  false,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			oldCfg := (&caddyServer{cfg: cfg}).buildConfig(cc.OldApps)
+			newCfg := (&caddyServer{cfg: cc.NewCfg}).buildConfig(cc.NewApps)
+
+			ops, ok := diffConfig(oldCfg, newCfg)
+			if ok != cc.WantOK {
+				t.Fatalf("mismatch ok: want=%t got=%t", cc.WantOK, ok)
+			}
+
+			var gotOps []string
+			for _, op := range ops {
+				gotOps = append(gotOps, op.String())
+			}
+
+			if diff := cmp.Diff(cc.WantOps, gotOps); diff != "" {
+				t.Fatalf("mismatch ops (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func Test_caddyServer_apply(t *testing.T) {
+	apps := []candy.App{{Host: "app1.test", Addr: "127.0.0.1:8080"}, {Host: "app2.test", Addr: "127.0.0.1:8081"}}
+
+	cases := []struct {
+		Name         string
+		NewApps      []candy.App
+		NewHTTPAddr  string
+		FailTargeted bool
+		WantRequests []string
+	}{
+		{
+			Name:    "change app",
+			NewApps: []candy.App{{Host: "app1.test", Addr: "127.0.0.1:8080"}, {Host: "app2.test", Addr: "127.0.0.1:9091"}},
+			// The route of app1 and the listeners are left alone
+			WantRequests: []string{
+				"PATCH /config/apps/http/servers/http/routes/1",
+				"PATCH /config/apps/http/servers/https/routes/1",
+			},
+		},
+		{
+			Name:        "listener changed",
+			NewApps:     apps,
+			NewHTTPAddr: "127.0.0.1:38080",
+			WantRequests: []string{
+				"POST /load",
+			},
+		},
+		{
+			Name: "many changes",
+			NewApps: []candy.App{
+				{Host: "app3.test", Addr: "127.0.0.1:8082"},
+				{Host: "app4.test", Addr: "127.0.0.1:8083"},
+				{Host: "app5.test", Addr: "127.0.0.1:8084"},
+			},
+			WantRequests: []string{
+				"POST /load",
+			},
+		},
+		{
+			Name:         "targeted call fails",
+			NewApps:      []candy.App{{Host: "app1.test", Addr: "127.0.0.1:9090"}, {Host: "app2.test", Addr: "127.0.0.1:8081"}},
+			FailTargeted: true,
+			WantRequests: []string{
+				"PATCH /config/apps/http/servers/http/routes/0",
+				"POST /load",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				mutex    sync.Mutex
+				requests []string
+			)
+			admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				mutex.Unlock()
+
+				if cc.FailTargeted && strings.HasPrefix(r.URL.Path, "/config/") {
+					http.Error(w, "failed", http.StatusInternalServerError)
+				}
+			}))
+			defer admin.Close()
+
+			cfg := Config{
+				HTTPAddr:  "127.0.0.1:28080",
+				HTTPSAddr: "127.0.0.1:28443",
+				AdminAddr: strings.TrimPrefix(admin.URL, "http://"),
+				TLDs:      []string{"test"},
+				Logger:    zap.NewNop(),
+			}
+			c := &caddyServer{cfg: cfg, ctx: context.Background()}
+			c.caddyCfg = c.buildConfig(apps)
+
+			if cc.NewHTTPAddr != "" {
+				c.cfg.HTTPAddr = cc.NewHTTPAddr
+			}
+			ccfg := c.buildConfig(cc.NewApps)
+
+			if err := c.apply(ccfg); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(cc.WantRequests, requests); diff != "" {
+				t.Fatalf("mismatch admin API requests (-want +got): %s", diff)
+			}
+			if !jsonEqual(ccfg, c.caddyCfg) {
+				t.Fatal("applied config isn't the running config")
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package caddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/owenthereal/candy"
+)
+
+func init() {
+	caddy.RegisterModule(httpsPolicy{})
+}
+
+// httpsPolicy enforces HTTPS for an app: plain HTTP requests are
+// redirected or rejected, and HTTPS responses get an HSTS header
+type httpsPolicy struct {
+	// HTTP is what plain HTTP requests get
+	HTTP string `json:"http,omitempty"`
+	// Port is the port of the HTTPS listener that requests are redirected to
+	Port int `json:"port,omitempty"`
+	// HSTSMaxAge is the max-age of the Strict-Transport-Security header in seconds
+	HSTSMaxAge int `json:"hsts_max_age,omitempty"`
+}
+
+func (httpsPolicy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.candy_https",
+		New: func() caddy.Module { return new(httpsPolicy) },
+	}
+}
+
+func (h httpsPolicy) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if r.TLS != nil {
+		if h.HSTSMaxAge > 0 {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", h.HSTSMaxAge))
+		}
+
+		return next.ServeHTTP(w, r)
+	}
+
+	switch h.HTTP {
+	case candy.HTTPRedirect:
+		http.Redirect(w, r, h.redirectURL(r), http.StatusPermanentRedirect)
+		return nil
+	case candy.HTTPReject:
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("HTTPS required"))
+	default:
+		return next.ServeHTTP(w, r)
+	}
+}
+
+// redirectURL returns the HTTPS URL of r. Requests to the default HTTP port,
+// e.g. through port forwarding, go to the default HTTPS port, others to the
+// port of the HTTPS listener.
+func (h httpsPolicy) redirectURL(r *http.Request) string {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = hostname
+		if h.Port != 0 && h.Port != 443 {
+			host = net.JoinHostPort(hostname, strconv.Itoa(h.Port))
+		}
+	}
+
+	return "https://" + host + r.URL.RequestURI()
+}
+
+// httpsHandler returns the handler that enforces HTTPS for app, or nil if
+// it's served over both HTTP and HTTPS
+func httpsHandler(app candy.App, httpsPort int) json.RawMessage {
+	if app.HTTPS.HSTSMaxAge == 0 && (app.HTTPS.HTTP == "" || app.HTTPS.HTTP == candy.HTTPServe) {
+		return nil
+	}
+
+	h := httpsPolicy{
+		HTTP:       app.HTTPS.HTTP,
+		HSTSMaxAge: app.HTTPS.HSTSMaxAge,
+	}
+	if h.HTTP == candy.HTTPRedirect {
+		h.Port = httpsPort
+	}
+
+	return caddyconfig.JSONModuleObject(h, "handler", "candy_https", nil)
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*httpsPolicy)(nil)
+)
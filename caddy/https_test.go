@@ -0,0 +1,94 @@
+package caddy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/go-cmp/cmp"
+	"github.com/owenthereal/candy"
+)
+
+func Test_httpsPolicy(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Policy       httpsPolicy
+		URL          string
+		WantStatus   int
+		WantLocation string
+		WantHSTS     string
+	}{
+		{
+			Name:       "serve",
+			Policy:     httpsPolicy{HTTP: candy.HTTPServe},
+			URL:        "http://app.test/",
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:         "redirect",
+			Policy:       httpsPolicy{HTTP: candy.HTTPRedirect, Port: 28443},
+			URL:          "http://app.test:28080/path?q=1",
+			WantStatus:   http.StatusPermanentRedirect,
+			WantLocation: "https://app.test:28443/path?q=1",
+		},
+		{
+			Name:         "redirect default port",
+			Policy:       httpsPolicy{HTTP: candy.HTTPRedirect, Port: 28443},
+			URL:          "http://app.test/path",
+			WantStatus:   http.StatusPermanentRedirect,
+			WantLocation: "https://app.test/path",
+		},
+		{
+			Name:       "reject",
+			Policy:     httpsPolicy{HTTP: candy.HTTPReject},
+			URL:        "http://app.test/",
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "https",
+			Policy:     httpsPolicy{HTTP: candy.HTTPReject, HSTSMaxAge: 3600},
+			URL:        "https://app.test/",
+			WantStatus: http.StatusOK,
+			WantHSTS:   "max-age=3600",
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			// Requests to https URLs come over TLS
+			r := httptest.NewRequest(http.MethodGet, cc.URL, nil)
+			w := httptest.NewRecorder()
+
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				return nil
+			})
+
+			var status int
+			if err := cc.Policy.ServeHTTP(w, r, next); err != nil {
+				var herr caddyhttp.HandlerError
+				if !errors.As(err, &herr) {
+					t.Fatal(err)
+				}
+				status = herr.StatusCode
+			} else {
+				status = w.Code
+			}
+
+			if status != cc.WantStatus {
+				t.Fatalf("mismatch status: want=%d got=%d", cc.WantStatus, status)
+			}
+			if diff := cmp.Diff(cc.WantLocation, w.Header().Get("Location")); diff != "" {
+				t.Fatalf("mismatch location (-want +got): %s", diff)
+			}
+			if diff := cmp.Diff(cc.WantHSTS, w.Header().Get("Strict-Transport-Security")); diff != "" {
+				t.Fatalf("mismatch HSTS (-want +got): %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package caddy
+
+import (
+	"strings"
+
+	"github.com/owenthereal/candy"
+)
+
+// mdnsApps adds the apps under the names that mDNS advertises them as, so
+// that they're routed and issued certificates. An app served under several
+// top-level domains is added once.
+func (c *caddyServer) mdnsApps(apps []candy.App) []candy.App {
+	if !c.cfg.MDNS {
+		return apps
+	}
+
+	hosts := make(map[string]bool)
+	for _, app := range apps {
+		hosts[app.Host] = true
+	}
+
+	result := append([]candy.App(nil), apps...)
+	for _, app := range apps {
+		name, ok := c.appName(app.Host)
+		if !ok {
+			continue
+		}
+
+		host := candy.MDNSHost(name, c.cfg.MDNSHostname)
+		if hosts[host] {
+			continue
+		}
+		hosts[host] = true
+
+		app.Host = host
+		// Certificates that apps bring are for their top-level domains
+		if app.TLS.CertFile != "" {
+			app.TLS = candy.TLS{}
+		}
+		result = append(result, app)
+	}
+
+	return result
+}
+
+// appName returns the name of the app file that host is served for
+func (c *caddyServer) appName(host string) (string, bool) {
+	for _, tld := range c.cfg.TLDs {
+		if name, ok := strings.CutSuffix(host, "."+tld); ok {
+			return name, true
+		}
+	}
+
+	return "", false
+}
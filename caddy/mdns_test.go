@@ -0,0 +1,120 @@
+package caddy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/google/go-cmp/cmp"
+	"github.com/owenthereal/candy"
+)
+
+func Test_mdnsApps(t *testing.T) {
+	own := candy.TLS{CertFile: "/certs/app.crt", KeyFile: "/certs/app.key"}
+
+	cases := []struct {
+		Name     string
+		Cfg      Config
+		Apps     []candy.App
+		WantApps []candy.App
+	}{
+		{
+			Name: "disabled",
+			Cfg:  Config{TLDs: []string{"test"}},
+			Apps: []candy.App{{Host: "app.test", Addr: "127.0.0.1:8080"}},
+			WantApps: []candy.App{
+				{Host: "app.test", Addr: "127.0.0.1:8080"},
+			},
+		},
+		{
+			Name: "several top-level domains",
+			Cfg:  Config{TLDs: []string{"test", "dev"}, MDNS: true},
+			Apps: []candy.App{
+				{Host: "app.test", Addr: "127.0.0.1:8080"},
+				{Host: "app.dev", Addr: "127.0.0.1:8080"},
+			},
+			WantApps: []candy.App{
+				{Host: "app.test", Addr: "127.0.0.1:8080"},
+				{Host: "app.dev", Addr: "127.0.0.1:8080"},
+				{Host: "app.local", Addr: "127.0.0.1:8080"},
+			},
+		},
+		{
+			Name: "hostname",
+			Cfg:  Config{TLDs: []string{"test"}, MDNS: true, MDNSHostname: "laptop"},
+			Apps: []candy.App{{Host: "App.test", Addr: "127.0.0.1:8080"}},
+			WantApps: []candy.App{
+				{Host: "App.test", Addr: "127.0.0.1:8080"},
+				{Host: "app-laptop.local", Addr: "127.0.0.1:8080"},
+			},
+		},
+		{
+			Name: "own certificate",
+			Cfg:  Config{TLDs: []string{"test"}, MDNS: true},
+			Apps: []candy.App{{Host: "app.test", Addr: "127.0.0.1:8080", TLS: own}},
+			WantApps: []candy.App{
+				{Host: "app.test", Addr: "127.0.0.1:8080", TLS: own},
+				{Host: "app.local", Addr: "127.0.0.1:8080"},
+			},
+		},
+		{
+			Name: "local top-level domain",
+			Cfg:  Config{TLDs: []string{"local"}, MDNS: true},
+			Apps: []candy.App{{Host: "app.local", Addr: "127.0.0.1:8080"}},
+			WantApps: []candy.App{
+				{Host: "app.local", Addr: "127.0.0.1:8080"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			svr := &caddyServer{cfg: cc.Cfg}
+			if diff := cmp.Diff(cc.WantApps, svr.mdnsApps(cc.Apps)); diff != "" {
+				t.Fatalf("mismatch apps (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+// Test_buildConfig_MDNS checks that the mDNS names are routed and issued
+// certificates by the local CA
+func Test_buildConfig_MDNS(t *testing.T) {
+	svr := &caddyServer{cfg: Config{
+		HTTPAddr:  "127.0.0.1:28080",
+		HTTPSAddr: "127.0.0.1:28443",
+		TLDs:      []string{"test"},
+		MDNS:      true,
+	}}
+
+	ccfg := svr.buildConfig([]candy.App{{Host: "app.test", Addr: "127.0.0.1:8080"}})
+
+	var httpApp caddyhttp.App
+	if err := json.Unmarshal(ccfg.AppsRaw["http"], &httpApp); err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []string
+	for _, route := range httpApp.Servers["https"].Routes {
+		var match caddyhttp.MatchHost
+		if err := json.Unmarshal(route.MatcherSetsRaw[0]["host"], &match); err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, match...)
+	}
+	if diff := cmp.Diff([]string{"app.test", "app.local"}, hosts); diff != "" {
+		t.Fatalf("mismatch routes (-want +got): %s", diff)
+	}
+
+	var tlsApp caddytls.TLS
+	if err := json.Unmarshal(ccfg.AppsRaw["tls"], &tlsApp); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"app.test", "app.local"}, tlsApp.Automation.Policies[0].SubjectsRaw); diff != "" {
+		t.Fatalf("mismatch certificate subjects (-want +got): %s", diff)
+	}
+}
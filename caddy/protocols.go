@@ -0,0 +1,74 @@
+package caddy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Protocols of the HTTPS listener
+const (
+	ProtocolHTTP1 = "h1"
+	ProtocolHTTP2 = "h2"
+	ProtocolHTTP3 = "h3"
+)
+
+// DefaultProtocols are the protocols served on the HTTPS listener by default
+var DefaultProtocols = []string{ProtocolHTTP1, ProtocolHTTP2, ProtocolHTTP3}
+
+// ValidateProtocols checks the protocols of the HTTPS listener
+func ValidateProtocols(protocols []string) error {
+	if len(protocols) == 0 {
+		return fmt.Errorf("at least one protocol is required")
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range protocols {
+		switch p {
+		case ProtocolHTTP1, ProtocolHTTP2, ProtocolHTTP3:
+		default:
+			return fmt.Errorf("unknown protocol %q, must be %s, %s or %s", p, ProtocolHTTP1, ProtocolHTTP2, ProtocolHTTP3)
+		}
+
+		if seen[p] {
+			return fmt.Errorf("duplicate protocol %q", p)
+		}
+		seen[p] = true
+	}
+
+	// Go's HTTP server only serves HTTP/2 over TLS alongside HTTP/1.1
+	if seen[ProtocolHTTP2] && !seen[ProtocolHTTP1] {
+		return fmt.Errorf("protocol %s requires %s", ProtocolHTTP2, ProtocolHTTP1)
+	}
+
+	return nil
+}
+
+// httpsListeners returns the network addresses the HTTPS listener serves
+// protocols on: TCP for HTTP/1.1 and HTTP/2, UDP for HTTP/3. Addresses with
+// a network, e.g. systemd/https, serve HTTP/3 on its datagram network.
+func httpsListeners(addr string, protocols []string) []string {
+	stream, datagram := "tcp/"+addr, "udp/"+addr
+	if network, host, ok := strings.Cut(addr, "/"); ok {
+		stream, datagram = addr, network+"gram/"+host
+	}
+
+	var tcp, udp bool
+	for _, p := range protocols {
+		switch p {
+		case ProtocolHTTP1, ProtocolHTTP2:
+			tcp = true
+		case ProtocolHTTP3:
+			udp = true
+		}
+	}
+
+	var listeners []string
+	if tcp {
+		listeners = append(listeners, stream)
+	}
+	if udp {
+		listeners = append(listeners, datagram)
+	}
+
+	return listeners
+}
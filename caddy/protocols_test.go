@@ -0,0 +1,52 @@
+package caddy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_ValidateProtocols(t *testing.T) {
+	cases := []struct {
+		Protocols     []string
+		WantErr       bool
+		WantListeners []string
+	}{
+		{Protocols: DefaultProtocols, WantListeners: []string{"tcp/127.0.0.1:443", "udp/127.0.0.1:443"}},
+		{Protocols: []string{"h1"}, WantListeners: []string{"tcp/127.0.0.1:443"}},
+		{Protocols: []string{"h1", "h2"}, WantListeners: []string{"tcp/127.0.0.1:443"}},
+		{Protocols: []string{"h3"}, WantListeners: []string{"udp/127.0.0.1:443"}},
+		{Protocols: nil, WantErr: true},
+		{Protocols: []string{"h2"}, WantErr: true},
+		{Protocols: []string{"h2", "h3"}, WantErr: true},
+		{Protocols: []string{"h1", "h1"}, WantErr: true},
+		{Protocols: []string{"h2c"}, WantErr: true},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(strings.Join(cc.Protocols, ","), func(t *testing.T) {
+			t.Parallel()
+
+			err := ValidateProtocols(cc.Protocols)
+			if got := err != nil; got != cc.WantErr {
+				t.Fatalf("mismatch error: want=%t got=%v", cc.WantErr, err)
+			}
+			if cc.WantErr {
+				return
+			}
+
+			if diff := cmp.Diff(cc.WantListeners, httpsListeners("127.0.0.1:443", cc.Protocols)); diff != "" {
+				t.Fatalf("Unexpected listeners (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func Test_httpsListeners_Network(t *testing.T) {
+	want := []string{"systemd/https", "systemdgram/https"}
+	if diff := cmp.Diff(want, httpsListeners("systemd/https", DefaultProtocols)); diff != "" {
+		t.Fatalf("Unexpected listeners (-want +got): %s", diff)
+	}
+}
@@ -15,9 +15,12 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
-	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/caddyserver/caddy/v2/modules/filestorage"
 	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/runnable"
+	"github.com/owenthereal/candy/status"
 	"go.uber.org/zap"
 )
 
@@ -28,11 +31,28 @@ var (
 type Config struct {
 	HTTPAddr  string
 	HTTPSAddr string
-	AdminAddr string
-	TLDs      []string
-	HostRoot  string
-	Debug     bool
-	Logger    *zap.Logger
+	// HTTPSProtocols are the protocols served on HTTPSAddr (DefaultProtocols if empty)
+	HTTPSProtocols []string
+	AdminAddr      string
+	TLDs           []string
+	HostRoot       string
+	// StorageDir is where Caddy stores its CA and certificates (Caddy's default location if empty)
+	StorageDir string
+	// DoHAddr is the upstream of the DNS-over-HTTPS endpoint https://candy.<tld>/dns-query
+	DoHAddr string
+	// DoHToken is sent to DoHAddr in candy.DoHTokenHeader
+	DoHToken string
+	// TLS is where the certificates of the DoH endpoint and the apps
+	// that don't configure their own come from
+	TLS candy.TLS
+	// HTTPS is how the apps that don't configure their own enforce HTTPS
+	HTTPS candy.HTTPS
+	// MDNS serves the apps under the names that mDNS advertises them as too
+	MDNS bool
+	// MDNSHostname is the hostname in the mDNS names of the apps if set
+	MDNSHostname string
+	Debug        bool
+	Logger       *zap.Logger
 }
 
 func New(cfg Config) candy.ProxyServer {
@@ -41,17 +61,72 @@ func New(cfg Config) candy.ProxyServer {
 		apps: candy.NewAppService(candy.AppServiceConfig{
 			TLDs:     cfg.TLDs,
 			HostRoot: cfg.HostRoot,
+			TLS:      cfg.TLS,
+			HTTPS:    cfg.HTTPS,
 		}),
+		ready: runnable.NewReadySignal(),
 	}
 }
 
 type caddyServer struct {
-	ctx  context.Context
-	cfg  Config
-	apps *candy.AppService
+	ctx   context.Context
+	cfg   Config
+	apps  *candy.AppService
+	ready *runnable.ReadySignal
 
+	// caddyCfg is the last config that was loaded successfully
 	caddyCfg      *caddy.Config
 	caddyCfgMutex sync.Mutex
+
+	statusMutex    sync.Mutex
+	erroredApps    []appError
+	reloadErr      error
+	httpsProtocols []string
+	httpsListeners []string
+}
+
+// Status reports the protocols served over HTTPS, the apps left out of the
+// config and the last reload error
+func (c *caddyServer) Status() interface{} {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	st := struct {
+		HTTPSProtocols []string   `json:"https_protocols"`
+		HTTPSListeners []string   `json:"https_listeners"`
+		ErroredApps    []appError `json:"errored_apps,omitempty"`
+		ReloadError    string     `json:"reload_error,omitempty"`
+	}{
+		HTTPSProtocols: c.httpsProtocols,
+		HTTPSListeners: c.httpsListeners,
+		ErroredApps:    c.erroredApps,
+	}
+	if c.reloadErr != nil {
+		st.ReloadError = c.reloadErr.Error()
+	}
+
+	return st
+}
+
+func (c *caddyServer) setStatus(errored []appError, reloadErr error) {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	c.erroredApps = errored
+	c.reloadErr = reloadErr
+	// Failed reloads keep the listeners of the last config that loaded
+	if reloadErr == nil {
+		c.httpsProtocols = c.protocols()
+		c.httpsListeners = httpsListeners(c.cfg.HTTPSAddr, c.httpsProtocols)
+	}
+}
+
+func (c *caddyServer) protocols() []string {
+	if len(c.cfg.HTTPSProtocols) == 0 {
+		return DefaultProtocols
+	}
+
+	return c.cfg.HTTPSProtocols
 }
 
 func (c *caddyServer) waitForServer(ctx context.Context) error {
@@ -83,6 +158,9 @@ func (c *caddyServer) Run(ctx context.Context) error {
 
 	c.ctx = ctx
 
+	status.Register("proxy", c.Status)
+	defer status.Unregister("proxy")
+
 	if err := c.startServer(); err != nil {
 		return err
 	}
@@ -90,6 +168,7 @@ func (c *caddyServer) Run(ctx context.Context) error {
 	if err := c.waitForServer(ctx); err != nil {
 		return err
 	}
+	c.ready.Signal()
 
 	<-ctx.Done()
 
@@ -100,16 +179,22 @@ func (c *caddyServer) Run(ctx context.Context) error {
 	return ctx.Err()
 }
 
+// Ready is closed once the Caddy admin API responds
+func (c *caddyServer) Ready() <-chan struct{} {
+	return c.ready.Ready()
+}
+
 func (c *caddyServer) startServer() error {
 	c.caddyCfgMutex.Lock()
 	defer c.caddyCfgMutex.Unlock()
 
 	caddy.TrapSignals()
 
-	ccfg, err := c.loadConfig()
+	ccfg, errored, err := c.loadConfig()
 	if err != nil {
 		return fmt.Errorf("error loading Caddy config: %w", err)
 	}
+	c.setStatus(errored, nil)
 
 	c.caddyCfg = ccfg
 
@@ -128,17 +213,81 @@ func (c *caddyServer) Reload() error {
 	c.caddyCfgMutex.Lock()
 	defer c.caddyCfgMutex.Unlock()
 
-	ccfg, err := c.loadConfig()
+	return c.reload()
+}
+
+func (c *caddyServer) Reconfigure(tlds []string, httpAddr, httpsAddr string) error {
+	c.cfg.Logger.Info("reconfiguring Caddy server", zap.Strings("tlds", tlds), zap.String("http_addr", httpAddr), zap.String("https_addr", httpsAddr))
+
+	c.caddyCfgMutex.Lock()
+	defer c.caddyCfgMutex.Unlock()
+
+	oldCfg := c.cfg
+	c.cfg.TLDs = tlds
+	c.cfg.HTTPAddr = httpAddr
+	c.cfg.HTTPSAddr = httpsAddr
+	c.apps.SetTLDs(tlds)
+
+	if err := c.reload(); err != nil {
+		c.cfg = oldCfg
+		c.apps.SetTLDs(oldCfg.TLDs)
+		return err
+	}
+
+	return nil
+}
+
+// reload validates the config of the current apps and applies it.
+// If applying fails, the last config that loaded successfully is restored.
+func (c *caddyServer) reload() error {
+	ccfg, errored, err := c.loadConfig()
 	if err != nil {
-		return fmt.Errorf("error reloading Caddy config: %w", err)
+		err = fmt.Errorf("error reloading Caddy config: %w", err)
+		c.setStatus(errored, err)
+		return err
+	}
+
+	for _, app := range errored {
+		c.cfg.Logger.Error("app left out of Caddy config", zap.String("host", app.Host), zap.String("addr", app.Addr), zap.String("file", app.File), zap.String("error", app.Error))
 	}
 
 	if jsonEqual(c.caddyCfg, ccfg) {
 		c.cfg.Logger.Info("Caddy server unchanged")
+		c.setStatus(errored, nil)
 		return nil
 	}
 
+	err = c.apply(ccfg)
+	c.setStatus(errored, err)
+
+	return err
+}
+
+// apply changes the running config to ccfg. Route and TLS subject changes
+// are made through targeted admin API calls that leave the other apps and
+// the listeners alone. Anything else, e.g. a listener change, loads the
+// full config. If loading fails, the last config that loaded successfully
+// is restored.
+func (c *caddyServer) apply(ccfg *caddy.Config) error {
+	// Caddy reloads its config on every admin API change, so past a few
+	// calls one /load is cheaper
+	if ops, ok := diffConfig(c.caddyCfg, ccfg); ok && len(ops) <= maxConfigOps {
+		err := c.applyOps(ops)
+		if err == nil {
+			c.caddyCfg = ccfg
+			return nil
+		}
+
+		c.cfg.Logger.Error("error applying Caddy config changes, loading full config", zap.Error(err))
+	}
+
 	if err := c.apiRequest(c.ctx, http.MethodPost, "/load", ccfg); err != nil {
+		c.cfg.Logger.Error("error applying Caddy config, rolling back to the last good config", zap.Error(err))
+
+		if rerr := c.apiRequest(c.ctx, http.MethodPost, "/load", c.caddyCfg); rerr != nil {
+			err = fmt.Errorf("%w, error rolling back: %v", err, rerr)
+		}
+
 		return err
 	}
 
@@ -147,40 +296,77 @@ func (c *caddyServer) Reload() error {
 	return nil
 }
 
-func (c *caddyServer) loadConfig() (*caddy.Config, error) {
-	apps, err := c.apps.FindApps()
+// applyOps applies targeted config changes so that unchanged apps and
+// listeners are left alone
+func (c *caddyServer) applyOps(ops []apiOp) error {
+	for _, op := range ops {
+		c.cfg.Logger.Info("updating Caddy config", zap.Stringer("op", op))
+
+		if err := c.apiRequest(c.ctx, op.Method, op.Path, op.Body); err != nil {
+			return fmt.Errorf("error applying %s: %w", op, err)
+		}
+	}
+
+	return nil
+}
+
+// loadConfig builds the config of the valid apps in the host root and
+// returns the invalid ones
+func (c *caddyServer) loadConfig() (*caddy.Config, []appError, error) {
+	apps, invalid, err := c.apps.FindApps()
 	if err != nil {
-		return nil, fmt.Errorf("error loading apps: %w", err)
+		return nil, nil, fmt.Errorf("error loading apps: %w", err)
 	}
 
-	return c.buildConfig(apps), nil
+	// TCP apps are served by the TCP proxy
+	httpApps := apps[:0]
+	for _, app := range apps {
+		if app.TCP.IsZero() {
+			httpApps = append(httpApps, app)
+		}
+	}
+
+	apps, errored, err := c.validApps(httpApps)
+	if err != nil {
+		return nil, fileErrors(invalid), err
+	}
+
+	return c.buildConfig(apps), append(fileErrors(invalid), errored...), nil
 }
 
 func (c *caddyServer) buildConfig(apps []candy.App) *caddy.Config {
+	apps = c.mdnsApps(apps)
+
+	// Best efforts of parsing corresponding port from addr
+	// If they are 0, Caddy will use the default ports
+	// See https://caddyserver.com/docs/json/apps/http/http_port
+	_, httpPortStr, _ := net.SplitHostPort(c.cfg.HTTPAddr)
+	_, httpsPortStr, _ := net.SplitHostPort(c.cfg.HTTPSAddr)
+	httpPort, _ := strconv.Atoi(httpPortStr)
+	httpsPort, _ := strconv.Atoi(httpsPortStr)
+
 	httpServer := &caddyhttp.Server{
 		Routes: caddyRoutes(
 			apps,
+			httpsPort,
 		),
-		Listen:    []string{c.cfg.HTTPAddr},
+		Listen: []string{c.cfg.HTTPAddr},
+		// Plain text HTTP/2 lets gRPC clients without TLS reach h2c apps
+		Protocols: []string{"h1", "h2c"},
 		AutoHTTPS: &caddyhttp.AutoHTTPSConfig{Disabled: true, DisableRedir: true},
 		Logs:      &caddyhttp.ServerLogConfig{},
 	}
 
 	httpsServer := &caddyhttp.Server{
-		Routes: caddyRoutes(
-			apps,
+		Routes: append(
+			c.dohRoutes(),
+			caddyRoutes(apps, httpsPort)...,
 		),
-		Listen: []string{c.cfg.HTTPSAddr},
+		Listen:          []string{c.cfg.HTTPSAddr},
+		Protocols:       c.protocols(),
+		TLSConnPolicies: c.connPolicies(apps),
 	}
 
-	// Best efforts of parsing corresponding port from addr
-	// If they are 0, Caddy will use the default ports
-	// See https://caddyserver.com/docs/json/apps/http/http_port
-	_, httpPortStr, _ := net.SplitHostPort(c.cfg.HTTPAddr)
-	_, httpsPortStr, _ := net.SplitHostPort(c.cfg.HTTPSAddr)
-	httpPort, _ := strconv.Atoi(httpPortStr)
-	httpsPort, _ := strconv.Atoi(httpsPortStr)
-
 	httpApp := caddyhttp.App{
 		HTTPPort:  httpPort,
 		HTTPSPort: httpsPort,
@@ -190,15 +376,18 @@ func (c *caddyServer) buildConfig(apps []candy.App) *caddy.Config {
 		},
 	}
 
-	tls := caddytls.TLS{
-		Automation: &caddytls.AutomationConfig{
-			Policies: []*caddytls.AutomationPolicy{
-				{
-					SubjectsRaw: appHosts(apps),
-					IssuersRaw:  []json.RawMessage{json.RawMessage(`{"module":"internal"}`)},
-				},
-			},
-		},
+	hosts := make([]hostTLS, 0, len(apps))
+	for _, app := range apps {
+		hosts = append(hosts, hostTLS{Host: app.Host, TLS: app.TLS})
+	}
+	for _, host := range c.dohHosts() {
+		hosts = append(hosts, hostTLS{Host: host, TLS: c.cfg.TLS})
+	}
+
+	tls, pki, ownHosts := tlsApps(hosts)
+	if len(ownHosts) > 0 {
+		// Serve the certificates the hosts bring as is
+		httpsServer.AutoHTTPS = &caddyhttp.AutoHTTPSConfig{SkipCerts: ownHosts}
 	}
 
 	ccfg := &caddy.Config{
@@ -207,6 +396,12 @@ func (c *caddyServer) buildConfig(apps []candy.App) *caddy.Config {
 			"tls":  caddyconfig.JSON(tls, nil),
 		},
 	}
+	if pki != nil {
+		ccfg.AppsRaw["pki"] = caddyconfig.JSON(pki, nil)
+	}
+	if c.cfg.StorageDir != "" {
+		ccfg.StorageRaw = caddyconfig.JSONModuleObject(filestorage.FileStorage{Root: c.cfg.StorageDir}, "module", "file_system", nil)
+	}
 	if c.cfg.Debug {
 		ccfg.Logging = &caddy.Logging{
 			Logs: map[string]*caddy.CustomLog{
@@ -225,12 +420,85 @@ func (c *caddyServer) buildConfig(apps []candy.App) *caddy.Config {
 }
 
 func (c *caddyServer) apiRequest(ctx context.Context, method, uri string, v interface{}) error {
+	return adminRequest(ctx, c.cfg.AdminAddr, method, uri, v, nil)
+}
+
+// Status returns the status of the Candy server listening on the admin address
+func Status(ctx context.Context, adminAddr string) (map[string]json.RawMessage, error) {
+	var result map[string]json.RawMessage
+	if err := adminRequest(ctx, adminAddr, http.MethodGet, statusPath, nil, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ReloadCA makes the Candy server listening on the admin address load its
+// local CA and certificates from storage again, e.g. after they're removed
+// to be regenerated
+func ReloadCA(ctx context.Context, adminAddr string) error {
+	var cfg json.RawMessage
+	if err := adminRequest(ctx, adminAddr, http.MethodGet, "/config/", nil, &cfg); err != nil {
+		return err
+	}
+
+	var stripped, apps map[string]json.RawMessage
+	if err := json.Unmarshal(cfg, &stripped); err != nil {
+		return fmt.Errorf("error decoding Caddy config: %w", err)
+	}
+	if err := json.Unmarshal(stripped["apps"], &apps); err != nil {
+		return fmt.Errorf("error decoding Caddy apps: %w", err)
+	}
+
+	// Caddy keeps the certificates it manages cached in memory across
+	// reloads. Loading a config without the TLS app and the HTTPS server,
+	// which depends on it, drops the cache so that the certificates are
+	// issued again by the new CA.
+	delete(apps, "tls")
+	if b, ok := apps["http"]; ok {
+		var httpApp, servers map[string]json.RawMessage
+		if err := json.Unmarshal(b, &httpApp); err != nil {
+			return fmt.Errorf("error decoding Caddy http app: %w", err)
+		}
+		if err := json.Unmarshal(httpApp["servers"], &servers); err != nil {
+			return fmt.Errorf("error decoding Caddy http servers: %w", err)
+		}
+		delete(servers, "https")
+
+		httpApp["servers"] = mustJSON(servers)
+		apps["http"] = mustJSON(httpApp)
+	}
+	stripped["apps"] = mustJSON(apps)
+
+	if err := adminRequest(ctx, adminAddr, http.MethodPost, "/load", stripped, nil); err != nil {
+		return fmt.Errorf("error unloading certificates: %w", err)
+	}
+
+	if err := adminRequest(ctx, adminAddr, http.MethodPost, "/load", cfg, nil); err != nil {
+		return fmt.Errorf("error reloading Caddy config: %w", err)
+	}
+
+	return nil
+}
+
+func mustJSON(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// adminRequest makes a request to the Caddy admin API with v as the JSON body
+// and decodes the JSON response into out if it's not nil
+func adminRequest(ctx context.Context, adminAddr, method, uri string, v, out interface{}) error {
 	ctx, cancel := context.WithTimeout(ctx, caddyAPITimeout)
 	defer cancel()
 
-	parsedAddr, err := caddy.ParseNetworkAddress(c.cfg.AdminAddr)
+	parsedAddr, err := caddy.ParseNetworkAddress(adminAddr)
 	if err != nil || parsedAddr.PortRangeSize() > 1 {
-		return fmt.Errorf("invalid admin address %s: %v", c.cfg.AdminAddr, err)
+		return fmt.Errorf("invalid admin address %s: %v", adminAddr, err)
 	}
 	origin := parsedAddr.JoinHostPort(0)
 	if parsedAddr.IsUnixNetwork() {
@@ -301,31 +569,42 @@ func (c *caddyServer) apiRequest(ctx context.Context, method, uri string, v inte
 		return fmt.Errorf("caddy responded with error: HTTP %d: %s", resp.StatusCode, respBody)
 	}
 
-	return nil
-}
-
-func appHosts(apps []candy.App) []string {
-	var hosts []string
-
-	for _, app := range apps {
-		hosts = append(hosts, app.Host)
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("error decoding response: %w", err)
+		}
 	}
 
-	return hosts
+	return nil
 }
 
-func caddyRoutes(apps []candy.App) []caddyhttp.Route {
+// caddyRoutes returns the routes of apps. httpsPort is where HTTP requests
+// to the apps that enforce HTTPS are redirected to.
+func caddyRoutes(apps []candy.App, httpsPort int) []caddyhttp.Route {
 	var routes caddyhttp.RouteList
 
 	for _, app := range apps {
 		handler := reverseproxy.Handler{
-			TransportRaw: caddyconfig.JSONModuleObject(reverseproxy.HTTPTransport{}, "protocol", "http", nil),
+			TransportRaw: caddyconfig.JSONModuleObject(upstreamTransport(app), "protocol", "http", nil),
 			Upstreams:    reverseproxy.UpstreamPool{{Dial: app.Addr}},
 		}
+		// Stream the responses of HTTP/2 upstreams as they come, e.g. gRPC
+		// streams. Caddy already streams server-sent events and responses
+		// without a length for any upstream.
+		if app.Protocol == candy.UpstreamH2C || app.Protocol == candy.UpstreamH2 {
+			handler.FlushInterval = caddy.Duration(-1)
+		}
+		var handlers []json.RawMessage
+		if h := httpsHandler(app, httpsPort); h != nil {
+			handlers = append(handlers, h)
+		}
+		if h := clientAuthHandler(app); h != nil {
+			handlers = append(handlers, h)
+		}
+		handlers = append(handlers, caddyconfig.JSONModuleObject(handler, "handler", "reverse_proxy", nil))
+
 		route := caddyhttp.Route{
-			HandlersRaw: []json.RawMessage{
-				caddyconfig.JSONModuleObject(handler, "handler", "reverse_proxy", nil),
-			},
+			HandlersRaw: handlers,
 			MatcherSetsRaw: []caddy.ModuleMap{
 				{
 					"host": caddyconfig.JSON(caddyhttp.MatchHost{app.Host}, nil),
@@ -340,6 +619,67 @@ func caddyRoutes(apps []candy.App) []caddyhttp.Route {
 	return routes
 }
 
+// upstreamTransport returns the transport that speaks the protocol of app
+// to its upstream
+func upstreamTransport(app candy.App) reverseproxy.HTTPTransport {
+	switch app.Protocol {
+	case candy.UpstreamH2C:
+		return reverseproxy.HTTPTransport{Versions: []string{"h2c", "2"}}
+	case candy.UpstreamH2:
+		return reverseproxy.HTTPTransport{
+			Versions: []string{"2"},
+			TLS:      &reverseproxy.TLSConfig{InsecureSkipVerify: app.TLSInsecureSkipVerify},
+		}
+	default:
+		return reverseproxy.HTTPTransport{}
+	}
+}
+
+func (c *caddyServer) dohHosts() []string {
+	if c.cfg.DoHAddr == "" {
+		return nil
+	}
+
+	var hosts []string
+	for _, tld := range c.cfg.TLDs {
+		hosts = append(hosts, candy.ResolverHost(tld))
+	}
+
+	return hosts
+}
+
+func (c *caddyServer) dohRoutes() []caddyhttp.Route {
+	hosts := c.dohHosts()
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	handler := reverseproxy.Handler{
+		TransportRaw: caddyconfig.JSONModuleObject(reverseproxy.HTTPTransport{}, "protocol", "http", nil),
+		Upstreams:    reverseproxy.UpstreamPool{{Dial: c.cfg.DoHAddr}},
+		Headers: &headers.Handler{
+			Request: &headers.HeaderOps{
+				Set: http.Header{candy.DoHTokenHeader: []string{c.cfg.DoHToken}},
+			},
+		},
+	}
+
+	return []caddyhttp.Route{
+		{
+			HandlersRaw: []json.RawMessage{
+				caddyconfig.JSONModuleObject(handler, "handler", "reverse_proxy", nil),
+			},
+			MatcherSetsRaw: []caddy.ModuleMap{
+				{
+					"host": caddyconfig.JSON(caddyhttp.MatchHost(hosts), nil),
+					"path": caddyconfig.JSON(caddyhttp.MatchPath{"/dns-query"}, nil),
+				},
+			},
+			Terminal: true,
+		},
+	}
+}
+
 func jsonEqual(v1, v2 interface{}) bool {
 	b1, err := json.Marshal(v1)
 	if err != nil {
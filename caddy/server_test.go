@@ -0,0 +1,84 @@
+package caddy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/owenthereal/candy"
+)
+
+func Test_caddyRoutes_Upstream(t *testing.T) {
+	type tlsConfig struct {
+		InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	}
+	type transport struct {
+		Versions []string   `json:"versions"`
+		TLS      *tlsConfig `json:"tls"`
+	}
+
+	cases := []struct {
+		Name              string
+		App               candy.App
+		WantTransport     transport
+		WantFlushInterval int64
+	}{
+		{
+			Name: "h1",
+			App:  candy.App{Host: "web.test", Addr: "127.0.0.1:8080"},
+		},
+		{
+			Name:              "h2c",
+			App:               candy.App{Host: "grpc.test", Addr: "127.0.0.1:50051", Protocol: candy.UpstreamH2C},
+			WantTransport:     transport{Versions: []string{"h2c", "2"}},
+			WantFlushInterval: -1,
+		},
+		{
+			Name: "h2 skipping verification",
+			App:  candy.App{Host: "api.test", Addr: "127.0.0.1:8443", Protocol: candy.UpstreamH2, TLSInsecureSkipVerify: true},
+			WantTransport: transport{
+				Versions: []string{"2"},
+				TLS:      &tlsConfig{InsecureSkipVerify: true},
+			},
+			WantFlushInterval: -1,
+		},
+		{
+			Name: "h2 verifying",
+			App:  candy.App{Host: "api.test", Addr: "127.0.0.1:8443", Protocol: candy.UpstreamH2},
+			WantTransport: transport{
+				Versions: []string{"2"},
+				TLS:      &tlsConfig{},
+			},
+			WantFlushInterval: -1,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			routes := caddyRoutes([]candy.App{cc.App}, 443)
+			if len(routes) != 1 {
+				t.Fatalf("unexpected routes: %v", routes)
+			}
+
+			// The reverse proxy is the last handler
+			handlers := routes[0].HandlersRaw
+			var handler struct {
+				FlushInterval int64     `json:"flush_interval"`
+				Transport     transport `json:"transport"`
+			}
+			if err := json.Unmarshal(handlers[len(handlers)-1], &handler); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(cc.WantTransport, handler.Transport); diff != "" {
+				t.Fatalf("mismatch transport (-want +got): %s", diff)
+			}
+			if want, got := cc.WantFlushInterval, handler.FlushInterval; want != got {
+				t.Fatalf("mismatch flush interval: want=%d got=%d", want, got)
+			}
+		})
+	}
+}
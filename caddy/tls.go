@@ -0,0 +1,136 @@
+package caddy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddypki"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/owenthereal/candy"
+)
+
+// hostTLS is where the certificate of a host comes from
+type hostTLS struct {
+	Host string
+	TLS  candy.TLS
+}
+
+// tlsApps builds the TLS app and, if custom CAs are used, the PKI app that
+// provide the certificates of hosts. Certificates are issued by the local
+// CA unless a host brings its own certificate or CA. The hosts with their
+// own certificate are returned so that automatic HTTPS skips them.
+func tlsApps(hosts []hostTLS) (caddytls.TLS, *caddypki.PKI, []string) {
+	var (
+		localHosts []string
+		ownHosts   []string
+		files      caddytls.FileLoader
+		loaded     = make(map[candy.TLS]bool)
+		caIDs      []string
+		caHosts    = make(map[string][]string)
+		cas        = make(map[string]candy.TLS)
+	)
+
+	for _, h := range hosts {
+		host, t := h.Host, h.TLS
+		switch {
+		case t.CertFile != "":
+			ownHosts = append(ownHosts, host)
+			if !loaded[t] {
+				loaded[t] = true
+				files = append(files, caddytls.CertKeyFilePair{Certificate: t.CertFile, Key: t.KeyFile})
+			}
+		case t.CACertFile != "":
+			id := caID(t)
+			if _, ok := cas[id]; !ok {
+				caIDs = append(caIDs, id)
+				cas[id] = t
+			}
+			caHosts[id] = append(caHosts[id], host)
+		default:
+			localHosts = append(localHosts, host)
+		}
+	}
+
+	app := caddytls.TLS{
+		Automation: &caddytls.AutomationConfig{},
+	}
+
+	if len(files) > 0 {
+		app.CertificatesRaw = map[string]json.RawMessage{
+			"load_files": caddyconfig.JSON(files, nil),
+		}
+	}
+
+	var pki *caddypki.PKI
+	if len(cas) > 0 {
+		pki = &caddypki.PKI{
+			CAs: map[string]*caddypki.CA{
+				// The local CA is only provisioned implicitly if no CA is configured
+				caddypki.DefaultCAID: {},
+			},
+		}
+	}
+
+	// The policies of the custom CAs go first as the local CA's may match any host
+	noTrust := false
+	sort.Strings(caIDs)
+	for _, id := range caIDs {
+		t := cas[id]
+		pki.CAs[id] = &caddypki.CA{
+			Name: "Candy Custom CA",
+			Root: &caddypki.KeyPair{
+				Certificate: t.CACertFile,
+				PrivateKey:  t.CAKeyFile,
+			},
+			// A custom CA is trusted already, don't install it
+			InstallTrust: &noTrust,
+		}
+
+		app.Automation.Policies = append(app.Automation.Policies, &caddytls.AutomationPolicy{
+			SubjectsRaw: caHosts[id],
+			IssuersRaw:  []json.RawMessage{caddyconfig.JSONModuleObject(caddytls.InternalIssuer{CA: id}, "module", "internal", nil)},
+		})
+	}
+
+	app.Automation.Policies = append(app.Automation.Policies, &caddytls.AutomationPolicy{
+		SubjectsRaw: localHosts,
+		IssuersRaw:  []json.RawMessage{json.RawMessage(`{"module":"internal"}`)},
+	})
+
+	return app, pki, ownHosts
+}
+
+// caID identifies a custom CA in the PKI app by its files
+func caID(t candy.TLS) string {
+	sum := sha256.Sum256([]byte(t.CACertFile + "\x00" + t.CAKeyFile))
+	return "candy-" + hex.EncodeToString(sum[:4])
+}
+
+// checkCertificate checks that the certificate of an app is valid for its host
+func checkCertificate(app candy.App) error {
+	if app.TLS.CertFile == "" {
+		return nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(app.TLS.CertFile, app.TLS.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate %s: %w", app.TLS.CertFile, err)
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error parsing certificate %s: %w", app.TLS.CertFile, err)
+	}
+
+	if err := leaf.VerifyHostname(app.Host); err != nil {
+		return fmt.Errorf("certificate %s is not valid for %s: %w", app.TLS.CertFile, app.Host, err)
+	}
+
+	return nil
+}
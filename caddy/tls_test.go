@@ -0,0 +1,92 @@
+package caddy
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/owenthereal/candy"
+)
+
+func Test_tlsApps(t *testing.T) {
+	var (
+		own = candy.TLS{CertFile: "/certs/app.crt", KeyFile: "/certs/app.key"}
+		ca  = candy.TLS{CACertFile: "/certs/ca.crt", CAKeyFile: "/certs/ca.key"}
+	)
+
+	cases := []struct {
+		Name         string
+		Hosts        []hostTLS
+		WantPolicies []string
+		WantFiles    string
+		WantCAs      []string
+		WantOwn      []string
+	}{
+		{
+			Name: "local CA",
+			Hosts: []hostTLS{
+				{Host: "app.test"},
+				{Host: "candy.test"},
+			},
+			WantPolicies: []string{`["app.test","candy.test"] {"module":"internal"}`},
+		},
+		{
+			Name: "own certificates",
+			Hosts: []hostTLS{
+				{Host: "app.test", TLS: own},
+				{Host: "app.dev", TLS: own},
+				{Host: "candy.test"},
+			},
+			WantPolicies: []string{`["candy.test"] {"module":"internal"}`},
+			WantFiles:    `[{"certificate":"/certs/app.crt","key":"/certs/app.key"}]`,
+			WantOwn:      []string{"app.test", "app.dev"},
+		},
+		{
+			Name: "custom CA",
+			Hosts: []hostTLS{
+				{Host: "app.test", TLS: ca},
+				{Host: "candy.test"},
+			},
+			WantPolicies: []string{
+				`["app.test"] {"ca":"` + caID(ca) + `","module":"internal"}`,
+				`["candy.test"] {"module":"internal"}`,
+			},
+			WantCAs: []string{caID(ca), "local"},
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			app, pki, ownHosts := tlsApps(cc.Hosts)
+
+			var policies []string
+			for _, p := range app.Automation.Policies {
+				policies = append(policies, string(mustJSON(p.SubjectsRaw))+" "+string(p.IssuersRaw[0]))
+			}
+			if diff := cmp.Diff(cc.WantPolicies, policies); diff != "" {
+				t.Fatalf("Unexpected policies (-want +got): %s", diff)
+			}
+
+			if diff := cmp.Diff(cc.WantFiles, string(app.CertificatesRaw["load_files"])); diff != "" {
+				t.Fatalf("Unexpected certificate files (-want +got): %s", diff)
+			}
+
+			var cas []string
+			if pki != nil {
+				for id := range pki.CAs {
+					cas = append(cas, id)
+				}
+			}
+			if diff := cmp.Diff(cc.WantCAs, cas, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Fatalf("Unexpected CAs (-want +got): %s", diff)
+			}
+
+			if diff := cmp.Diff(cc.WantOwn, ownHosts); diff != "" {
+				t.Fatalf("Unexpected own hosts (-want +got): %s", diff)
+			}
+		})
+	}
+}
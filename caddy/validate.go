@@ -0,0 +1,146 @@
+package caddy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/owenthereal/candy"
+)
+
+// appError is an app that was left out of the config because it's invalid,
+// or an app file that can't be parsed
+type appError struct {
+	Host  string `json:"host,omitempty"`
+	Addr  string `json:"addr,omitempty"`
+	File  string `json:"file,omitempty"`
+	Error string `json:"error"`
+}
+
+// fileErrors returns the app files that can't be parsed as appErrors
+func fileErrors(invalid []candy.AppFileError) []appError {
+	var errored []appError
+	for _, f := range invalid {
+		errored = append(errored, appError{File: f.File, Error: f.Error()})
+	}
+
+	return errored
+}
+
+// validApps returns the apps that can be loaded into Caddy along with the
+// errors of the ones that can't. It returns an error if the config is
+// invalid regardless of the apps. The apps are checked without Caddy first,
+// then the config is provisioned once and only bisected if that fails.
+func (c *caddyServer) validApps(apps []candy.App) ([]candy.App, []appError, error) {
+	var (
+		checked []candy.App
+		errored []appError
+	)
+	for _, app := range apps {
+		if err := checkApp(app); err != nil {
+			errored = append(errored, appError{Host: app.Host, Addr: app.Addr, Error: err.Error()})
+			continue
+		}
+		checked = append(checked, app)
+	}
+
+	if err := c.validate(checked); err != nil {
+		if err := c.validate(nil); err != nil {
+			return nil, nil, fmt.Errorf("invalid Caddy config: %w", err)
+		}
+
+		invalid := c.invalidApps(checked, err)
+		valid := checked[:0:0]
+		for _, app := range checked {
+			if err, ok := invalid[app]; ok {
+				errored = append(errored, appError{Host: app.Host, Addr: app.Addr, Error: err.Error()})
+				continue
+			}
+			valid = append(valid, app)
+		}
+		checked = valid
+	}
+
+	sort.Slice(errored, func(i, j int) bool {
+		return errored[i].Host < errored[j].Host
+	})
+
+	return checked, errored, nil
+}
+
+// invalidApps bisects apps, which fail validation with err, to find the
+// ones that fail on their own
+func (c *caddyServer) invalidApps(apps []candy.App, err error) map[candy.App]error {
+	if len(apps) == 1 {
+		return map[candy.App]error{apps[0]: err}
+	}
+
+	result := make(map[candy.App]error)
+	for _, half := range [][]candy.App{apps[:len(apps)/2], apps[len(apps)/2:]} {
+		if err := c.validate(half); err != nil {
+			for app, err := range c.invalidApps(half, err) {
+				result[app] = err
+			}
+		}
+	}
+
+	return result
+}
+
+// validate provisions the config of apps without running it
+func (c *caddyServer) validate(apps []candy.App) error {
+	// Provisioning consumes the raw modules of the config, build a new one
+	ccfg := c.buildConfig(apps)
+
+	// The running config was provisioned when it was loaded
+	if c.caddyCfg != nil && jsonEqual(c.caddyCfg, ccfg) {
+		return nil
+	}
+
+	return caddy.Validate(ccfg)
+}
+
+// checkApp checks what Caddy only finds out when proxying, e.g. the upstream
+// address or a certificate that doesn't match the host, and the files that
+// would fail provisioning, which is much slower to find out with Caddy
+func checkApp(app candy.App) error {
+	addr, err := caddy.ParseNetworkAddress(app.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid upstream address %q: %w", app.Addr, err)
+	}
+
+	if !addr.IsUnixNetwork() && (addr.StartPort == 0 || addr.PortRangeSize() != 1) {
+		return fmt.Errorf("invalid upstream address %q: a single port is required", app.Addr)
+	}
+
+	if err := checkCertificate(app); err != nil {
+		return err
+	}
+
+	return checkCAs(app)
+}
+
+// checkCAs checks that the custom CA of an app and the CA of its client
+// certificates can be loaded
+func checkCAs(app candy.App) error {
+	if app.TLS.CACertFile != "" {
+		if _, err := tls.LoadX509KeyPair(app.TLS.CACertFile, app.TLS.CAKeyFile); err != nil {
+			return fmt.Errorf("error loading CA %s: %w", app.TLS.CACertFile, err)
+		}
+	}
+
+	if app.ClientAuth.CACertFile != "" {
+		b, err := os.ReadFile(app.ClientAuth.CACertFile)
+		if err != nil {
+			return fmt.Errorf("error loading client CA: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates in client CA %s", app.ClientAuth.CACertFile)
+		}
+	}
+
+	return nil
+}
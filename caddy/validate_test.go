@@ -0,0 +1,82 @@
+package caddy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/owenthereal/candy"
+)
+
+func Test_checkApp(t *testing.T) {
+	cases := []struct {
+		Addr    string
+		WantErr bool
+	}{
+		{Addr: "127.0.0.1:8080"},
+		{Addr: "localhost:8080"},
+		{Addr: "unix//tmp/app.sock"},
+		{Addr: "", WantErr: true},
+		{Addr: "localhost", WantErr: true},
+		{Addr: "localhost:abc", WantErr: true},
+		{Addr: "localhost:0", WantErr: true},
+		{Addr: "localhost:8080-8081", WantErr: true},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Addr, func(t *testing.T) {
+			t.Parallel()
+
+			err := checkApp(candy.App{Host: "app.test", Addr: cc.Addr})
+			if got := err != nil; got != cc.WantErr {
+				t.Fatalf("mismatch error: want=%t got=%v", cc.WantErr, err)
+			}
+		})
+	}
+}
+
+func Test_checkCAs(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Name    string
+		App     candy.App
+		WantErr bool
+	}{
+		{
+			Name: "no CAs",
+			App:  candy.App{Host: "app.test"},
+		},
+		{
+			Name:    "missing CA",
+			App:     candy.App{Host: "app.test", TLS: candy.TLS{CACertFile: "/missing/ca.crt", CAKeyFile: "/missing/ca.key"}},
+			WantErr: true,
+		},
+		{
+			Name:    "missing client CA",
+			App:     candy.App{Host: "app.test", ClientAuth: candy.ClientAuth{Mode: candy.ClientAuthRequire, CACertFile: "/missing/ca.crt"}},
+			WantErr: true,
+		},
+		{
+			Name:    "client CA without certificates",
+			App:     candy.App{Host: "app.test", ClientAuth: candy.ClientAuth{Mode: candy.ClientAuthRequire, CACertFile: notPEM}},
+			WantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			err := checkCAs(cc.App)
+			if got := err != nil; got != cc.WantErr {
+				t.Fatalf("mismatch error: want=%t got=%v", cc.WantErr, err)
+			}
+		})
+	}
+}
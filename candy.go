@@ -1,6 +1,10 @@
 package candy
 
 import (
+	"fmt"
+	"os"
+	"strings"
+
 	"github.com/caddyserver/caddy/v2"
 	"github.com/owenthereal/candy/runnable"
 	"go.uber.org/zap"
@@ -8,15 +12,70 @@ import (
 
 type ProxyServer interface {
 	runnable.Runable
+	runnable.Readier
 	Reload() error
+	// Reconfigure changes the top-level domains and listener addresses of the running server
+	Reconfigure(tlds []string, httpAddr, httpsAddr string) error
 }
 
 type DNSServer interface {
 	runnable.Runable
+	runnable.Readier
+	// SetTLDs changes the top-level domains the running server responds to
+	SetTLDs(tlds []string)
+}
+
+type MDNSServer interface {
+	runnable.Runable
+	runnable.Readier
+	Reload() error
+}
+
+type TCPProxy interface {
+	runnable.Runable
+	runnable.Readier
+	Reload() error
+	// SetTLDs changes the top-level domains that the apps are routed under
+	SetTLDs(tlds []string)
 }
 
 type Watcher interface {
 	runnable.Runable
+	runnable.Readier
+}
+
+// DoHTokenHeader carries the secret that Caddy adds to the DNS-over-HTTPS
+// requests it proxies, so that the DNS server trusts their X-Forwarded-For
+const DoHTokenHeader = "X-Candy-Doh-Token"
+
+// ResolverHost returns the hostname of Candy's own DNS-over-HTTPS and
+// DNS-over-TLS resolver for a top-level domain, e.g. candy.test
+func ResolverHost(tld string) string {
+	return "candy." + tld
+}
+
+// MDNSTLD is the top-level domain that apps are advertised under by mDNS
+const MDNSTLD = "local"
+
+// MDNSHost returns the name that mDNS advertises an app of the host root
+// as, e.g. myapp.local, or myapp-laptop.local with the hostname laptop
+func MDNSHost(app, hostname string) string {
+	if hostname != "" {
+		app += "-" + hostname
+	}
+
+	return strings.ToLower(app) + "." + MDNSTLD
+}
+
+// MDNSHostname returns the first label of the hostname of the machine,
+// which tells the apps of several machines on the LAN apart
+func MDNSHostname() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("error getting hostname: %w", err)
+	}
+
+	return strings.ToLower(strings.Split(hostname, ".")[0]), nil
 }
 
 func Log() *zap.Logger {
@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/owenthereal/candy/ca"
+	"github.com/owenthereal/candy/caddy"
+	"github.com/owenthereal/candy/server"
+	"github.com/spf13/cobra"
+)
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manages the local CA that issues the certificates of the apps",
+}
+
+var caExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Prints the root and intermediate certificates of the local CA",
+	Args:  cobra.NoArgs,
+	RunE:  caExportRunE,
+}
+
+var caInfoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Shows the fingerprints and expiry of the local CA",
+	Args:  cobra.NoArgs,
+	RunE:  caInfoRunE,
+}
+
+var caIssueClientCmd = &cobra.Command{
+	Use:   "issue-client <name>",
+	Short: "Issues a client certificate from the local CA for apps that authenticate clients",
+	Args:  cobra.ExactArgs(1),
+	RunE:  caIssueClientRunE,
+}
+
+var caRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Regenerates the local CA and the certificates it issued",
+	Args:  cobra.NoArgs,
+	RunE:  caRotateRunE,
+}
+
+func init() {
+	rootCmd.AddCommand(caCmd)
+	caCmd.AddCommand(caExportCmd, caInfoCmd, caIssueClientCmd, caRotateCmd)
+
+	for _, cmd := range []*cobra.Command{caExportCmd, caInfoCmd, caIssueClientCmd, caRotateCmd} {
+		cmd.Flags().String("state-dir", defaultStateDir(), "The --state-dir of Candy, used if Candy isn't running")
+		cmd.Flags().String("admin-addr", defaultAdminAddr, "The Proxy server administrative address")
+	}
+
+	caExportCmd.Flags().String("format", ca.FormatPEM, fmt.Sprintf("The format of the certificates: %s, %s, %s or %s", ca.FormatPEM, ca.FormatDER, ca.FormatJKS, ca.FormatPKCS12))
+	caExportCmd.Flags().String("cert", ca.CertAll, fmt.Sprintf("The certificates to export: %s, %s or %s", ca.CertRoot, ca.CertIntermediate, ca.CertAll))
+	caExportCmd.Flags().String("password", ca.DefaultPassword, "The password of the JKS or PKCS#12 trust store")
+	caExportCmd.Flags().StringP("output", "o", "", "The file to write to (stdout if empty)")
+	caInfoCmd.Flags().Bool("json", false, "Print as JSON")
+	caIssueClientCmd.Flags().Duration("lifetime", ca.DefaultClientLifetime, "How long the certificate is valid")
+	caIssueClientCmd.Flags().String("output-dir", ".", "The directory to write <name>.crt and <name>.key to")
+	caIssueClientCmd.Flags().Bool("pkcs12", false, "Also write <name>.p12, e.g. to import into a browser")
+	caIssueClientCmd.Flags().String("password", ca.DefaultPassword, "The password of <name>.p12")
+}
+
+type caOptions struct {
+	server.Config `mapstructure:",squash"`
+	Format        string
+	Cert          string
+	Password      string
+	Output        string
+	JSON          bool
+	Lifetime      time.Duration
+	OutputDir     string `mapstructure:"output-dir"`
+	PKCS12        bool
+}
+
+// caStorageDir returns the Caddy storage of the running Candy, or the one in
+// the state dir if Candy isn't running
+func caStorageDir(c *cobra.Command, opts caOptions) (string, bool) {
+	st, err := caddy.Status(c.Context(), opts.AdminAddr)
+	if err != nil {
+		return opts.CaddyStorageDir(), false
+	}
+
+	var state struct {
+		CaddyStorage string `json:"caddy_storage"`
+	}
+	if err := json.Unmarshal(st["state"], &state); err != nil {
+		return opts.CaddyStorageDir(), false
+	}
+
+	return state.CaddyStorage, true
+}
+
+func caExportRunE(c *cobra.Command, args []string) error {
+	var opts caOptions
+	if err := unmarshalFlags(flagConfigFile, c, &opts); err != nil {
+		return err
+	}
+
+	storageDir, _ := caStorageDir(c, opts)
+	authority, err := ca.Load(storageDir)
+	if err != nil {
+		return err
+	}
+
+	certs, err := authority.Certificates(opts.Cert)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if opts.Output != "" {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			return fmt.Errorf("error creating %s: %w", opts.Output, err)
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	return ca.Export(w, certs, opts.Format, opts.Password)
+}
+
+func caInfoRunE(c *cobra.Command, args []string) error {
+	var opts caOptions
+	if err := unmarshalFlags(flagConfigFile, c, &opts); err != nil {
+		return err
+	}
+
+	storageDir, _ := caStorageDir(c, opts)
+	authority, err := ca.Load(storageDir)
+	if err != nil {
+		return err
+	}
+
+	return printCAInfo(authority, opts.JSON)
+}
+
+func caRotateRunE(c *cobra.Command, args []string) error {
+	var opts caOptions
+	if err := unmarshalFlags(flagConfigFile, c, &opts); err != nil {
+		return err
+	}
+
+	storageDir, running := caStorageDir(c, opts)
+	if err := ca.Remove(storageDir); err != nil {
+		return err
+	}
+
+	if !running {
+		fmt.Println("Local CA removed, Candy generates a new one the next time it starts.")
+		return nil
+	}
+
+	if err := caddy.ReloadCA(c.Context(), opts.AdminAddr); err != nil {
+		return fmt.Errorf("error reloading the local CA of the running Candy: %w", err)
+	}
+
+	authority, err := ca.Load(storageDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Local CA rotated, export it again to the trust stores it was installed into.")
+
+	return printCAInfo(authority, false)
+}
+
+func printCAInfo(authority *ca.Authority, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(authority.Info())
+	}
+
+	for _, info := range authority.Info() {
+		fmt.Printf("%s:\n", info.Name)
+		fmt.Printf("  Subject:     %s\n", info.Subject)
+		fmt.Printf("  SHA-256:     %s\n", info.Fingerprint)
+		fmt.Printf("  Not before:  %s\n", info.NotBefore.Local())
+		fmt.Printf("  Not after:   %s\n", info.NotAfter.Local())
+	}
+
+	return nil
+}
+
+func caIssueClientRunE(c *cobra.Command, args []string) error {
+	var opts caOptions
+	if err := unmarshalFlags(flagConfigFile, c, &opts); err != nil {
+		return err
+	}
+
+	storageDir, _ := caStorageDir(c, opts)
+	authority, err := ca.Load(storageDir)
+	if err != nil {
+		return err
+	}
+
+	name := args[0]
+	cert, key, err := authority.IssueClient(name, opts.Lifetime)
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Join(opts.OutputDir, name)
+	files := []exportFile{
+		{Name: base + ".crt", Export: func(w io.Writer) error { return ca.Export(w, []*x509.Certificate{cert}, ca.FormatPEM, "") }},
+		{Name: base + ".key", Export: func(w io.Writer) error { return ca.ExportKey(w, key) }},
+	}
+	if opts.PKCS12 {
+		files = append(files, exportFile{Name: base + ".p12", Export: func(w io.Writer) error { return ca.ExportPKCS12(w, cert, key, opts.Password) }})
+	}
+
+	for _, file := range files {
+		if err := file.write(); err != nil {
+			return err
+		}
+		fmt.Println(file.Name)
+	}
+
+	return nil
+}
+
+type exportFile struct {
+	Name   string
+	Export func(w io.Writer) error
+}
+
+// write writes the file readable by the user only as it may contain a key
+func (f exportFile) write() error {
+	file, err := os.OpenFile(f.Name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", f.Name, err)
+	}
+	defer file.Close()
+
+	if err := f.Export(file); err != nil {
+		return fmt.Errorf("error writing %s: %w", f.Name, err)
+	}
+
+	return file.Close()
+}
@@ -4,7 +4,6 @@ package cmd
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"path/filepath"
 
@@ -25,8 +24,22 @@ func init() {
 }
 
 func launchRunE(c *cobra.Command, args []string) error {
-	httpUnixSocketPath := generateSocketPath("http")
-	httpsUnixSocketPath := generateSocketPath("https")
+	cfg, err := loadServerConfig(c)
+	if err != nil {
+		return err
+	}
+
+	httpUnixSocketPath := cfg.SocketPath("http")
+	httpsUnixSocketPath := cfg.SocketPath("https")
+	for _, path := range []string{httpUnixSocketPath, httpsUnixSocketPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return err
+		}
+		// Stale sockets of a previous run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 
 	os.Setenv("CANDY_HTTP_ADDR", "unix/"+httpUnixSocketPath)
 	os.Setenv("CANDY_HTTPS_ADDR", "unix/"+httpsUnixSocketPath)
@@ -67,8 +80,3 @@ func launchRunE(c *cobra.Command, args []string) error {
 
 	return g.Run()
 }
-
-func generateSocketPath(name string) string {
-	filename := fmt.Sprintf("candy-%s.sock-%d", name, os.Getpid())
-	return filepath.Join(os.TempDir(), filename)
-}
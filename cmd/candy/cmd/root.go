@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"runtime"
 
 	"github.com/owenthereal/candy"
 	"github.com/spf13/cobra"
@@ -55,3 +56,13 @@ func userHomeDir() string {
 
 	return homeDir
 }
+
+// defaultStateDir is the state directory of the user running Candy, or of
+// the sudo user like userHomeDir
+func defaultStateDir() string {
+	if runtime.GOOS == "darwin" {
+		return filepath.Join(userHomeDir(), "Library", "Application Support", "Candy")
+	}
+
+	return filepath.Join(userHomeDir(), ".local", "state", "candy")
+}
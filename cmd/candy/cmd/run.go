@@ -6,17 +6,25 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/caddy"
+	"github.com/owenthereal/candy/runnable"
 	"github.com/owenthereal/candy/server"
+	"github.com/owenthereal/candy/systemd"
+	"github.com/owenthereal/candy/watch"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 const (
-	defaultDNSAddr = "127.0.0.1:25353"
+	defaultDNSAddr   = "127.0.0.1:25353"
+	defaultAdminAddr = "127.0.0.1:22019"
 )
 
 var (
@@ -36,16 +44,43 @@ func init() {
 
 func addDefaultFlags(cmd *cobra.Command) {
 	cmd.Flags().String("host-root", filepath.Join(userHomeDir(), ".candy"), "Path to the directory containing applications that will be served by Candy")
+	cmd.Flags().String("state-dir", defaultStateDir(), "Path to the directory holding Caddy's storage (the local CA and certificates), the pid file and the sockets of candy launch. An existing CA in Caddy's default storage is kept there")
 	cmd.Flags().StringSlice("domain", defaultDomains, "The top-level domains for which Candy will respond to DNS queries")
 	cmd.Flags().String("http-addr", "127.0.0.1:28080", "The Proxy server HTTP address")
 	cmd.Flags().String("https-addr", "127.0.0.1:28443", "The Proxy server HTTPS address")
-	cmd.Flags().String("admin-addr", "127.0.0.1:22019", "The Proxy server administrative address")
+	cmd.Flags().StringSlice("https-protocols", caddy.DefaultProtocols, "The protocols served on --https-addr: h1, h2 and h3 (HTTP/3 over UDP on the same address)")
+	cmd.Flags().String("http-mode", candy.HTTPServe, fmt.Sprintf("What plain HTTP requests to the apps that don't configure their own get: %s, %s to HTTPS or %s", candy.HTTPServe, candy.HTTPRedirect, candy.HTTPReject))
+	cmd.Flags().Int("hsts-max-age", 0, "The max-age in seconds of the Strict-Transport-Security header of the apps that don't configure their own (not sent if 0)")
+	cmd.Flags().String("admin-addr", defaultAdminAddr, "The Proxy server administrative address")
 	cmd.Flags().String("dns-addr", defaultDNSAddr, "The DNS server address")
 	cmd.Flags().Bool("dns-local-ip", false, "DNS server responds DNS queries with local IP instead of 127.0.0.1")
+	cmd.Flags().String("dns-local-ip-interface", "", `Select the local IP for --dns-local-ip and --mdns by interface name, CIDR or "default" route (the first non-loopback IPv4 address if empty)`)
+	cmd.Flags().Bool("dns-ptr", false, "DNS server responds reverse (PTR) queries for the local IP of --dns-local-ip with candy.<domain>")
+	cmd.Flags().Bool("dns-log", false, "Log every DNS query with its answer and latency")
+	cmd.Flags().String("dns-doh-addr", "", "The local address of the DNS-over-HTTPS server, served at https://candy.<domain>/dns-query (disabled if empty)")
+	cmd.Flags().String("dns-dot-addr", "", "The DNS-over-TLS server address (disabled if empty)")
+	cmd.Flags().StringSlice("dns-upstream", nil, "The resolvers, as host:port, that DNS-over-HTTPS and DNS-over-TLS forward other domains to (the nameservers of /etc/resolv.conf if empty)")
+	cmd.Flags().String("tcp-sni-addr", "", "The address where TLS connections are passed through to the TCP apps by server name (disabled if empty)")
+	cmd.Flags().String("tcp-ip", "127.0.0.1", "The IP that the dedicated ports of the TCP apps listen on")
+	cmd.Flags().Bool("mdns", false, "Advertise apps as <app>.local to the local network through multicast DNS")
+	cmd.Flags().Bool("mdns-host-suffix", false, "Advertise apps as <app>-<hostname>.local through multicast DNS")
+	cmd.Flags().Duration("watch-debounce", 100*time.Millisecond, "How long to wait for changes in the host root to settle before reloading apps")
+	cmd.Flags().Bool("watch-poll", false, "Poll the host root for changes instead of using filesystem notifications, e.g. on network filesystems")
+	cmd.Flags().Duration("watch-poll-interval", 2*time.Second, "How often to poll the host root when polling")
+	cmd.Flags().Int("watch-max-retries", 0, "Consecutive failures watching the host root after which Candy shuts down. 0 retries forever")
+	cmd.Flags().String("tls-cert-file", "", "Certificate file served for all apps instead of issuing one per app with the local CA")
+	cmd.Flags().String("tls-key-file", "", "Key file of --tls-cert-file")
+	cmd.Flags().String("tls-ca-cert-file", "", "CA certificate file that issues the app certificates instead of the local CA")
+	cmd.Flags().String("tls-ca-key-file", "", "Key file of --tls-ca-cert-file")
 	cmd.Flags().Bool("debug", false, "Debug mode")
 }
 
 func runRunE(c *cobra.Command, args []string) error {
+	// Only Candy notifies systemd, once all services are ready
+	if err := systemd.HideNotifySocket(); err != nil {
+		candy.Log().Warn("Caddy will notify systemd before Candy is ready", zap.Error(err))
+	}
+
 	return startServer(c, c.Context())
 }
 
@@ -55,6 +90,10 @@ func startServer(c *cobra.Command, ctx context.Context) error {
 		return err
 	}
 
+	if err := adoptSockets(cfg); err != nil {
+		return err
+	}
+
 	candy.Log().Info("using config", zap.Any("cfg", cfg))
 
 	if err := os.MkdirAll(cfg.HostRoot, 0o0755); err != nil {
@@ -63,7 +102,54 @@ func startServer(c *cobra.Command, ctx context.Context) error {
 
 	svr := server.New(*cfg)
 
-	return svr.Run(ctx)
+	notifier := systemd.NewNotifier(systemd.NotifierConfig{
+		Ready:   svr.Ready(),
+		Running: svr.Running,
+		Logger:  candy.Log().Named("systemd"),
+	})
+
+	return runnable.RunWithContext(ctx, []runnable.Runable{svr, configWatcher(c, svr, cfg), notifier})
+}
+
+// configWatcher applies changes of the config file to the running server
+func configWatcher(c *cobra.Command, svr *server.Server, cfg *server.Config) runnable.Runable {
+	logger := candy.Log().Named("config")
+	cfgFile := filepath.Clean(flagConfigFile)
+
+	return watch.New(watch.Config{
+		HostRoot: filepath.Dir(cfgFile),
+		Debounce: cfg.WatchDebounce,
+		HandleFunc: func(events []fsnotify.Event) {
+			var changed bool
+			for _, evt := range events {
+				if filepath.Clean(evt.Name) == cfgFile || evt.Name == filepath.Dir(cfgFile) {
+					changed = true
+				}
+			}
+			if !changed {
+				return
+			}
+
+			logger.Info("reloading config", zap.String("file", cfgFile))
+
+			cfg, err := loadServerConfig(c)
+			if err != nil {
+				logger.Error("error loading config", zap.String("file", cfgFile), zap.Error(err))
+				return
+			}
+
+			if err := adoptSockets(cfg); err != nil {
+				logger.Error("error loading config", zap.String("file", cfgFile), zap.Error(err))
+				return
+			}
+
+			if err := svr.Reconfigure(*cfg); err != nil {
+				logger.Error("error applying config", zap.String("file", cfgFile), zap.Error(err))
+			}
+		},
+		// The config dir is usually the home dir, don't log every change in it
+		Logger: logger.WithOptions(zap.IncreaseLevel(zapcore.WarnLevel)),
+	})
 }
 
 func loadServerConfig(cmd *cobra.Command) (*server.Config, error) {
@@ -109,3 +195,47 @@ func unmarshalFlags(cfgFile string, cmd *cobra.Command, opts interface{}) error
 
 	return v.Unmarshal(opts)
 }
+
+// adoptSockets points the addresses at the sockets named http, https and dns
+// that systemd passed by socket activation, so that Candy serves on ports
+// owned by systemd instead of binding its own
+func adoptSockets(cfg *server.Config) error {
+	sockets, err := systemd.Activated()
+	if err != nil {
+		return fmt.Errorf("error reading sockets passed by systemd: %w", err)
+	}
+
+	if _, ok := sockets["http"]; ok {
+		cfg.HttpAddr = systemd.Network + "/http"
+	}
+
+	if _, ok := sockets["dns"]; ok {
+		cfg.DnsAddr = systemd.Network + "/dns"
+	}
+
+	if _, ok := sockets["https"]; ok {
+		cfg.HttpsAddr = systemd.Network + "/https"
+
+		// HTTP/3 needs a datagram socket of the same name
+		if !sockets.HasPacketConn("https") {
+			protocols := cfg.HttpsProtocols
+			if len(protocols) == 0 {
+				protocols = caddy.DefaultProtocols
+			}
+
+			var withoutH3 []string
+			for _, p := range protocols {
+				if p != caddy.ProtocolHTTP3 {
+					withoutH3 = append(withoutH3, p)
+				}
+			}
+			if len(withoutH3) == 0 {
+				return fmt.Errorf("--https-protocols %s requires a datagram socket named https", caddy.ProtocolHTTP3)
+			}
+
+			cfg.HttpsProtocols = withoutH3
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,350 @@
+//go:build linux
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/caddy"
+	"github.com/owenthereal/candy/systemd"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Manages the systemd user service that runs Candy (Linux)",
+}
+
+var serviceInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Writes the systemd user units of Candy, enables and starts them",
+	Args:  cobra.NoArgs,
+	RunE:  serviceInstallRunE,
+}
+
+var serviceUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Stops and disables the systemd user units of Candy and removes them",
+	Args:  cobra.NoArgs,
+	RunE:  serviceUninstallRunE,
+}
+
+var serviceStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Starts the systemd user units of Candy",
+	Args:  cobra.NoArgs,
+	RunE:  serviceStartRunE,
+}
+
+var serviceStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stops the systemd user units of Candy",
+	Args:  cobra.NoArgs,
+	RunE:  serviceStopRunE,
+}
+
+var serviceStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows the state of the systemd user units of Candy",
+	Args:  cobra.NoArgs,
+	RunE:  serviceStatusRunE,
+}
+
+func init() {
+	rootCmd.AddCommand(serviceCmd)
+	serviceCmd.AddCommand(serviceInstallCmd, serviceUninstallCmd, serviceStartCmd, serviceStopCmd, serviceStatusCmd)
+
+	// The flags set on install are passed to candy run by the service
+	addDefaultFlags(serviceInstallCmd)
+	serviceInstallCmd.Flags().Bool("socket", false, "Start Candy by socket activation on --http-addr, --https-addr and --dns-addr")
+	serviceStatusCmd.Flags().Bool("json", false, "Print as JSON")
+}
+
+func serviceInstallRunE(c *cobra.Command, args []string) error {
+	cfg, err := loadServerConfig(c)
+	if err != nil {
+		return err
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding candy binary: %w", err)
+	}
+	if binary, err = filepath.EvalSymlinks(binary); err != nil {
+		return fmt.Errorf("error finding candy binary: %w", err)
+	}
+
+	runArgs, err := serviceRunArgs(c)
+	if err != nil {
+		return err
+	}
+
+	socket, err := c.Flags().GetBool("socket")
+	if err != nil {
+		return err
+	}
+
+	protocols := cfg.HttpsProtocols
+	if len(protocols) == 0 {
+		protocols = caddy.DefaultProtocols
+	}
+
+	unitCfg := systemd.UnitConfig{
+		Binary:    binary,
+		Args:      runArgs,
+		Sockets:   socket,
+		HTTPAddr:  cfg.HttpAddr,
+		HTTPSAddr: cfg.HttpsAddr,
+		HTTP3:     slices.Contains(protocols, caddy.ProtocolHTTP3),
+		DNSAddr:   cfg.DnsAddr,
+	}
+
+	dir, err := userUnitDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	logger := candy.Log()
+
+	// Socket units of an earlier install with --socket
+	names := systemd.UnitNames(unitCfg)
+	var stale []string
+	for _, name := range installedUnits(dir) {
+		if !slices.Contains(names, name) {
+			stale = append(stale, name)
+		}
+	}
+	if len(stale) > 0 {
+		if err := systemctlUser(append([]string{"disable", "--now"}, stale...)...); err != nil {
+			return err
+		}
+		for _, name := range stale {
+			file := filepath.Join(dir, name)
+			logger.Info("removing unit file", zap.String("file", file))
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, content := range systemd.Units(unitCfg) {
+		file := filepath.Join(dir, name)
+
+		if b, err := os.ReadFile(file); err == nil && string(b) == content {
+			logger.Info("unit file unchanged", zap.String("file", file))
+			continue
+		}
+
+		logger.Info("writing unit file", zap.String("file", file))
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			return err
+		}
+	}
+
+	if err := systemctlUser("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctlUser(append([]string{"enable"}, names...)...); err != nil {
+		return err
+	}
+	// Restarting applies changed units, the sockets go first so that the
+	// service is passed the new ones
+	if err := systemctlUser(append([]string{"restart"}, startOrder(names)...)...); err != nil {
+		return err
+	}
+
+	return printServiceStatus(names, false)
+}
+
+func serviceUninstallRunE(c *cobra.Command, args []string) error {
+	dir, err := userUnitDir()
+	if err != nil {
+		return err
+	}
+
+	names := installedUnits(dir)
+	if len(names) == 0 {
+		fmt.Println("Candy's service isn't installed.")
+		return nil
+	}
+
+	if err := systemctlUser(append([]string{"disable", "--now"}, names...)...); err != nil {
+		return err
+	}
+
+	logger := candy.Log()
+	for _, name := range names {
+		file := filepath.Join(dir, name)
+		logger.Info("removing unit file", zap.String("file", file))
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	return systemctlUser("daemon-reload")
+}
+
+func serviceStartRunE(c *cobra.Command, args []string) error {
+	names, err := installedServiceUnits()
+	if err != nil {
+		return err
+	}
+
+	if err := systemctlUser(append([]string{"start"}, startOrder(names)...)...); err != nil {
+		return err
+	}
+
+	return printServiceStatus(names, false)
+}
+
+func serviceStopRunE(c *cobra.Command, args []string) error {
+	names, err := installedServiceUnits()
+	if err != nil {
+		return err
+	}
+
+	// Stopping the sockets too keeps them from starting the service again
+	if err := systemctlUser(append([]string{"stop"}, names...)...); err != nil {
+		return err
+	}
+
+	return printServiceStatus(names, false)
+}
+
+func serviceStatusRunE(c *cobra.Command, args []string) error {
+	asJSON, err := c.Flags().GetBool("json")
+	if err != nil {
+		return err
+	}
+
+	dir, err := userUnitDir()
+	if err != nil {
+		return err
+	}
+
+	names := installedUnits(dir)
+	if len(names) == 0 {
+		names = []string{systemd.ServiceName}
+	}
+
+	return printServiceStatus(names, asJSON)
+}
+
+func printServiceStatus(names []string, asJSON bool) error {
+	args := append([]string{"--user", "show", "--property=" + strings.Join(systemd.ShowProperties, ",")}, names...)
+	out, err := exec.Command("systemctl", args...).Output()
+	if err != nil {
+		return fmt.Errorf("error getting the state of %s: %w", strings.Join(names, " "), err)
+	}
+
+	states := systemd.ParseUnitStates(string(out))
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(states)
+	}
+
+	for _, st := range states {
+		if st.LoadState == "not-found" {
+			fmt.Printf("%s: not installed\n", st.Name)
+			continue
+		}
+
+		fmt.Printf("%s: %s, %s (%s)\n", st.Name, st.UnitFileState, st.ActiveState, st.SubState)
+	}
+
+	return nil
+}
+
+// serviceRunArgs returns the arguments of candy run for the service: the
+// config file and the flags set on install
+func serviceRunArgs(c *cobra.Command) ([]string, error) {
+	cfgFile, err := filepath.Abs(flagConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"run", "--config", cfgFile}
+	c.Flags().Visit(func(f *pflag.Flag) {
+		if f.Name == "socket" || f.Name == "config" {
+			return
+		}
+
+		value := f.Value.String()
+		if s, ok := f.Value.(pflag.SliceValue); ok {
+			value = strings.Join(s.GetSlice(), ",")
+		}
+		args = append(args, "--"+f.Name+"="+value)
+	})
+
+	return args, nil
+}
+
+// installedServiceUnits returns the installed units, or an error if the
+// service isn't installed
+func installedServiceUnits() ([]string, error) {
+	dir, err := userUnitDir()
+	if err != nil {
+		return nil, err
+	}
+
+	names := installedUnits(dir)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("Candy's service isn't installed, run `candy service install`")
+	}
+
+	return names, nil
+}
+
+// installedUnits returns the units of Candy in dir, the service first
+func installedUnits(dir string) []string {
+	var names []string
+	for _, name := range systemd.UnitNames(systemd.UnitConfig{Sockets: true}) {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// startOrder puts the sockets before the service
+func startOrder(names []string) []string {
+	var sockets, services []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".socket") {
+			sockets = append(sockets, name)
+		} else {
+			services = append(services, name)
+		}
+	}
+
+	return append(sockets, services...)
+}
+
+func userUnitDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("error finding user config directory: %w", err)
+	}
+
+	return filepath.Join(dir, "systemd", "user"), nil
+}
+
+func systemctlUser(args ...string) error {
+	return execCmd(append([]string{"systemctl", "--user"}, args...)...)
+}
@@ -0,0 +1,26 @@
+//go:build darwin || linux
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/sysconf"
+	"github.com/spf13/cobra"
+)
+
+func addSetupFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("uninstall", false, "Remove what setup changed instead")
+	cmd.Flags().Bool("dry-run", false, "Print a diff of the files and the commands that setup would change and run, without changing anything")
+}
+
+// applySetup changes the system as planned, or prints the changes with
+// dryRun
+func applySetup(actions []sysconf.Action, dryRun bool) error {
+	if dryRun {
+		return sysconf.DryRun(os.Stdout, actions)
+	}
+
+	return sysconf.Apply(actions, candy.Log())
+}
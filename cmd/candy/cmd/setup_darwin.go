@@ -5,23 +5,12 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"net"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/resolver"
 	"github.com/spf13/cobra"
-	"go.uber.org/zap"
-)
-
-const (
-	resolverDir  = "/etc/resolver"
-	resolverTmpl = `domain %s
-nameserver %s
-port %s
-search_order 1
-timeout 5`
 )
 
 var setupCmd = &cobra.Command{
@@ -33,13 +22,36 @@ var setupCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(setupCmd)
 	addDefaultFlags(setupCmd)
+	addSetupFlags(setupCmd)
 
 	// Hide flags that are not used by setup
 	_ = setupCmd.Flags().MarkHidden("host-root")
 	_ = setupCmd.Flags().MarkHidden("http-addr")
 	_ = setupCmd.Flags().MarkHidden("https-addr")
+	_ = setupCmd.Flags().MarkHidden("https-protocols")
+	_ = setupCmd.Flags().MarkHidden("http-mode")
+	_ = setupCmd.Flags().MarkHidden("hsts-max-age")
 	_ = setupCmd.Flags().MarkHidden("admin-addr")
 	_ = setupCmd.Flags().MarkHidden("dns-local-ip")
+	_ = setupCmd.Flags().MarkHidden("dns-local-ip-interface")
+	_ = setupCmd.Flags().MarkHidden("dns-ptr")
+	_ = setupCmd.Flags().MarkHidden("dns-log")
+	_ = setupCmd.Flags().MarkHidden("dns-doh-addr")
+	_ = setupCmd.Flags().MarkHidden("dns-dot-addr")
+	_ = setupCmd.Flags().MarkHidden("dns-upstream")
+	_ = setupCmd.Flags().MarkHidden("tcp-sni-addr")
+	_ = setupCmd.Flags().MarkHidden("tcp-ip")
+	_ = setupCmd.Flags().MarkHidden("mdns")
+	_ = setupCmd.Flags().MarkHidden("mdns-host-suffix")
+	_ = setupCmd.Flags().MarkHidden("watch-debounce")
+	_ = setupCmd.Flags().MarkHidden("watch-poll")
+	_ = setupCmd.Flags().MarkHidden("watch-poll-interval")
+	_ = setupCmd.Flags().MarkHidden("watch-max-retries")
+	_ = setupCmd.Flags().MarkHidden("state-dir")
+	_ = setupCmd.Flags().MarkHidden("tls-cert-file")
+	_ = setupCmd.Flags().MarkHidden("tls-key-file")
+	_ = setupCmd.Flags().MarkHidden("tls-ca-cert-file")
+	_ = setupCmd.Flags().MarkHidden("tls-ca-key-file")
 }
 
 func setupRunE(c *cobra.Command, args []string) error {
@@ -59,34 +71,32 @@ func runSetupRunE(c *cobra.Command, args []string) error {
 		return err
 	}
 
-	host, port, err := net.SplitHostPort(cfg.DnsAddr)
+	uninstall, err := c.Flags().GetBool("uninstall")
 	if err != nil {
 		return err
 	}
-
-	if err := os.MkdirAll(resolverDir, 0o755); err != nil {
+	dryRun, err := c.Flags().GetBool("dry-run")
+	if err != nil {
 		return err
 	}
 
-	logger := candy.Log()
-
-	for _, domain := range cfg.Domain {
-		file := filepath.Join(resolverDir, "candy-"+domain)
-		content := fmt.Sprintf(resolverTmpl, domain, host, port)
+	// Including the files of domains that are no longer configured
+	installed, err := resolver.MacInstalled("/")
+	if err != nil {
+		return err
+	}
 
-		b, err := os.ReadFile(file)
-		if err == nil {
-			if string(b) == content {
-				logger.Info("resolver configuration file unchanged", zap.String("file", file))
-				continue
-			}
-		}
+	if uninstall {
+		return applySetup(resolver.MacUninstall(installed), dryRun)
+	}
 
-		logger.Info("writing resolver configuration file", zap.String("file", file))
-		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
-			return err
-		}
+	actions, err := resolver.MacPlan(resolver.MacResolverDir, resolver.Config{
+		Domains: cfg.Domain,
+		DNSAddr: cfg.DnsAddr,
+	}, installed)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return applySetup(actions, dryRun)
 }
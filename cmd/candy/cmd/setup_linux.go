@@ -11,18 +11,26 @@ import (
 	"strings"
 
 	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/privileged"
+	"github.com/owenthereal/candy/resolver"
+	"github.com/owenthereal/candy/server"
+	"github.com/owenthereal/candy/sysconf"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
 
 const (
-	resolvedDir  = "/usr/lib/systemd/resolved.conf.d"
-	resolvedFile = "01-candy.conf"
-	resolvedTmpl = `[Resolve]
-DNS=%s
-Domains=%s`
+	systemdUnitDir = "/etc/systemd/system"
+	// nftRulesFile is loaded by the unit that redirects the privileged ports
+	nftRulesFile = "/etc/candy/redirect.nft"
 )
 
+// socketProxydPaths are where distros install systemd-socket-proxyd
+var socketProxydPaths = []string{
+	"/usr/lib/systemd/systemd-socket-proxyd",
+	"/lib/systemd/systemd-socket-proxyd",
+}
+
 var setupCmd = &cobra.Command{
 	Use:   "setup",
 	Short: "Run system setup for Linux",
@@ -32,13 +40,35 @@ var setupCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(setupCmd)
 	addDefaultFlags(setupCmd)
+	addSetupFlags(setupCmd)
+	setupCmd.Flags().String("privileged-ports", "", fmt.Sprintf("How apps are reached on ports 80 and 443: %s them to --http-addr and --https-addr with nftables or iptables, %s to let the candy binary bind them, %s to listen with systemd socket units, or %s to remove any of them", privileged.ModeRedirect, privileged.ModeCapability, privileged.ModeSocket, privileged.ModeNone))
 
 	// Hide flags that are not used by setup
 	_ = setupCmd.Flags().MarkHidden("host-root")
-	_ = setupCmd.Flags().MarkHidden("http-addr")
-	_ = setupCmd.Flags().MarkHidden("https-addr")
+	_ = setupCmd.Flags().MarkHidden("https-protocols")
+	_ = setupCmd.Flags().MarkHidden("http-mode")
+	_ = setupCmd.Flags().MarkHidden("hsts-max-age")
 	_ = setupCmd.Flags().MarkHidden("admin-addr")
 	_ = setupCmd.Flags().MarkHidden("dns-local-ip")
+	_ = setupCmd.Flags().MarkHidden("dns-local-ip-interface")
+	_ = setupCmd.Flags().MarkHidden("dns-ptr")
+	_ = setupCmd.Flags().MarkHidden("dns-log")
+	_ = setupCmd.Flags().MarkHidden("dns-doh-addr")
+	_ = setupCmd.Flags().MarkHidden("dns-dot-addr")
+	_ = setupCmd.Flags().MarkHidden("dns-upstream")
+	_ = setupCmd.Flags().MarkHidden("tcp-sni-addr")
+	_ = setupCmd.Flags().MarkHidden("tcp-ip")
+	_ = setupCmd.Flags().MarkHidden("mdns")
+	_ = setupCmd.Flags().MarkHidden("mdns-host-suffix")
+	_ = setupCmd.Flags().MarkHidden("watch-debounce")
+	_ = setupCmd.Flags().MarkHidden("watch-poll")
+	_ = setupCmd.Flags().MarkHidden("watch-poll-interval")
+	_ = setupCmd.Flags().MarkHidden("watch-max-retries")
+	_ = setupCmd.Flags().MarkHidden("state-dir")
+	_ = setupCmd.Flags().MarkHidden("tls-cert-file")
+	_ = setupCmd.Flags().MarkHidden("tls-key-file")
+	_ = setupCmd.Flags().MarkHidden("tls-ca-cert-file")
+	_ = setupCmd.Flags().MarkHidden("tls-ca-key-file")
 }
 
 func setupRunE(c *cobra.Command, args []string) error {
@@ -58,32 +88,155 @@ func runSetupRunE(c *cobra.Command, args []string) error {
 		return err
 	}
 
-	if err := os.MkdirAll(resolvedDir, 0o755); err != nil {
+	uninstall, err := c.Flags().GetBool("uninstall")
+	if err != nil {
+		return err
+	}
+	dryRun, err := c.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	mode, err := c.Flags().GetString("privileged-ports")
+	if err != nil {
 		return err
 	}
 
-	var (
-		file    = filepath.Join(resolvedDir, resolvedFile)
-		content = fmt.Sprintf(resolvedTmpl, cfg.DnsAddr, strings.Join(cfg.Domain, " "))
-		logger  = candy.Log()
-	)
-
-	b, err := os.ReadFile(file)
-	if err == nil {
-		if string(b) == content {
-			logger.Info("network name resolution file unchanged", zap.String("file", file))
-			return nil
+	if uninstall {
+		if mode != "" {
+			return fmt.Errorf("--privileged-ports can't be used with --uninstall, which removes any of them")
 		}
+
+		return uninstallSetup(cfg, dryRun)
+	}
+
+	if err := setupResolver(cfg, dryRun); err != nil {
+		return err
+	}
+
+	if mode == "" {
+		return nil
+	}
+
+	return setupPrivilegedPorts(mode, cfg, dryRun)
+}
+
+// setupResolver sends the domains to Candy's DNS server with the stack
+// that resolves host names
+func setupResolver(cfg *server.Config, dryRun bool) error {
+	stack, err := resolver.Detect("/")
+	if err != nil {
+		return err
+	}
+
+	candy.Log().Info("detected resolver", zap.String("stack", stack))
+
+	rcfg := resolver.Config{
+		Domains: cfg.Domain,
+		DNSAddr: cfg.DnsAddr,
+	}
+	actions, err := resolver.Plan(stack, rcfg)
+	if err != nil {
+		return err
+	}
+
+	if err := applySetup(actions, dryRun); err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+
+	fmt.Println(resolver.Explain(stack, rcfg))
+
+	return nil
+}
+
+func setupPrivilegedPorts(mode string, cfg *server.Config, dryRun bool) error {
+	actions, binary, err := privilegedPlan(mode, cfg)
+	if err != nil {
+		return fmt.Errorf("invalid --privileged-ports: %w", err)
 	}
 
-	logger.Info("writing network name resolution file", zap.String("file", file))
-	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+	if err := applySetup(actions, dryRun); err != nil {
 		return err
 	}
+	if dryRun {
+		return nil
+	}
+
+	logger := candy.Log()
+	switch mode {
+	case privileged.ModeRedirect:
+		logger.Info("redirected ports 80 and 443 with a systemd unit that restores the rules at boot")
+	case privileged.ModeCapability:
+		logger.Info(fmt.Sprintf("candy can bind ports 80 and 443, set http-addr and https-addr to them in %s and restart candy", flagConfigFile), zap.String("binary", binary))
+	case privileged.ModeSocket:
+		logger.Info("listening on ports 80 and 443 with systemd socket units")
+	}
 
-	logger.Info("restarting systemd-resolved")
-	return execCmd("systemctl", "restart", "systemd-resolved")
+	return nil
+}
+
+// uninstallSetup removes the resolver config and whatever leads the
+// privileged ports to Candy
+func uninstallSetup(cfg *server.Config, dryRun bool) error {
+	stack, err := resolver.Detect("/")
+	if err != nil {
+		return err
+	}
+
+	actions, _, err := privilegedPlan(privileged.ModeNone, cfg)
+	if err != nil {
+		return err
+	}
+
+	return applySetup(append(resolver.Uninstall(stack), actions...), dryRun)
+}
+
+// privilegedPlan plans mode of reaching Candy on the privileged ports,
+// returning the candy binary that gets or loses the capability
+func privilegedPlan(mode string, cfg *server.Config) ([]sysconf.Action, string, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return nil, "", fmt.Errorf("error finding candy binary: %w", err)
+	}
+	if binary, err = filepath.EvalSymlinks(binary); err != nil {
+		return nil, "", fmt.Errorf("error finding candy binary: %w", err)
+	}
+
+	actions, err := privileged.Plan(mode, privileged.Config{
+		HTTPAddr:     cfg.HttpAddr,
+		HTTPSAddr:    cfg.HttpsAddr,
+		Binary:       binary,
+		Firewall:     firewall(),
+		RulesFile:    nftRulesFile,
+		SocketProxyd: socketProxyd(),
+		UnitDir:      systemdUnitDir,
+	})
+
+	return actions, binary, err
+}
+
+// firewall returns the path of the firewall command that redirects ports,
+// preferring nftables
+func firewall() string {
+	for _, fw := range []string{privileged.FirewallNFT, privileged.FirewallIPTables} {
+		if path, err := exec.LookPath(fw); err == nil {
+			return path
+		}
+	}
+
+	return ""
+}
+
+func socketProxyd() string {
+	for _, path := range socketProxydPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
 
+	return ""
 }
 
 func execCmd(c ...string) error {
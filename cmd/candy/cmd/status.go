@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/owenthereal/candy/caddy"
+	"github.com/owenthereal/candy/server"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows the status of the running Candy process",
+	RunE:  statusRunE,
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().String("admin-addr", defaultAdminAddr, "The Proxy server administrative address")
+}
+
+func statusRunE(c *cobra.Command, args []string) error {
+	var cfg server.Config
+	if err := unmarshalFlags(flagConfigFile, c, &cfg); err != nil {
+		return err
+	}
+
+	st, err := caddy.Status(c.Context(), cfg.AdminAddr)
+	if err != nil {
+		return fmt.Errorf("error getting status from %s, is Candy running? %w", cfg.AdminAddr, err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(st)
+}
@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/owenthereal/candy"
+	"go.uber.org/zap"
+)
+
+const (
+	dohMediaType = "application/dns-message"
+	dohPath      = "/dns-query"
+)
+
+// dohHandler serves RFC 8484 DNS queries over HTTP.
+// TLS is terminated by Caddy, which proxies https://candy.<tld>/dns-query to it.
+type dohHandler struct {
+	handler dns.Handler
+	// token is sent by Caddy in candy.DoHTokenHeader
+	token  string
+	logger *zap.Logger
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != dohPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		b, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, fmt.Sprintf("unsupported content type, expecting %s", dohMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+		b, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading DNS query: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(b); err != nil || len(req.Question) == 0 {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	ip := h.remoteIP(r)
+	if ip == nil {
+		http.Error(w, "unknown client address", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{
+		remote: &net.TCPAddr{IP: ip},
+	}
+	h.handler.ServeDNS(rw, req)
+
+	if rw.msg == nil {
+		http.Error(w, "no DNS response", http.StatusBadGateway)
+		return
+	}
+
+	out, err := rw.msg.Pack()
+	if err != nil {
+		h.logger.Error("error packing DNS-over-HTTPS response", zap.Error(err))
+		http.Error(w, "error packing DNS response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	// Answers are served with a TTL of 0 so they must not be cached
+	w.Header().Set("Cache-Control", "max-age=0")
+	_, _ = w.Write(out)
+}
+
+// remoteIP returns the client address of r, or nil if it doesn't parse.
+// X-Forwarded-For is only trusted from Caddy, which proves itself with the
+// token, and its last address is the one that Caddy added.
+func (h *dohHandler) remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	token := r.Header.Get(candy.DoHTokenHeader)
+	if h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		return ip
+	}
+
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+		addrs := strings.Split(fwd[len(fwd)-1], ",")
+		if fip := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1])); fip != nil {
+			return fip
+		}
+	}
+
+	return ip
+}
+
+// dohResponseWriter captures the reply of a dns.Handler
+type dohResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dohResponseWriter) Hijack() {}
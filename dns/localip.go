@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/owenthereal/candy/runnable"
+	"go.uber.org/zap"
+)
+
+const (
+	// LocalIPDefaultRoute selects the interface of the default route
+	LocalIPDefaultRoute = "default"
+
+	localIPRefreshInterval = 5 * time.Second
+)
+
+type LocalIPConfig struct {
+	// Interface selects the local IP by interface name, CIDR or LocalIPDefaultRoute.
+	// If empty, the first IPv4 address of a non-loopback interface is used.
+	Interface string
+	Logger    *zap.Logger
+}
+
+// NewLocalIPTracker returns a tracker of the local IP that DNS queries are
+// answered with when Candy is configured to respond with the local IP.
+func NewLocalIPTracker(cfg LocalIPConfig) *LocalIPTracker {
+	return &LocalIPTracker{
+		cfg:     cfg,
+		ready:   runnable.NewReadySignal(),
+		routeIP: defaultRouteIP,
+	}
+}
+
+// LocalIPTracker caches the selected local IP and refreshes it when
+// network interfaces or the default route change
+type LocalIPTracker struct {
+	cfg     LocalIPConfig
+	ready   *runnable.ReadySignal
+	routeIP func() (net.IP, error)
+
+	mutex       sync.Mutex
+	ip          net.IP
+	iface       string
+	err         error
+	fingerprint string
+}
+
+// Run refreshes the local IP periodically until ctx is done
+func (t *LocalIPTracker) Run(ctx context.Context) error {
+	t.cfg.Logger.Info("starting local IP tracker", zap.String("interface", t.cfg.Interface))
+	defer t.cfg.Logger.Info("shutting down local IP tracker")
+
+	t.refresh()
+	t.ready.Signal()
+
+	ticker := time.NewTicker(localIPRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			t.refresh()
+		}
+	}
+}
+
+// Ready is closed once the local IP has been selected for the first time
+func (t *LocalIPTracker) Ready() <-chan struct{} {
+	return t.ready.Ready()
+}
+
+// IP returns the local IP selected by the last refresh of Run, without
+// checking the interfaces on the query path
+func (t *LocalIPTracker) IP() (net.IP, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.ip == nil && t.err == nil {
+		return nil, fmt.Errorf("no local IP selected yet")
+	}
+
+	return t.ip, t.err
+}
+
+func (t *LocalIPTracker) Status() interface{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	st := struct {
+		Selector  string `json:"selector"`
+		Interface string `json:"interface,omitempty"`
+		IP        string `json:"ip,omitempty"`
+		Error     string `json:"error,omitempty"`
+	}{
+		Selector:  t.cfg.Interface,
+		Interface: t.iface,
+	}
+	if t.ip != nil {
+		st.IP = t.ip.String()
+	}
+	if t.err != nil {
+		st.Error = t.err.Error()
+	}
+
+	return st
+}
+
+// refresh selects the local IP again if interfaces or the default route
+// have changed
+func (t *LocalIPTracker) refresh() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.err = err
+		return
+	}
+
+	fingerprint := interfacesFingerprint(ifaces)
+
+	// The default route can move to another interface without any interface
+	// changing, e.g. when a VPN connects, so it's looked up on every refresh
+	var routeIP net.IP
+	if t.cfg.Interface == LocalIPDefaultRoute {
+		routeIP, err = t.routeIP()
+		if err != nil {
+			t.ip, t.iface, t.err = nil, "", err
+			t.cfg.Logger.Error("error selecting local IP", zap.String("interface", t.cfg.Interface), zap.Error(err))
+			return
+		}
+		fingerprint += "route=" + routeIP.String()
+	}
+
+	if fingerprint == t.fingerprint && t.err == nil {
+		return
+	}
+	t.fingerprint = fingerprint
+
+	ip, iface, err := selectLocalIP(ifaces, t.cfg.Interface, routeIP)
+	if err != nil {
+		t.ip, t.iface, t.err = nil, "", err
+		t.cfg.Logger.Error("error selecting local IP", zap.String("interface", t.cfg.Interface), zap.Error(err))
+		return
+	}
+
+	if !ip.Equal(t.ip) || iface != t.iface {
+		t.cfg.Logger.Info("selected local IP", zap.String("interface", iface), zap.Stringer("ip", ip))
+	}
+	t.ip, t.iface, t.err = ip, iface, nil
+}
+
+func interfacesFingerprint(ifaces []net.Interface) string {
+	var b strings.Builder
+	for _, iface := range ifaces {
+		fmt.Fprintf(&b, "%s|%s|", iface.Name, iface.Flags)
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			b.WriteString(addr.String())
+			b.WriteByte(',')
+		}
+		b.WriteByte(';')
+	}
+
+	return b.String()
+}
+
+// selectLocalIP returns the first IPv4 address of the up interfaces
+// matching selector, along with the interface name.
+// routeIP is the source IP of the default route for LocalIPDefaultRoute.
+func selectLocalIP(ifaces []net.Interface, selector string, routeIP net.IP) (net.IP, string, error) {
+	var match func(iface net.Interface, ip net.IP) bool
+
+	switch {
+	case selector == "":
+		match = func(iface net.Interface, ip net.IP) bool {
+			return iface.Flags&net.FlagLoopback == 0 && !ip.IsLoopback()
+		}
+	case selector == LocalIPDefaultRoute:
+		match = func(iface net.Interface, ip net.IP) bool {
+			return ip.Equal(routeIP)
+		}
+	case strings.Contains(selector, "/"):
+		_, cidr, err := net.ParseCIDR(selector)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid local IP CIDR %s: %w", selector, err)
+		}
+		match = func(iface net.Interface, ip net.IP) bool {
+			return cidr.Contains(ip)
+		}
+	default:
+		match = func(iface net.Interface, ip net.IP) bool {
+			return iface.Name == selector
+		}
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue // interface down
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, addr := range addrs {
+			var ip net.IP
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ip = v.IP
+			case *net.IPAddr:
+				ip = v.IP
+			}
+
+			ip = ip.To4()
+			if ip == nil {
+				continue // not an ipv4 address
+			}
+
+			if match(iface, ip) {
+				return ip, iface.Name, nil
+			}
+		}
+	}
+
+	if selector == "" {
+		return nil, "", fmt.Errorf("no external IP")
+	}
+
+	return nil, "", fmt.Errorf("no IPv4 address matching %s", selector)
+}
+
+// defaultRouteIP returns the source IP of the default route.
+// Connecting a UDP socket doesn't send any packets.
+func defaultRouteIP() (net.IP, error) {
+	conn, err := net.Dial("udp4", "192.0.2.1:9") // TEST-NET-1
+	if err != nil {
+		return nil, fmt.Errorf("error finding default route: %w", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP.To4(), nil
+}
@@ -0,0 +1,282 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/oklog/run"
+	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/runnable"
+	"go.uber.org/zap"
+)
+
+const (
+	mdnsTTL = 120
+)
+
+var (
+	mdnsGroupAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+)
+
+type MDNSConfig struct {
+	HostRoot string
+	// HostSuffix advertises apps as <app>-<hostname>.local instead of <app>.local
+	HostSuffix     bool
+	LocalIPTracker *LocalIPTracker `json:"-"`
+	Logger         *zap.Logger
+}
+
+func NewMDNS(cfg MDNSConfig) candy.MDNSServer {
+	var localIPs *LocalIPTracker
+	if cfg.LocalIPTracker == nil {
+		localIPs = NewLocalIPTracker(LocalIPConfig{Logger: cfg.Logger})
+		cfg.LocalIPTracker = localIPs
+	}
+
+	return &mdnsServer{
+		cfg:      cfg,
+		localIPs: localIPs,
+		apps: candy.NewAppService(candy.AppServiceConfig{
+			TLDs:     []string{candy.MDNSTLD},
+			HostRoot: cfg.HostRoot,
+		}),
+		ready: runnable.NewReadySignal(),
+	}
+}
+
+type mdnsServer struct {
+	cfg   MDNSConfig
+	apps  *candy.AppService
+	ready *runnable.ReadySignal
+	// localIPs is the tracker created by NewMDNS, which Run runs since no
+	// one else does
+	localIPs *LocalIPTracker
+
+	conn  *net.UDPConn
+	names map[string]bool
+	mutex sync.RWMutex
+}
+
+// Ready is closed once the apps are announced
+func (m *mdnsServer) Ready() <-chan struct{} {
+	return m.ready.Ready()
+}
+
+func (m *mdnsServer) Run(ctx context.Context) error {
+	m.cfg.Logger.Info("starting mDNS server", zap.Any("cfg", m.cfg))
+	defer m.cfg.Logger.Info("shutting down mDNS server")
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroupAddr)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.conn = conn
+	m.mutex.Unlock()
+
+	if m.localIPs != nil {
+		m.localIPs.refresh()
+	}
+	if err := m.Reload(); err != nil {
+		m.cfg.Logger.Error("error loading mDNS names", zap.Error(err))
+	}
+	m.ready.Signal()
+
+	var g run.Group
+	{
+		g.Add(func() error {
+			return m.serve(conn)
+		}, func(err error) {
+			m.announce(0) // goodbye
+			_ = conn.Close()
+		})
+	}
+	if m.localIPs != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			return m.localIPs.Run(ctx)
+		}, func(err error) {
+			cancel()
+		})
+	}
+	{
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, func(err error) {
+			cancel()
+		})
+	}
+
+	return g.Run()
+}
+
+// Reload reloads the advertised names from the host root and announces them
+func (m *mdnsServer) Reload() error {
+	apps, _, err := m.apps.FindApps()
+	if err != nil {
+		return fmt.Errorf("error loading apps: %w", err)
+	}
+
+	var hostname string
+	if m.cfg.HostSuffix {
+		hostname, err = candy.MDNSHostname()
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, app := range apps {
+		name := candy.MDNSHost(strings.TrimSuffix(app.Host, "."+candy.MDNSTLD), hostname)
+		names[dns.Fqdn(name)] = true
+	}
+
+	m.mutex.Lock()
+	m.names = names
+	m.mutex.Unlock()
+
+	m.cfg.Logger.Info("advertising mDNS names", zap.Int("count", len(names)))
+	m.announce(mdnsTTL)
+
+	return nil
+}
+
+func (m *mdnsServer) serve(conn *net.UDPConn) error {
+	buf := make([]byte, dns.MaxMsgSize)
+
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		var req dns.Msg
+		if err := req.Unpack(buf[:n]); err != nil {
+			m.cfg.Logger.Debug("error unpacking mDNS message", zap.Error(err))
+			continue
+		}
+
+		if req.Response || req.Opcode != dns.OpcodeQuery {
+			continue
+		}
+
+		m.handleQuery(&req, src)
+	}
+}
+
+func (m *mdnsServer) handleQuery(req *dns.Msg, src *net.UDPAddr) {
+	ip, err := m.cfg.LocalIPTracker.IP()
+	if err != nil {
+		m.cfg.Logger.Error("error getting local v4 IP", zap.Error(err))
+		return
+	}
+
+	var (
+		answers []dns.RR
+		unicast bool
+	)
+
+	m.mutex.RLock()
+	for _, q := range req.Question {
+		name := strings.ToLower(q.Name)
+		if !m.names[name] {
+			continue
+		}
+
+		// The top bit of the class requests a unicast response
+		if q.Qclass&(1<<15) != 0 {
+			unicast = true
+		}
+
+		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+			answers = append(answers, mdnsRecord(q.Name, ip, mdnsTTL))
+		}
+	}
+	m.mutex.RUnlock()
+
+	if len(answers) == 0 {
+		return
+	}
+
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+	resp.Answer = answers
+
+	dst := mdnsGroupAddr
+	// Legacy unicast queries don't come from the mDNS port and
+	// expect a conventional DNS response
+	if src.Port != mdnsGroupAddr.Port {
+		resp.Id = req.Id
+		resp.Question = req.Question
+		for _, rr := range resp.Answer {
+			rr.Header().Class = dns.ClassINET
+			rr.Header().Ttl = 10
+		}
+		dst = src
+	} else if unicast {
+		dst = src
+	}
+
+	m.send(resp, dst)
+}
+
+// announce sends an unsolicited response with all advertised names.
+// A ttl of 0 tells the other hosts to flush the records.
+func (m *mdnsServer) announce(ttl uint32) {
+	ip, err := m.cfg.LocalIPTracker.IP()
+	if err != nil {
+		m.cfg.Logger.Error("error getting local v4 IP", zap.Error(err))
+		return
+	}
+
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+
+	m.mutex.RLock()
+	for name := range m.names {
+		resp.Answer = append(resp.Answer, mdnsRecord(name, ip, ttl))
+	}
+	m.mutex.RUnlock()
+
+	if len(resp.Answer) == 0 {
+		return
+	}
+
+	m.send(resp, mdnsGroupAddr)
+}
+
+func (m *mdnsServer) send(msg *dns.Msg, dst *net.UDPAddr) {
+	m.mutex.RLock()
+	conn := m.conn
+	m.mutex.RUnlock()
+
+	if conn == nil {
+		return
+	}
+
+	b, err := msg.Pack()
+	if err != nil {
+		m.cfg.Logger.Error("error packing mDNS message", zap.Error(err))
+		return
+	}
+
+	if _, err := conn.WriteToUDP(b, dst); err != nil {
+		m.cfg.Logger.Debug("error sending mDNS message", zap.Stringer("dst", dst), zap.Error(err))
+	}
+}
+
+func mdnsRecord(name string, ip net.IP, ttl uint32) dns.RR {
+	return &dns.A{
+		// The top bit of the class is the cache-flush bit as the records are unique to this host
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET | 1<<15, Ttl: ttl},
+		A:   ip.To4(),
+	}
+}
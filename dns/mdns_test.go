@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"github.com/owenthereal/candy"
+	"go.uber.org/zap"
+)
+
+// newTestMDNS returns an mDNS server of the apps in a new host root that
+// answers with ip and isn't joined to the multicast group
+func newTestMDNS(t *testing.T, hostSuffix bool, ip net.IP, apps ...string) *mdnsServer {
+	t.Helper()
+
+	hostRoot := t.TempDir()
+	for _, app := range apps {
+		if err := os.WriteFile(filepath.Join(hostRoot, app), []byte("8080"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker := NewLocalIPTracker(LocalIPConfig{Logger: zap.NewNop()})
+	tracker.ip = ip
+
+	m := NewMDNS(MDNSConfig{
+		HostRoot:       hostRoot,
+		HostSuffix:     hostSuffix,
+		LocalIPTracker: tracker,
+		Logger:         zap.NewNop(),
+	}).(*mdnsServer)
+
+	// Without a connection, nothing is announced
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func Test_mdnsServer_Reload(t *testing.T) {
+	hostname, err := candy.MDNSHostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Name       string
+		HostSuffix bool
+		WantNames  map[string]bool
+	}{
+		{
+			Name: "app names",
+			WantNames: map[string]bool{
+				"myapp.local.": true,
+				"other.local.": true,
+			},
+		},
+		{
+			Name:       "host suffix",
+			HostSuffix: true,
+			WantNames: map[string]bool{
+				"myapp-" + hostname + ".local.": true,
+				"other-" + hostname + ".local.": true,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			m := newTestMDNS(t, cc.HostSuffix, net.IPv4(192, 168, 1, 10), "MyApp", "other")
+			if diff := cmp.Diff(cc.WantNames, m.names); diff != "" {
+				t.Fatalf("mismatch names (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+// Test_mdnsServer_serve sends legacy unicast queries, which are answered
+// to the querier like conventional DNS
+func Test_mdnsServer_serve(t *testing.T) {
+	m := newTestMDNS(t, false, net.IPv4(192, 168, 1, 10), "myapp")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.conn = conn
+	defer conn.Close()
+
+	go func() {
+		_ = m.serve(conn)
+	}()
+
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	exchange := func(name string) (*dns.Msg, error) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		b, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(b); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.SetReadDeadline(time.Now().Add(500 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Id != req.Id {
+			t.Fatalf("mismatch id: want=%d got=%d", req.Id, resp.Id)
+		}
+
+		return resp, nil
+	}
+
+	resp, err := exchange("MyApp.local.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("unexpected answers: %v", resp.Answer)
+	}
+	a, ok := resp.Answer[0].(*dns.A)
+	if !ok || !a.A.Equal(net.IPv4(192, 168, 1, 10)) {
+		t.Fatalf("unexpected answer: %v", resp.Answer[0])
+	}
+	if a.Hdr.Class != dns.ClassINET {
+		t.Fatalf("unexpected class: %d", a.Hdr.Class)
+	}
+
+	// Names of other hosts are left to them
+	if resp, err := exchange("unknown.local."); err == nil {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+}
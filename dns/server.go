@@ -2,65 +2,245 @@ package dns
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/oklog/run"
 	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/runnable"
+	"github.com/owenthereal/candy/status"
+	"github.com/owenthereal/candy/systemd"
 	"go.uber.org/zap"
 )
 
+const (
+	resolvConf      = "/etc/resolv.conf"
+	upstreamTimeout = 3 * time.Second
+)
+
 type Config struct {
-	Addr    string
-	TLDs    []string
-	LocalIP bool
-	Logger  *zap.Logger
+	// Addr is where the DNS server listens on UDP and TCP, or systemd/<name>
+	// for the sockets passed by socket activation
+	Addr string
+	TLDs []string
+	// LocalIP answers queries with the IP selected by LocalIPTracker instead of the client IP
+	LocalIP        bool
+	LocalIPTracker *LocalIPTracker `json:"-"`
+	// PTR answers reverse lookups of the local IP with Candy's own hostname
+	PTR bool
+	// QueryLog logs every query with its answer and latency
+	QueryLog bool
+	// DoHAddr is the plain HTTP address for DNS-over-HTTPS queries proxied by Caddy
+	DoHAddr string
+	// DoHToken is the secret that Caddy sends with the DNS-over-HTTPS
+	// queries it proxies, which makes their X-Forwarded-For trusted
+	DoHToken string `json:"-"`
+	// DoTAddr is the DNS-over-TLS address
+	DoTAddr string
+	// Upstreams are the resolvers, as host:port, that DNS-over-HTTPS and
+	// DNS-over-TLS forward names outside the TLDs to, defaulting to the
+	// nameservers of /etc/resolv.conf. Addr only answers the TLDs because
+	// the system resolver sends it nothing else.
+	Upstreams []string
+	// GetCertificate returns the certificates for DNS-over-TLS
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error) `json:"-"`
+	Logger         *zap.Logger
 }
 
 func New(cfg Config) candy.DNSServer {
-	return &dnsServer{
-		cfg: cfg,
+	var localIPs *LocalIPTracker
+	if cfg.LocalIP && cfg.LocalIPTracker == nil {
+		localIPs = NewLocalIPTracker(LocalIPConfig{Logger: cfg.Logger})
+		cfg.LocalIPTracker = localIPs
+	}
+	if len(cfg.Upstreams) == 0 && (cfg.DoHAddr != "" || cfg.DoTAddr != "") {
+		upstreams, err := systemUpstreams(resolvConf)
+		if err != nil {
+			cfg.Logger.Warn("DNS-over-HTTPS and DNS-over-TLS only answer the TLDs", zap.Error(err))
+		}
+		cfg.Upstreams = upstreams
 	}
+
+	d := &dnsServer{
+		cfg:      cfg,
+		stats:    newQueryStats(),
+		localIPs: localIPs,
+		ready:    runnable.NewReadySignal(),
+	}
+	d.mux, d.fwdMux = d.newMux(false), d.newMux(true)
+
+	return d
 }
 
 type dnsServer struct {
-	cfg Config
+	cfg   Config
+	stats *queryStats
+	// localIPs is the tracker created by New, which Run runs since no
+	// one else does
+	localIPs *LocalIPTracker
+	ready    *runnable.ReadySignal
+
+	// mutex guards the TLDs in cfg and the muxes, which are rebuilt when
+	// the TLDs change
+	mutex sync.RWMutex
+	mux   *dns.ServeMux
+	// fwdMux is mux forwarding other names to the upstreams, for
+	// DNS-over-HTTPS and DNS-over-TLS
+	fwdMux *dns.ServeMux
+}
+
+func (d *dnsServer) SetTLDs(tlds []string) {
+	d.cfg.Logger.Info("changing DNS server TLDs", zap.Strings("tlds", tlds))
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.cfg.TLDs = tlds
+	d.mux, d.fwdMux = d.newMux(false), d.newMux(true)
+}
+
+// Ready is closed once the listeners are bound
+func (d *dnsServer) Ready() <-chan struct{} {
+	return d.ready.Ready()
+}
+
+func (d *dnsServer) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	d.mutex.RLock()
+	mux := d.mux
+	d.mutex.RUnlock()
+
+	mux.ServeDNS(w, r)
+}
+
+func (d *dnsServer) serveForwardDNS(w dns.ResponseWriter, r *dns.Msg) {
+	d.mutex.RLock()
+	mux := d.fwdMux
+	d.mutex.RUnlock()
+
+	mux.ServeDNS(w, r)
 }
 
 func (d *dnsServer) Run(ctx context.Context) error {
 	d.cfg.Logger.Info("starting DNS server", zap.Any("cfg", d.cfg))
 	defer d.cfg.Logger.Info("shutting down DNS server")
 
-	mux := dns.NewServeMux()
-	for _, tld := range d.cfg.TLDs {
-		mux.HandleFunc(tld+".", d.handleDNS)
+	status.Register("dns", d.stats.Status)
+	defer status.Unregister("dns")
+
+	mux := d.instrument(dns.HandlerFunc(d.serveDNS))
+
+	if d.localIPs != nil {
+		d.localIPs.refresh()
+	}
+
+	// Listen before serving so that an early shutdown can always close
+	// the sockets instead of racing against ListenAndServe. If a listener
+	// fails, the ones bound so far are closed so that a restart can bind
+	// them again.
+	var bound []io.Closer
+	fail := func(err error) error {
+		for _, c := range bound {
+			_ = c.Close()
+		}
+		return err
+	}
+
+	pc, err := systemd.ListenPacket("udp", d.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	bound = append(bound, pc)
+
+	ln, err := systemd.Listen("tcp", d.cfg.Addr)
+	if err != nil {
+		return fail(err)
+	}
+	bound = append(bound, ln)
+
+	var dohLn, dotLn net.Listener
+	if d.cfg.DoHAddr != "" {
+		if dohLn, err = systemd.Listen("tcp", d.cfg.DoHAddr); err != nil {
+			return fail(fmt.Errorf("error listening for DNS-over-HTTPS: %w", err))
+		}
+		bound = append(bound, dohLn)
+	}
+	if d.cfg.DoTAddr != "" {
+		if dotLn, err = systemd.Listen("tcp", d.cfg.DoTAddr); err != nil {
+			return fail(fmt.Errorf("error listening for DNS-over-TLS: %w", err))
+		}
+		bound = append(bound, dotLn)
 	}
 
 	var g run.Group
 	{
 		udp := &dns.Server{
-			Handler: mux,
-			Addr:    d.cfg.Addr,
-			Net:     "udp",
+			Handler:    mux,
+			PacketConn: pc,
 		}
 		g.Add(func() error {
-			return udp.ListenAndServe()
+			return udp.ActivateAndServe()
 		}, func(err error) {
 			_ = udp.ShutdownContext(ctx)
+			_ = pc.Close()
 		})
 	}
 	{
 		tcp := &dns.Server{
-			Handler: mux,
-			Addr:    d.cfg.Addr,
-			Net:     "tcp",
+			Handler:  mux,
+			Listener: ln,
 		}
 		g.Add(func() error {
-			return tcp.ListenAndServe()
+			return tcp.ActivateAndServe()
 		}, func(err error) {
 			_ = tcp.ShutdownContext(ctx)
+			_ = ln.Close()
+		})
+	}
+	fwd := d.instrument(dns.HandlerFunc(d.serveForwardDNS))
+	if dohLn != nil {
+		doh := &http.Server{
+			Handler: &dohHandler{
+				handler: fwd,
+				token:   d.cfg.DoHToken,
+				logger:  d.cfg.Logger,
+			},
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		g.Add(func() error {
+			return doh.Serve(dohLn)
+		}, func(err error) {
+			_ = doh.Shutdown(ctx)
+			_ = dohLn.Close()
+		})
+	}
+	if dotLn != nil {
+		dot := &dns.Server{
+			Handler: fwd,
+			Listener: tls.NewListener(dotLn, &tls.Config{
+				GetCertificate: d.getCertificate,
+				MinVersion:     tls.VersionTLS12,
+			}),
+		}
+		g.Add(func() error {
+			return dot.ActivateAndServe()
+		}, func(err error) {
+			_ = dot.ShutdownContext(ctx)
+			_ = dotLn.Close()
+		})
+	}
+	if d.localIPs != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			return d.localIPs.Run(ctx)
+		}, func(err error) {
+			cancel()
 		})
 	}
 	{
@@ -73,29 +253,111 @@ func (d *dnsServer) Run(ctx context.Context) error {
 		})
 	}
 
+	// All listeners are bound
+	d.ready.Signal()
+
 	return g.Run()
 }
 
-func (d *dnsServer) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
-	dom := r.Question[0].Name
+// newMux returns the handlers of the TLDs and reverse zones. With forward,
+// the other names, including reverse lookups of other addresses, are
+// forwarded to the upstreams.
+func (d *dnsServer) newMux(forward bool) *dns.ServeMux {
+	mux := dns.NewServeMux()
+	for _, tld := range d.cfg.TLDs {
+		mux.HandleFunc(tld+".", d.handleDNS)
+	}
 
-	m := new(dns.Msg)
-	m.SetReply(r)
+	var other dns.HandlerFunc
+	if forward && len(d.cfg.Upstreams) > 0 {
+		other = d.forward
+		mux.HandleFunc(".", other)
+	}
+	if d.cfg.PTR && len(d.cfg.TLDs) > 0 {
+		host := dns.Fqdn(candy.ResolverHost(d.cfg.TLDs[0]))
+		ptr := func(w dns.ResponseWriter, r *dns.Msg) {
+			d.handlePTR(w, r, host, other)
+		}
+		mux.HandleFunc("in-addr.arpa.", ptr)
+		mux.HandleFunc("ip6.arpa.", ptr)
+	}
+
+	return mux
+}
 
+// forward answers r with the reply of the first upstream that responds,
+// retrying over TCP if the UDP reply is truncated
+func (d *dnsServer) forward(w dns.ResponseWriter, r *dns.Msg) {
 	var (
-		a   net.IP
-		err error
+		udp = &dns.Client{Timeout: upstreamTimeout}
+		tcp = &dns.Client{Net: "tcp", Timeout: upstreamTimeout}
 	)
 
-	if d.cfg.LocalIP {
-		a, err = localV4IP()
+	for _, upstream := range d.cfg.Upstreams {
+		m, _, err := udp.Exchange(r, upstream)
+		if err == nil && m.Truncated {
+			m, _, err = tcp.Exchange(r, upstream)
+		}
 		if err != nil {
-			d.cfg.Logger.Error("error getting local v4 IP", zap.Error(err))
-			_ = w.WriteMsg(m)
-			return
+			d.cfg.Logger.Debug("error forwarding DNS query", zap.String("upstream", upstream), zap.Error(err))
+			continue
 		}
-	} else {
-		a = clientIP(w)
+
+		writeMsg(w, r, m)
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	writeMsg(w, r, m)
+}
+
+// systemUpstreams returns the nameservers of the resolv.conf at path
+func systemUpstreams(path string) ([]string, error) {
+	cc, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading upstream DNS servers: %w", err)
+	}
+
+	upstreams := make([]string, len(cc.Servers))
+	for i, s := range cc.Servers {
+		upstreams[i] = net.JoinHostPort(s, cc.Port)
+	}
+
+	return upstreams, nil
+}
+
+// getCertificate returns the DNS-over-TLS certificate, defaulting to
+// candy.<tld> for clients that don't send a server name
+func (d *dnsServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if d.cfg.GetCertificate == nil {
+		return nil, fmt.Errorf("no certificate source for DNS-over-TLS")
+	}
+
+	d.mutex.RLock()
+	tlds := d.cfg.TLDs
+	d.mutex.RUnlock()
+
+	if hello.ServerName == "" && len(tlds) > 0 {
+		h := *hello
+		h.ServerName = candy.ResolverHost(tlds[0])
+		hello = &h
+	}
+
+	return d.cfg.GetCertificate(hello)
+}
+
+func (d *dnsServer) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
+	dom := r.Question[0].Name
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	a, err := d.answerIP(w)
+	if err != nil {
+		d.cfg.Logger.Error("error getting local v4 IP", zap.Error(err))
+		_ = w.WriteMsg(m)
+		return
 	}
 
 	var (
@@ -120,6 +382,63 @@ func (d *dnsServer) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
 		m.Answer = append(m.Answer, rr)
 	}
 
+	writeMsg(w, r, m)
+}
+
+// handlePTR answers reverse lookups of the local IP with host, Candy's
+// own hostname. The address is shared by all apps, so it can't name any
+// one of them. The client and loopback addresses that are handed out
+// otherwise belong to their owners, e.g. /etc/hosts, so their lookups go
+// to other like those of any other address, or are NXDOMAIN if it's nil.
+func (d *dnsServer) handlePTR(w dns.ResponseWriter, r *dns.Msg, host string, other dns.HandlerFunc) {
+	q := r.Question[0]
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if !d.isLocalIP(reverseIP(q.Name)) {
+		if other != nil {
+			other(w, r)
+			return
+		}
+
+		m.SetRcode(r, dns.RcodeNameError)
+		writeMsg(w, r, m)
+		return
+	}
+
+	if q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 0},
+			Ptr: host,
+		})
+	}
+
+	writeMsg(w, r, m)
+}
+
+// isLocalIP reports whether ip is the local IP that queries are answered
+// with, which is never a loopback address
+func (d *dnsServer) isLocalIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || !d.cfg.LocalIP {
+		return false
+	}
+
+	local, err := d.cfg.LocalIPTracker.IP()
+
+	return err == nil && ip.Equal(local)
+}
+
+// answerIP returns the address that A/AAAA queries from w are answered with
+func (d *dnsServer) answerIP(w dns.ResponseWriter) (net.IP, error) {
+	if d.cfg.LocalIP {
+		return d.cfg.LocalIPTracker.IP()
+	}
+
+	return clientIP(w), nil
+}
+
+func writeMsg(w dns.ResponseWriter, r, m *dns.Msg) {
 	if r.IsTsig() != nil {
 		if w.TsigStatus() == nil {
 			m.SetTsig(r.Extra[len(r.Extra)-1].(*dns.TSIG).Hdr.Name, dns.HmacMD5, 300, time.Now().Unix())
@@ -129,6 +448,43 @@ func (d *dnsServer) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
 	_ = w.WriteMsg(m)
 }
 
+// reverseIP parses the IP address out of an in-addr.arpa or ip6.arpa name.
+// It returns nil if name is not a complete reverse name.
+func reverseIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	if s, ok := strings.CutSuffix(name, ".in-addr.arpa."); ok {
+		labels := strings.Split(s, ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+
+	if s, ok := strings.CutSuffix(name, ".ip6.arpa."); ok {
+		nibbles := strings.Split(s, ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i != 0 {
+				b.WriteByte(':')
+			}
+		}
+
+		return net.ParseIP(b.String())
+	}
+
+	return nil
+}
+
 func clientIP(w dns.ResponseWriter) net.IP {
 	var a net.IP
 
@@ -142,44 +498,3 @@ func clientIP(w dns.ResponseWriter) net.IP {
 
 	return a
 }
-
-func localV4IP() (net.IP, error) {
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, iface := range ifaces {
-		if iface.Flags&net.FlagUp == 0 {
-			continue // interface down
-		}
-		if iface.Flags&net.FlagLoopback != 0 {
-			continue // loopback interface
-		}
-		addrs, err := iface.Addrs()
-		if err != nil {
-			return nil, err
-		}
-		for _, addr := range addrs {
-			var ip net.IP
-			switch v := addr.(type) {
-			case *net.IPNet:
-				ip = v.IP
-			case *net.IPAddr:
-				ip = v.IP
-			}
-			if ip == nil || ip.IsLoopback() {
-				continue
-			}
-
-			ip = ip.To4()
-			if ip == nil {
-				continue // not an ipv4 address
-			}
-
-			return ip, nil
-		}
-	}
-
-	return nil, fmt.Errorf("no external IP")
-}
@@ -0,0 +1,580 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"github.com/owenthereal/candy"
+	"go.uber.org/zap"
+)
+
+func Test_reverseIP(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Input  string
+		WantIP net.IP
+	}{
+		{
+			Name:   "ipv4",
+			Input:  "1.0.0.127.in-addr.arpa.",
+			WantIP: net.ParseIP("127.0.0.1"),
+		},
+		{
+			Name:   "ipv6",
+			Input:  "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.",
+			WantIP: net.ParseIP("::1"),
+		},
+		{
+			Name:   "partial ipv4",
+			Input:  "0.127.in-addr.arpa.",
+			WantIP: nil,
+		},
+		{
+			Name:   "not reverse",
+			Input:  "app.test.",
+			WantIP: nil,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := reverseIP(cc.Input); !got.Equal(cc.WantIP) {
+				t.Fatalf("mismatch IP: want=%s got=%s", cc.WantIP, got)
+			}
+		})
+	}
+}
+
+func Test_dnsServer_handlePTR(t *testing.T) {
+	d := New(Config{
+		TLDs:           []string{"test", "dev"},
+		LocalIP:        true,
+		LocalIPTracker: &LocalIPTracker{ip: net.ParseIP("192.0.2.10")},
+		PTR:            true,
+		Logger:         zap.NewNop(),
+	}).(*dnsServer)
+
+	cases := []struct {
+		Name      string
+		Question  string
+		Qtype     uint16
+		WantRcode int
+		WantNames []string
+	}{
+		{
+			Name:      "local IP",
+			Question:  "10.2.0.192.in-addr.arpa.",
+			Qtype:     dns.TypePTR,
+			WantRcode: dns.RcodeSuccess,
+			WantNames: []string{"candy.test."},
+		},
+		{
+			Name:      "local IP without PTR question",
+			Question:  "10.2.0.192.in-addr.arpa.",
+			Qtype:     dns.TypeTXT,
+			WantRcode: dns.RcodeSuccess,
+		},
+		{
+			Name:      "loopback",
+			Question:  "1.0.0.127.in-addr.arpa.",
+			Qtype:     dns.TypePTR,
+			WantRcode: dns.RcodeNameError,
+		},
+		{
+			Name:      "other IP",
+			Question:  "11.2.0.192.in-addr.arpa.",
+			Qtype:     dns.TypePTR,
+			WantRcode: dns.RcodeNameError,
+		},
+		{
+			Name:      "partial name",
+			Question:  "2.0.192.in-addr.arpa.",
+			Qtype:     dns.TypePTR,
+			WantRcode: dns.RcodeNameError,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			w := &recordResponseWriter{}
+			m := new(dns.Msg)
+			m.SetQuestion(cc.Question, cc.Qtype)
+			d.serveDNS(w, m)
+
+			if w.msg == nil {
+				t.Fatal("no reply")
+			}
+			if w.msg.Rcode != cc.WantRcode {
+				t.Fatalf("mismatch rcode: want=%s got=%s", dns.RcodeToString[cc.WantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+
+			var names []string
+			for _, rr := range w.msg.Answer {
+				names = append(names, rr.(*dns.PTR).Ptr)
+			}
+			if diff := cmp.Diff(cc.WantNames, names); diff != "" {
+				t.Fatalf("mismatch names (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+// recordResponseWriter is a testResponseWriter that keeps the reply
+type recordResponseWriter struct {
+	testResponseWriter
+	msg *dns.Msg
+}
+
+func (w *recordResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func Test_dohHandler(t *testing.T) {
+	d := New(Config{
+		TLDs:   []string{"test"},
+		Logger: zap.NewNop(),
+	}).(*dnsServer)
+	h := &dohHandler{
+		handler: d.newMux(false),
+		token:   "secret",
+		logger:  zap.NewNop(),
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("app.test.", dns.TypeA)
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	}
+
+	cases := []struct {
+		Name       string
+		Request    *http.Request
+		Token      string
+		Forwarded  string
+		WantStatus int
+		WantIP     string
+	}{
+		{
+			Name:       "get",
+			Request:    get(),
+			Token:      "secret",
+			Forwarded:  "127.0.0.1",
+			WantStatus: http.StatusOK,
+			WantIP:     "127.0.0.1",
+		},
+		{
+			Name: "post",
+			Request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(b))
+				r.Header.Set("Content-Type", dohMediaType)
+				return r
+			}(),
+			Token:      "secret",
+			Forwarded:  "127.0.0.1",
+			WantStatus: http.StatusOK,
+			WantIP:     "127.0.0.1",
+		},
+		{
+			Name:       "address added by caddy",
+			Request:    get(),
+			Token:      "secret",
+			Forwarded:  "198.51.100.1, 127.0.0.1",
+			WantStatus: http.StatusOK,
+			WantIP:     "127.0.0.1",
+		},
+		{
+			Name:       "forwarded without token",
+			Request:    get(),
+			Forwarded:  "127.0.0.1",
+			WantStatus: http.StatusOK,
+			WantIP:     "192.0.2.1",
+		},
+		{
+			Name:       "forwarded with wrong token",
+			Request:    get(),
+			Token:      "guess",
+			Forwarded:  "127.0.0.1",
+			WantStatus: http.StatusOK,
+			WantIP:     "192.0.2.1",
+		},
+		{
+			Name:       "invalid forwarded address",
+			Request:    get(),
+			Token:      "secret",
+			Forwarded:  "unknown",
+			WantStatus: http.StatusOK,
+			WantIP:     "192.0.2.1",
+		},
+		{
+			Name: "invalid remote address",
+			Request: func() *http.Request {
+				r := get()
+				r.RemoteAddr = "unknown"
+				return r
+			}(),
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "invalid query",
+			Request:    httptest.NewRequest(http.MethodGet, "/dns-query?dns=invalid", nil),
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "invalid content type",
+			Request:    httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(b)),
+			WantStatus: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			if cc.Token != "" {
+				cc.Request.Header.Set(candy.DoHTokenHeader, cc.Token)
+			}
+			if cc.Forwarded != "" {
+				cc.Request.Header.Set("X-Forwarded-For", cc.Forwarded)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, cc.Request)
+
+			if want, got := cc.WantStatus, rec.Code; want != got {
+				t.Fatalf("mismatch status: want=%d got=%d", want, got)
+			}
+
+			if cc.WantIP == "" {
+				return
+			}
+
+			r := new(dns.Msg)
+			if err := r.Unpack(rec.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(r.Answer) != 1 {
+				t.Fatalf("unexpected answers: %v", r.Answer)
+			}
+			if a, ok := r.Answer[0].(*dns.A); !ok || a.A.String() != cc.WantIP {
+				t.Fatalf("unexpected answer: %v", r.Answer[0])
+			}
+		})
+	}
+}
+
+func Test_dnsServer_forward(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() {
+		_ = upstream.ActivateAndServe()
+	}()
+	defer upstream.Shutdown()
+
+	d := New(Config{
+		TLDs:      []string{"test"},
+		PTR:       true,
+		Upstreams: []string{pc.LocalAddr().String()},
+		Logger:    zap.NewNop(),
+	}).(*dnsServer)
+
+	cases := []struct {
+		Name      string
+		Forward   bool
+		Question  string
+		Qtype     uint16
+		WantRcode int
+		WantIP    string
+	}{
+		{
+			Name:      "candy domain",
+			Forward:   true,
+			Question:  "app.test.",
+			Qtype:     dns.TypeA,
+			WantRcode: dns.RcodeSuccess,
+			WantIP:    "127.0.0.1",
+		},
+		{
+			Name:      "other domain",
+			Forward:   true,
+			Question:  "example.com.",
+			Qtype:     dns.TypeA,
+			WantRcode: dns.RcodeSuccess,
+			WantIP:    "192.0.2.1",
+		},
+		{
+			Name:      "other reverse lookup",
+			Forward:   true,
+			Question:  "1.2.0.192.in-addr.arpa.",
+			Qtype:     dns.TypePTR,
+			WantRcode: dns.RcodeSuccess,
+			WantIP:    "192.0.2.1",
+		},
+		{
+			Name:      "other domain without forwarding",
+			Question:  "example.com.",
+			Qtype:     dns.TypeA,
+			WantRcode: dns.RcodeRefused,
+		},
+		{
+			Name:      "other reverse lookup without forwarding",
+			Question:  "1.2.0.192.in-addr.arpa.",
+			Qtype:     dns.TypePTR,
+			WantRcode: dns.RcodeNameError,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			h := &dohHandler{
+				handler: d.newMux(cc.Forward),
+				logger:  zap.NewNop(),
+			}
+
+			m := new(dns.Msg)
+			m.SetQuestion(cc.Question, cc.Qtype)
+			b, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			r := new(dns.Msg)
+			if err := r.Unpack(rec.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Rcode != cc.WantRcode {
+				t.Fatalf("mismatch rcode: want=%s got=%s", dns.RcodeToString[cc.WantRcode], dns.RcodeToString[r.Rcode])
+			}
+			if cc.WantIP == "" {
+				return
+			}
+			if len(r.Answer) != 1 {
+				t.Fatalf("unexpected answers: %v", r.Answer)
+			}
+			if a, ok := r.Answer[0].(*dns.A); !ok || a.A.String() != cc.WantIP {
+				t.Fatalf("unexpected answer: %v", r.Answer[0])
+			}
+		})
+	}
+}
+
+func Test_systemUpstreams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte("# Generated\nnameserver 192.168.1.1\nnameserver fd00::1\nsearch lan\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := systemUpstreams(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"192.168.1.1:53", "[fd00::1]:53"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch upstreams (-want +got): %s", diff)
+	}
+}
+
+func Test_dnsServer_Run_ListenError(t *testing.T) {
+	// An address that is free on UDP and TCP
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	// The DoH address is taken, so Run fails after binding addr
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	d := New(Config{
+		Addr:    addr,
+		TLDs:    []string{"test"},
+		DoHAddr: taken.Addr().String(),
+		Logger:  zap.NewNop(),
+	})
+	if err := d.Run(context.Background()); err == nil {
+		t.Fatal("want listen error")
+	}
+
+	// The listeners bound before the error are closed
+	pc, err = net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("UDP listener leaked: %s", err)
+	}
+	pc.Close()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("TCP listener leaked: %s", err)
+	}
+	ln.Close()
+}
+
+func Test_selectLocalIP(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			loopback = iface.Name
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	cases := []struct {
+		Name     string
+		Selector string
+		RouteIP  net.IP
+		WantIP   net.IP
+		WantErr  bool
+	}{
+		{
+			Name:     "default route",
+			Selector: LocalIPDefaultRoute,
+			RouteIP:  net.ParseIP("127.0.0.1"),
+			WantIP:   net.ParseIP("127.0.0.1"),
+		},
+		{
+			Name:     "interface name",
+			Selector: loopback,
+			WantIP:   net.ParseIP("127.0.0.1"),
+		},
+		{
+			Name:     "cidr",
+			Selector: "127.0.0.0/8",
+			WantIP:   net.ParseIP("127.0.0.1"),
+		},
+		{
+			Name:     "no match",
+			Selector: "203.0.113.0/24",
+			WantErr:  true,
+		},
+		{
+			Name:     "invalid cidr",
+			Selector: "127.0.0.0/99",
+			WantErr:  true,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			gotIP, _, gotErr := selectLocalIP(ifaces, cc.Selector, cc.RouteIP)
+			if cc.WantErr != (gotErr != nil) {
+				t.Fatalf("mismatch error: want=%t got=%s", cc.WantErr, gotErr)
+			}
+
+			if !gotIP.Equal(cc.WantIP) {
+				t.Fatalf("mismatch IP: want=%s got=%s", cc.WantIP, gotIP)
+			}
+		})
+	}
+}
+
+func Test_LocalIPTracker_IP(t *testing.T) {
+	tracker := NewLocalIPTracker(LocalIPConfig{
+		Interface: "127.0.0.0/8",
+		Logger:    zap.NewNop(),
+	})
+
+	// Only Run selects the IP
+	if _, err := tracker.IP(); err == nil {
+		t.Fatal("want error before the first refresh")
+	}
+
+	tracker.refresh()
+
+	ip, err := tracker.IP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.ParseIP("127.0.0.1"); !ip.Equal(want) {
+		t.Fatalf("mismatch IP: want=%s got=%s", want, ip)
+	}
+}
+
+func Test_LocalIPTracker_refresh_defaultRoute(t *testing.T) {
+	tracker := NewLocalIPTracker(LocalIPConfig{
+		Interface: LocalIPDefaultRoute,
+		Logger:    zap.NewNop(),
+	})
+
+	routeIP := net.ParseIP("127.0.0.1")
+	tracker.routeIP = func() (net.IP, error) {
+		return routeIP, nil
+	}
+
+	tracker.refresh()
+
+	ip, err := tracker.IP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.ParseIP("127.0.0.1"); !ip.Equal(want) {
+		t.Fatalf("mismatch IP: want=%s got=%s", want, ip)
+	}
+
+	// The route moves off the interfaces while they stay the same
+	routeIP = net.ParseIP("203.0.113.1")
+	tracker.refresh()
+
+	if ip, err := tracker.IP(); err == nil {
+		t.Fatalf("want error after the default route moved, got IP %s", ip)
+	}
+}
@@ -0,0 +1,149 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "candy",
+		Subsystem: "dns",
+		Name:      "queries_total",
+		Help:      "Counter of DNS queries by name, type and response code.",
+	}, []string{"name", "qtype", "rcode"})
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "candy",
+		Subsystem: "dns",
+		Name:      "query_duration_seconds",
+		Help:      "Histogram of the time taken to answer DNS queries.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"qtype"})
+)
+
+const (
+	// maxStatsNames caps the names counted by queryStats and the name
+	// label of the metrics, since the names queried are up to the clients
+	maxStatsNames = 100
+	// otherName counts the queries for names beyond maxStatsNames
+	otherName = "other"
+)
+
+func init() {
+	prometheus.MustRegister(queriesTotal, queryDuration)
+}
+
+// queryStats counts the queries of a DNS server, by name for the first
+// maxStatsNames names and under otherName for the rest
+type queryStats struct {
+	mutex  sync.Mutex
+	names  map[string]uint64
+	rcodes map[string]uint64
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{
+		names:  make(map[string]uint64),
+		rcodes: make(map[string]uint64),
+	}
+}
+
+// record counts a query and returns the name it's counted under
+func (s *queryStats) record(name, rcode string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.names[name]; !ok && len(s.names) >= maxStatsNames {
+		name = otherName
+	}
+	s.names[name]++
+	s.rcodes[rcode]++
+
+	return name
+}
+
+func (s *queryStats) Status() interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := make(map[string]uint64, len(s.names))
+	for k, v := range s.names {
+		names[k] = v
+	}
+	rcodes := make(map[string]uint64, len(s.rcodes))
+	for k, v := range s.rcodes {
+		rcodes[k] = v
+	}
+
+	return struct {
+		Names  map[string]uint64 `json:"names"`
+		Rcodes map[string]uint64 `json:"rcodes"`
+	}{
+		Names:  names,
+		Rcodes: rcodes,
+	}
+}
+
+// instrument counts and optionally logs the queries answered by next
+func (d *dnsServer) instrument(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		start := time.Now()
+
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		next.ServeDNS(rw, r)
+
+		latency := time.Since(start)
+
+		var (
+			name  string
+			qtype string
+			rcode = "NONE"
+		)
+		if len(r.Question) > 0 {
+			name = strings.ToLower(r.Question[0].Name)
+			qtype = dns.TypeToString[r.Question[0].Qtype]
+		}
+		if rw.msg != nil {
+			rcode = dns.RcodeToString[rw.msg.Rcode]
+		}
+
+		queriesTotal.WithLabelValues(d.stats.record(name, rcode), qtype, rcode).Inc()
+		queryDuration.WithLabelValues(qtype).Observe(latency.Seconds())
+
+		if !d.cfg.QueryLog {
+			return
+		}
+
+		var answers []string
+		if rw.msg != nil {
+			for _, rr := range rw.msg.Answer {
+				answers = append(answers, rr.String())
+			}
+		}
+
+		d.cfg.Logger.Info("dns query",
+			zap.Stringer("client", w.RemoteAddr()),
+			zap.String("qname", name),
+			zap.String("qtype", qtype),
+			zap.String("rcode", rcode),
+			zap.Strings("answer", answers),
+			zap.Duration("latency", latency),
+		)
+	})
+}
+
+// recordingResponseWriter keeps the reply written to a dns.ResponseWriter
+type recordingResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *recordingResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func Test_queryStats(t *testing.T) {
+	s := newQueryStats()
+	for i := 0; i < maxStatsNames+10; i++ {
+		name := fmt.Sprintf("app%d.test.", i)
+		want := name
+		if i >= maxStatsNames {
+			want = otherName
+		}
+		if got := s.record(name, "NOERROR"); want != got {
+			t.Fatalf("mismatch recorded name: want=%s got=%s", want, got)
+		}
+	}
+	if want, got := "app0.test.", s.record("app0.test.", "NXDOMAIN"); want != got {
+		t.Fatalf("mismatch recorded name: want=%s got=%s", want, got)
+	}
+
+	status := s.Status().(struct {
+		Names  map[string]uint64 `json:"names"`
+		Rcodes map[string]uint64 `json:"rcodes"`
+	})
+
+	if want, got := maxStatsNames+1, len(status.Names); want != got {
+		t.Fatalf("mismatch names: want=%d got=%d", want, got)
+	}
+	if want, got := uint64(2), status.Names["app0.test."]; want != got {
+		t.Fatalf("mismatch app0.test. count: want=%d got=%d", want, got)
+	}
+	if want, got := uint64(10), status.Names[otherName]; want != got {
+		t.Fatalf("mismatch %s count: want=%d got=%d", otherName, want, got)
+	}
+	if diff := cmp.Diff(map[string]uint64{"NOERROR": uint64(maxStatsNames + 10), "NXDOMAIN": 1}, status.Rcodes); diff != "" {
+		t.Fatalf("mismatch rcodes (-want +got): %s", diff)
+	}
+
+	// Status returns a copy
+	status.Names["app0.test."] = 0
+	if s.names["app0.test."] != 2 {
+		t.Fatal("Status shares the names with queryStats")
+	}
+}
+
+func Test_instrument(t *testing.T) {
+	d := New(Config{
+		TLDs:   []string{"test"},
+		Logger: zap.NewNop(),
+	}).(*dnsServer)
+	h := d.instrument(d.newMux(false))
+
+	cases := []struct {
+		Name      string
+		Question  string
+		WantName  string
+		WantRcode string
+	}{
+		{
+			Name:      "candy domain",
+			Question:  "App.Test.",
+			WantName:  "app.test.",
+			WantRcode: "NOERROR",
+		},
+		{
+			Name:      "other domain",
+			Question:  "example.com.",
+			WantName:  "example.com.",
+			WantRcode: "REFUSED",
+		},
+	}
+
+	for _, cc := range cases {
+		before := queriesCount(t, cc.WantName, "A", cc.WantRcode)
+
+		m := new(dns.Msg)
+		m.SetQuestion(cc.Question, dns.TypeA)
+		h.ServeDNS(&testResponseWriter{}, m)
+
+		if got := queriesCount(t, cc.WantName, "A", cc.WantRcode) - before; got != 1 {
+			t.Fatalf("%s: mismatch queries_total: want=1 got=%v", cc.Name, got)
+		}
+	}
+
+	if diff := cmp.Diff(map[string]uint64{"app.test.": 1, "example.com.": 1}, d.stats.names); diff != "" {
+		t.Fatalf("mismatch names (-want +got): %s", diff)
+	}
+}
+
+// queriesCount returns candy_dns_queries_total for name, qtype and rcode
+func queriesCount(t *testing.T, name, qtype, rcode string) float64 {
+	t.Helper()
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		if mf.GetName() != "candy_dns_queries_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if len(labels) == 3 && labels["name"] == name && labels["qtype"] == qtype && labels["rcode"] == rcode {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	return 0
+}
+
+// testResponseWriter is a dns.ResponseWriter from 127.0.0.1 that drops
+// the replies
+type testResponseWriter struct{}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error   { return nil }
+func (w *testResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testResponseWriter) Close() error                { return nil }
+func (w *testResponseWriter) TsigStatus() error           { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool)         {}
+func (w *testResponseWriter) Hijack()                     {}
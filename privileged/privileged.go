@@ -0,0 +1,383 @@
+// Package privileged plans how Candy is reached on the privileged ports 80
+// and 443 on Linux while it listens on unprivileged ports, the equivalent
+// of the launchd sockets on Mac.
+package privileged
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/owenthereal/candy/sysconf"
+)
+
+// Modes of reaching Candy on the privileged ports
+const (
+	// ModeRedirect redirects the privileged ports to Candy with firewall
+	// rules. Only IPv4 connections made on this machine are redirected, as
+	// the rules are in the nat OUTPUT chain.
+	ModeRedirect = "redirect"
+	// ModeCapability lets the candy binary bind the privileged ports itself
+	ModeCapability = "capability"
+	// ModeSocket listens on the privileged ports with systemd socket units
+	// named candy-proxy-<name> that proxy to Candy
+	ModeSocket = "socket"
+	// ModeNone removes what any of the modes set up
+	ModeNone = "none"
+)
+
+// Firewalls that install the redirect rules, by the name of their command
+const (
+	FirewallNFT      = "nft"
+	FirewallIPTables = "iptables"
+)
+
+const (
+	nftTable     = "candy"
+	ruleComment  = "candy"
+	redirectUnit = "candy-redirect.service"
+
+	nftTmpl = `table ip %[1]s {}
+delete table ip %[1]s
+table ip %[1]s {
+	chain output {
+		type nat hook output priority -100; policy accept;
+%[2]s	}
+}
+`
+	nftRuleTmpl = "\t\tfib daddr type local tcp dport %d redirect to :%d\n"
+
+	// The firewall services flush the rules when they start, so the
+	// redirect follows them
+	redirectUnitTmpl = `[Unit]
+Description=Candy redirect of ports 80 and 443
+After=nftables.service iptables.service netfilter-persistent.service
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+%s
+[Install]
+WantedBy=multi-user.target
+`
+
+	socketUnitTmpl = `[Unit]
+Description=Candy %[1]s on port %[2]d
+
+[Socket]
+ListenStream=%[3]s
+
+[Install]
+WantedBy=sockets.target
+`
+	serviceUnitTmpl = `[Unit]
+Description=Candy %[1]s on port %[2]d
+Requires=%[3]s
+After=%[3]s
+
+[Service]
+ExecStart=%[4]s %[5]s
+DynamicUser=yes
+PrivateTmp=yes
+`
+)
+
+type Config struct {
+	// HTTPAddr and HTTPSAddr are the addresses Candy listens on
+	HTTPAddr  string
+	HTTPSAddr string
+	// Binary is the candy executable that gets the capability
+	Binary string
+	// Firewall is the path of nft or iptables that installs the redirect
+	// rules
+	Firewall string
+	// RulesFile is where the nft rules are saved for the unit that
+	// restores them at boot
+	RulesFile string
+	// SocketProxyd is the path of systemd-socket-proxyd
+	SocketProxyd string
+	// UnitDir is where the systemd units are installed
+	UnitDir string
+}
+
+// port is a privileged port that is forwarded to Candy
+type port struct {
+	Name       string
+	Privileged int
+	Host       string
+	Port       int
+}
+
+// Plan returns the actions that set up mode, after removing what the
+// other modes set up
+func Plan(mode string, cfg Config) ([]sysconf.Action, error) {
+	switch mode {
+	case ModeRedirect, ModeCapability, ModeSocket, ModeNone:
+	default:
+		return nil, fmt.Errorf("unknown mode %q, must be %s, %s, %s or %s", mode, ModeRedirect, ModeCapability, ModeSocket, ModeNone)
+	}
+
+	ports, err := parsePorts(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []sysconf.Action
+	for _, m := range []string{ModeRedirect, ModeCapability, ModeSocket} {
+		if m != mode {
+			actions = append(actions, teardown(m, cfg, ports)...)
+		}
+	}
+
+	setup, err := setup(mode, cfg, ports)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(actions, setup...), nil
+}
+
+func parsePorts(cfg Config) ([]port, error) {
+	var ports []port
+	for _, p := range []struct {
+		Name       string
+		Privileged int
+		Addr       string
+	}{
+		{Name: "http", Privileged: 80, Addr: cfg.HTTPAddr},
+		{Name: "https", Privileged: 443, Addr: cfg.HTTPSAddr},
+	} {
+		host, portStr, err := net.SplitHostPort(p.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s address %s: %w", p.Name, p.Addr, err)
+		}
+
+		n, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s address %s: %w", p.Name, p.Addr, err)
+		}
+
+		ports = append(ports, port{Name: p.Name, Privileged: p.Privileged, Host: host, Port: n})
+	}
+
+	return ports, nil
+}
+
+func setup(mode string, cfg Config, ports []port) ([]sysconf.Action, error) {
+	if mode == ModeNone {
+		return nil, nil
+	}
+
+	if mode == ModeCapability {
+		if cfg.Binary == "" {
+			return nil, fmt.Errorf("the path of the candy binary is required")
+		}
+
+		return []sysconf.Action{{Cmd: []string{"setcap", "cap_net_bind_service=+ep", cfg.Binary}}}, nil
+	}
+
+	for _, p := range ports {
+		if p.Port == p.Privileged {
+			return nil, fmt.Errorf("%s address already listens on port %d, use %s instead", p.Name, p.Privileged, ModeCapability)
+		}
+	}
+
+	switch mode {
+	case ModeRedirect:
+		// The rules are installed by a oneshot unit, which installs them
+		// again at boot and removes them when it's stopped
+		var actions []sysconf.Action
+		switch firewallName(cfg) {
+		case FirewallNFT:
+			if cfg.RulesFile == "" {
+				return nil, fmt.Errorf("the path of the nft rules file is required")
+			}
+
+			actions = append(actions,
+				sysconf.Action{Path: cfg.RulesFile, Content: nftRules(ports)},
+				sysconf.Action{Path: filepath.Join(cfg.UnitDir, redirectUnit), Content: nftUnit(cfg.Firewall, cfg.RulesFile)},
+			)
+		case FirewallIPTables:
+			actions = append(actions, sysconf.Action{Path: filepath.Join(cfg.UnitDir, redirectUnit), Content: iptablesUnit(cfg.Firewall, ports)})
+		default:
+			return nil, fmt.Errorf("%s or %s is required to redirect ports", FirewallNFT, FirewallIPTables)
+		}
+
+		return append(actions,
+			sysconf.Action{Cmd: []string{"systemctl", "daemon-reload"}},
+			sysconf.Action{Cmd: []string{"systemctl", "enable", redirectUnit}},
+			// Picks up changed rules of a unit that already ran
+			sysconf.Action{Cmd: []string{"systemctl", "restart", redirectUnit}},
+		), nil
+	case ModeSocket:
+		if cfg.SocketProxyd == "" {
+			return nil, fmt.Errorf("systemd-socket-proxyd is required for socket units")
+		}
+
+		var (
+			actions []sysconf.Action
+			sockets []string
+		)
+		for _, p := range ports {
+			actions = append(actions,
+				sysconf.Action{Path: filepath.Join(cfg.UnitDir, socketName(p.Name)), Content: socketUnit(p.Name, p.Privileged, p.Host)},
+				sysconf.Action{Path: filepath.Join(cfg.UnitDir, serviceName(p.Name)), Content: serviceUnit(p.Name, p.Privileged, cfg.SocketProxyd, targetAddr(p))},
+			)
+			sockets = append(sockets, socketName(p.Name))
+		}
+
+		return append(actions,
+			sysconf.Action{Cmd: []string{"systemctl", "daemon-reload"}},
+			sysconf.Action{Cmd: append([]string{"systemctl", "enable"}, sockets...)},
+			// Picks up changed addresses of sockets that are already listening
+			sysconf.Action{Cmd: append([]string{"systemctl", "restart"}, sockets...)},
+		), nil
+	}
+
+	return nil, nil
+}
+
+func teardown(mode string, cfg Config, ports []port) []sysconf.Action {
+	switch mode {
+	case ModeRedirect:
+		// Stopping the unit removes the rules
+		actions := []sysconf.Action{
+			{Cmd: []string{"systemctl", "disable", "--now", redirectUnit}, IgnoreError: true},
+			{Path: filepath.Join(cfg.UnitDir, redirectUnit), Remove: true},
+		}
+		if cfg.RulesFile != "" {
+			actions = append(actions, sysconf.Action{Path: cfg.RulesFile, Remove: true})
+		}
+		actions = append(actions, sysconf.Action{Cmd: []string{"systemctl", "daemon-reload"}, IgnoreError: true})
+
+		// Rules that are left without the unit, e.g. when it failed
+		switch firewallName(cfg) {
+		case FirewallNFT:
+			actions = append(actions, sysconf.Action{Cmd: nftDelete(cfg.Firewall), IgnoreError: true})
+		case FirewallIPTables:
+			for _, p := range ports {
+				actions = append(actions, sysconf.Action{Cmd: iptablesRule(cfg.Firewall, "-D", p), IgnoreError: true})
+			}
+		}
+
+		return actions
+	case ModeCapability:
+		if cfg.Binary != "" {
+			return []sysconf.Action{{Cmd: []string{"setcap", "-r", cfg.Binary}, IgnoreError: true}}
+		}
+	case ModeSocket:
+		units := []string{"systemctl", "disable", "--now"}
+		var actions []sysconf.Action
+		for _, p := range ports {
+			units = append(units, socketName(p.Name), serviceName(p.Name))
+			actions = append(actions,
+				sysconf.Action{Path: filepath.Join(cfg.UnitDir, socketName(p.Name)), Remove: true},
+				sysconf.Action{Path: filepath.Join(cfg.UnitDir, serviceName(p.Name)), Remove: true},
+			)
+		}
+
+		return append(
+			append([]sysconf.Action{{Cmd: units, IgnoreError: true}}, actions...),
+			sysconf.Action{Cmd: []string{"systemctl", "daemon-reload"}, IgnoreError: true},
+		)
+	}
+
+	return nil
+}
+
+func nftRules(ports []port) string {
+	var rules strings.Builder
+	for _, p := range ports {
+		fmt.Fprintf(&rules, nftRuleTmpl, p.Privileged, p.Port)
+	}
+
+	return fmt.Sprintf(nftTmpl, nftTable, rules.String())
+}
+
+func nftDelete(nft string) []string {
+	return []string{nft, "delete", "table", "ip", nftTable}
+}
+
+// nftUnit renders the redirect unit that loads the nft rules of rulesFile
+func nftUnit(nft, rulesFile string) string {
+	return fmt.Sprintf(redirectUnitTmpl,
+		"ExecStart="+strings.Join([]string{nft, "-f", rulesFile}, " ")+"\n"+
+			"ExecStop=-"+strings.Join(nftDelete(nft), " ")+"\n",
+	)
+}
+
+// iptablesUnit renders the redirect unit that appends the iptables rules
+// redirecting ports
+func iptablesUnit(iptables string, ports []port) string {
+	var start, stop strings.Builder
+	for _, p := range ports {
+		// Appending the same rule twice would duplicate it
+		fmt.Fprintf(&start, "ExecStart=-%s\n", strings.Join(iptablesRule(iptables, "-D", p), " "))
+		fmt.Fprintf(&start, "ExecStart=%s\n", strings.Join(iptablesRule(iptables, "-A", p), " "))
+		fmt.Fprintf(&stop, "ExecStop=-%s\n", strings.Join(iptablesRule(iptables, "-D", p), " "))
+	}
+
+	return fmt.Sprintf(redirectUnitTmpl, start.String()+stop.String())
+}
+
+// iptablesRule returns the iptables command that appends (-A) or deletes
+// (-D) the rule redirecting p. Locally generated connections to any local
+// address are redirected to the loopback address.
+func iptablesRule(iptables, op string, p port) []string {
+	return []string{
+		iptables, "-t", "nat", op, "OUTPUT",
+		"-p", "tcp", "--dport", strconv.Itoa(p.Privileged),
+		"-m", "addrtype", "--dst-type", "LOCAL",
+		"-m", "comment", "--comment", ruleComment,
+		"-j", "REDIRECT", "--to-ports", strconv.Itoa(p.Port),
+	}
+}
+
+// socketUnit renders the systemd socket unit that listens on port of host,
+// or of all addresses if host is empty
+func socketUnit(name string, port int, host string) string {
+	listen := strconv.Itoa(port)
+	if host != "" {
+		listen = net.JoinHostPort(host, listen)
+	}
+
+	return fmt.Sprintf(socketUnitTmpl, strings.ToUpper(name), port, listen)
+}
+
+// serviceUnit renders the systemd service unit that proxies the
+// connections of the socket unit of name to addr with socketProxyd
+func serviceUnit(name string, port int, socketProxyd, addr string) string {
+	return fmt.Sprintf(serviceUnitTmpl, strings.ToUpper(name), port, socketName(name), socketProxyd, addr)
+}
+
+// firewallName returns the name of the firewall command of cfg
+func firewallName(cfg Config) string {
+	if cfg.Firewall == "" {
+		return ""
+	}
+
+	return filepath.Base(cfg.Firewall)
+}
+
+// socketName and serviceName name the units of ModeSocket apart from the
+// candy-<name>.socket units of the user service that Candy listens on
+func socketName(name string) string {
+	return "candy-proxy-" + name + ".socket"
+}
+
+func serviceName(name string) string {
+	return "candy-proxy-" + name + ".service"
+}
+
+// targetAddr is the address socket units proxy to, the loopback address if
+// Candy listens on all addresses
+func targetAddr(p port) string {
+	host := p.Host
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(p.Port))
+}
@@ -0,0 +1,368 @@
+package privileged
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/owenthereal/candy/sysconf"
+)
+
+func Test_Plan(t *testing.T) {
+	cfg := Config{
+		HTTPAddr:     "127.0.0.1:28080",
+		HTTPSAddr:    "127.0.0.1:28443",
+		Binary:       "/usr/local/bin/candy",
+		Firewall:     "/usr/sbin/nft",
+		RulesFile:    "/etc/candy/redirect.nft",
+		SocketProxyd: "/usr/lib/systemd/systemd-socket-proxyd",
+		UnitDir:      "/etc/systemd/system",
+	}
+
+	cases := []struct {
+		Name    string
+		Mode    string
+		Cfg     func(cfg Config) Config
+		Actions []string
+		Err     string
+	}{
+		{
+			Name: "redirect with nft",
+			Mode: ModeRedirect,
+			Actions: []string{
+				"setcap -r /usr/local/bin/candy",
+				"systemctl disable --now candy-proxy-http.socket candy-proxy-http.service candy-proxy-https.socket candy-proxy-https.service",
+				"remove /etc/systemd/system/candy-proxy-http.socket",
+				"remove /etc/systemd/system/candy-proxy-http.service",
+				"remove /etc/systemd/system/candy-proxy-https.socket",
+				"remove /etc/systemd/system/candy-proxy-https.service",
+				"systemctl daemon-reload",
+				"write /etc/candy/redirect.nft",
+				"write /etc/systemd/system/candy-redirect.service",
+				"systemctl daemon-reload",
+				"systemctl enable candy-redirect.service",
+				"systemctl restart candy-redirect.service",
+			},
+		},
+		{
+			Name: "redirect with iptables",
+			Mode: ModeRedirect,
+			Cfg: func(cfg Config) Config {
+				cfg.Firewall = "/usr/sbin/iptables"
+				cfg.RulesFile = ""
+				cfg.Binary = ""
+				cfg.UnitDir = "/run/systemd/system"
+				return cfg
+			},
+			Actions: []string{
+				"systemctl disable --now candy-proxy-http.socket candy-proxy-http.service candy-proxy-https.socket candy-proxy-https.service",
+				"remove /run/systemd/system/candy-proxy-http.socket",
+				"remove /run/systemd/system/candy-proxy-http.service",
+				"remove /run/systemd/system/candy-proxy-https.socket",
+				"remove /run/systemd/system/candy-proxy-https.service",
+				"systemctl daemon-reload",
+				"write /run/systemd/system/candy-redirect.service",
+				"systemctl daemon-reload",
+				"systemctl enable candy-redirect.service",
+				"systemctl restart candy-redirect.service",
+			},
+		},
+		{
+			Name: "capability",
+			Mode: ModeCapability,
+			Actions: []string{
+				"systemctl disable --now candy-redirect.service",
+				"remove /etc/systemd/system/candy-redirect.service",
+				"remove /etc/candy/redirect.nft",
+				"systemctl daemon-reload",
+				"/usr/sbin/nft delete table ip candy",
+				"systemctl disable --now candy-proxy-http.socket candy-proxy-http.service candy-proxy-https.socket candy-proxy-https.service",
+				"remove /etc/systemd/system/candy-proxy-http.socket",
+				"remove /etc/systemd/system/candy-proxy-http.service",
+				"remove /etc/systemd/system/candy-proxy-https.socket",
+				"remove /etc/systemd/system/candy-proxy-https.service",
+				"systemctl daemon-reload",
+				"setcap cap_net_bind_service=+ep /usr/local/bin/candy",
+			},
+		},
+		{
+			Name: "socket",
+			Mode: ModeSocket,
+			Actions: []string{
+				"systemctl disable --now candy-redirect.service",
+				"remove /etc/systemd/system/candy-redirect.service",
+				"remove /etc/candy/redirect.nft",
+				"systemctl daemon-reload",
+				"/usr/sbin/nft delete table ip candy",
+				"setcap -r /usr/local/bin/candy",
+				"write /etc/systemd/system/candy-proxy-http.socket",
+				"write /etc/systemd/system/candy-proxy-http.service",
+				"write /etc/systemd/system/candy-proxy-https.socket",
+				"write /etc/systemd/system/candy-proxy-https.service",
+				"systemctl daemon-reload",
+				"systemctl enable candy-proxy-http.socket candy-proxy-https.socket",
+				"systemctl restart candy-proxy-http.socket candy-proxy-https.socket",
+			},
+		},
+		{
+			Name: "none",
+			Mode: ModeNone,
+			Actions: []string{
+				"systemctl disable --now candy-redirect.service",
+				"remove /etc/systemd/system/candy-redirect.service",
+				"remove /etc/candy/redirect.nft",
+				"systemctl daemon-reload",
+				"/usr/sbin/nft delete table ip candy",
+				"setcap -r /usr/local/bin/candy",
+				"systemctl disable --now candy-proxy-http.socket candy-proxy-http.service candy-proxy-https.socket candy-proxy-https.service",
+				"remove /etc/systemd/system/candy-proxy-http.socket",
+				"remove /etc/systemd/system/candy-proxy-http.service",
+				"remove /etc/systemd/system/candy-proxy-https.socket",
+				"remove /etc/systemd/system/candy-proxy-https.service",
+				"systemctl daemon-reload",
+			},
+		},
+		{
+			Name: "unknown mode",
+			Mode: "forward",
+			Err:  `unknown mode "forward", must be redirect, capability, socket or none`,
+		},
+		{
+			Name: "redirect without firewall",
+			Mode: ModeRedirect,
+			Cfg: func(cfg Config) Config {
+				cfg.Firewall = ""
+				return cfg
+			},
+			Err: "nft or iptables is required to redirect ports",
+		},
+		{
+			Name: "redirect without rules file",
+			Mode: ModeRedirect,
+			Cfg: func(cfg Config) Config {
+				cfg.RulesFile = ""
+				return cfg
+			},
+			Err: "the path of the nft rules file is required",
+		},
+		{
+			Name: "none with iptables",
+			Mode: ModeNone,
+			Cfg: func(cfg Config) Config {
+				cfg.Firewall = "/usr/sbin/iptables"
+				cfg.RulesFile = ""
+				cfg.Binary = ""
+				return cfg
+			},
+			Actions: []string{
+				"systemctl disable --now candy-redirect.service",
+				"remove /etc/systemd/system/candy-redirect.service",
+				"systemctl daemon-reload",
+				"/usr/sbin/iptables -t nat -D OUTPUT -p tcp --dport 80 -m addrtype --dst-type LOCAL -m comment --comment candy -j REDIRECT --to-ports 28080",
+				"/usr/sbin/iptables -t nat -D OUTPUT -p tcp --dport 443 -m addrtype --dst-type LOCAL -m comment --comment candy -j REDIRECT --to-ports 28443",
+				"systemctl disable --now candy-proxy-http.socket candy-proxy-http.service candy-proxy-https.socket candy-proxy-https.service",
+				"remove /etc/systemd/system/candy-proxy-http.socket",
+				"remove /etc/systemd/system/candy-proxy-http.service",
+				"remove /etc/systemd/system/candy-proxy-https.socket",
+				"remove /etc/systemd/system/candy-proxy-https.service",
+				"systemctl daemon-reload",
+			},
+		},
+		{
+			Name: "socket on privileged port",
+			Mode: ModeSocket,
+			Cfg: func(cfg Config) Config {
+				cfg.HTTPSAddr = "127.0.0.1:443"
+				return cfg
+			},
+			Err: "https address already listens on port 443, use capability instead",
+		},
+		{
+			Name: "invalid address",
+			Mode: ModeNone,
+			Cfg: func(cfg Config) Config {
+				cfg.HTTPAddr = "28080"
+				return cfg
+			},
+			Err: "error parsing http address 28080: address 28080: missing port in address",
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := cfg
+			if cc.Cfg != nil {
+				cfg = cc.Cfg(cfg)
+			}
+
+			actions, err := Plan(cc.Mode, cfg)
+			if cc.Err != "" {
+				if err == nil || err.Error() != cc.Err {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, a := range actions {
+				got = append(got, a.String())
+			}
+
+			if diff := cmp.Diff(cc.Actions, got); diff != "" {
+				t.Fatalf("Unexpected actions (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func Test_Plan_Content(t *testing.T) {
+	cfg := Config{
+		HTTPAddr:     ":28080",
+		HTTPSAddr:    "127.0.0.1:28443",
+		Firewall:     "/usr/sbin/nft",
+		RulesFile:    "/etc/candy/redirect.nft",
+		SocketProxyd: "/lib/systemd/systemd-socket-proxyd",
+		UnitDir:      "/etc/systemd/system",
+	}
+
+	t.Run("nft rules", func(t *testing.T) {
+		actions, err := Plan(ModeRedirect, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{
+			"redirect.nft": `table ip candy {}
+delete table ip candy
+table ip candy {
+	chain output {
+		type nat hook output priority -100; policy accept;
+		fib daddr type local tcp dport 80 redirect to :28080
+		fib daddr type local tcp dport 443 redirect to :28443
+	}
+}
+`,
+			"candy-redirect.service": `[Unit]
+Description=Candy redirect of ports 80 and 443
+After=nftables.service iptables.service netfilter-persistent.service
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/usr/sbin/nft -f /etc/candy/redirect.nft
+ExecStop=-/usr/sbin/nft delete table ip candy
+
+[Install]
+WantedBy=multi-user.target
+`,
+		}
+		if diff := cmp.Diff(want, writtenFiles(actions)); diff != "" {
+			t.Fatalf("Unexpected rules (-want +got): %s", diff)
+		}
+	})
+
+	t.Run("iptables rules", func(t *testing.T) {
+		cfg := cfg
+		cfg.Firewall = "/usr/sbin/iptables"
+
+		actions, err := Plan(ModeRedirect, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{
+			"candy-redirect.service": `[Unit]
+Description=Candy redirect of ports 80 and 443
+After=nftables.service iptables.service netfilter-persistent.service
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=-/usr/sbin/iptables -t nat -D OUTPUT -p tcp --dport 80 -m addrtype --dst-type LOCAL -m comment --comment candy -j REDIRECT --to-ports 28080
+ExecStart=/usr/sbin/iptables -t nat -A OUTPUT -p tcp --dport 80 -m addrtype --dst-type LOCAL -m comment --comment candy -j REDIRECT --to-ports 28080
+ExecStart=-/usr/sbin/iptables -t nat -D OUTPUT -p tcp --dport 443 -m addrtype --dst-type LOCAL -m comment --comment candy -j REDIRECT --to-ports 28443
+ExecStart=/usr/sbin/iptables -t nat -A OUTPUT -p tcp --dport 443 -m addrtype --dst-type LOCAL -m comment --comment candy -j REDIRECT --to-ports 28443
+ExecStop=-/usr/sbin/iptables -t nat -D OUTPUT -p tcp --dport 80 -m addrtype --dst-type LOCAL -m comment --comment candy -j REDIRECT --to-ports 28080
+ExecStop=-/usr/sbin/iptables -t nat -D OUTPUT -p tcp --dport 443 -m addrtype --dst-type LOCAL -m comment --comment candy -j REDIRECT --to-ports 28443
+
+[Install]
+WantedBy=multi-user.target
+`,
+		}
+		if diff := cmp.Diff(want, writtenFiles(actions)); diff != "" {
+			t.Fatalf("Unexpected rules (-want +got): %s", diff)
+		}
+	})
+
+	t.Run("socket units", func(t *testing.T) {
+		actions, err := Plan(ModeSocket, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		units := writtenFiles(actions)
+
+		want := map[string]string{
+			"candy-proxy-http.socket": `[Unit]
+Description=Candy HTTP on port 80
+
+[Socket]
+ListenStream=80
+
+[Install]
+WantedBy=sockets.target
+`,
+			"candy-proxy-http.service": `[Unit]
+Description=Candy HTTP on port 80
+Requires=candy-proxy-http.socket
+After=candy-proxy-http.socket
+
+[Service]
+ExecStart=/lib/systemd/systemd-socket-proxyd 127.0.0.1:28080
+DynamicUser=yes
+PrivateTmp=yes
+`,
+			"candy-proxy-https.socket": `[Unit]
+Description=Candy HTTPS on port 443
+
+[Socket]
+ListenStream=127.0.0.1:443
+
+[Install]
+WantedBy=sockets.target
+`,
+			"candy-proxy-https.service": `[Unit]
+Description=Candy HTTPS on port 443
+Requires=candy-proxy-https.socket
+After=candy-proxy-https.socket
+
+[Service]
+ExecStart=/lib/systemd/systemd-socket-proxyd 127.0.0.1:28443
+DynamicUser=yes
+PrivateTmp=yes
+`,
+		}
+		if diff := cmp.Diff(want, units); diff != "" {
+			t.Fatalf("Unexpected units (-want +got): %s", diff)
+		}
+	})
+}
+
+// writtenFiles returns the content of the files that actions write by
+// their base name
+func writtenFiles(actions []sysconf.Action) map[string]string {
+	files := make(map[string]string)
+	for _, a := range actions {
+		if a.Path != "" && !a.Remove {
+			files[filepath.Base(a.Path)] = a.Content
+		}
+	}
+
+	return files
+}
@@ -0,0 +1,74 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/owenthereal/candy/sysconf"
+)
+
+const (
+	// MacResolverDir is where Mac reads the resolvers of domains from
+	MacResolverDir = "/etc/resolver"
+
+	macResolverPrefix = "candy-"
+	macResolverTmpl   = `domain %s
+nameserver %s
+port %s
+search_order 1
+timeout 5`
+)
+
+// MacInstalled returns the resolver files of Candy in MacResolverDir
+// under root, which is / except in tests
+func MacInstalled(root string) ([]string, error) {
+	return filepath.Glob(filepath.Join(root, MacResolverDir, macResolverPrefix+"*"))
+}
+
+// MacPlan returns the actions that write the resolver file of each domain
+// in dir and remove the installed files of domains that are no longer
+// configured
+func MacPlan(dir string, cfg Config, installed []string) ([]sysconf.Action, error) {
+	addr, err := serverAddr(cfg)
+	if err != nil {
+		return nil, err
+	}
+	host, port, _ := net.SplitHostPort(addr)
+
+	var (
+		actions []sysconf.Action
+		files   []string
+	)
+	for _, domain := range cfg.Domains {
+		file := filepath.Join(dir, macResolverPrefix+domain)
+		files = append(files, file)
+		actions = append(actions, sysconf.Action{Path: file, Content: fmt.Sprintf(macResolverTmpl, domain, host, port)})
+	}
+
+	var stale []string
+	for _, file := range installed {
+		if !slices.Contains(files, file) && strings.HasPrefix(filepath.Base(file), macResolverPrefix) {
+			stale = append(stale, file)
+		}
+	}
+
+	return append(actions, MacUninstall(stale)...), nil
+}
+
+// MacUninstall returns the actions that remove the installed resolver
+// files, and make mDNSResponder forget the answers of Candy
+func MacUninstall(installed []string) []sysconf.Action {
+	if len(installed) == 0 {
+		return nil
+	}
+
+	var actions []sysconf.Action
+	for _, file := range installed {
+		actions = append(actions, sysconf.Action{Path: file, Remove: true})
+	}
+
+	return append(actions, sysconf.Action{Cmd: []string{"killall", "-HUP", "mDNSResponder"}})
+}
@@ -0,0 +1,109 @@
+package resolver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_MacPlan(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Domains   []string
+		Installed []string
+		Actions   []string
+	}{
+		{
+			Name:    "new install",
+			Domains: []string{"test", "dev"},
+			Actions: []string{
+				"write /etc/resolver/candy-test",
+				"write /etc/resolver/candy-dev",
+			},
+		},
+		{
+			Name:      "dropped domain",
+			Domains:   []string{"test"},
+			Installed: []string{"/etc/resolver/candy-test", "/etc/resolver/candy-dev"},
+			Actions: []string{
+				"write /etc/resolver/candy-test",
+				"remove /etc/resolver/candy-dev",
+				"killall -HUP mDNSResponder",
+			},
+		},
+		{
+			Name:      "not owned by candy",
+			Domains:   []string{"test"},
+			Installed: []string{"/etc/resolver/test"},
+			Actions: []string{
+				"write /etc/resolver/candy-test",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			actions, err := MacPlan(MacResolverDir, Config{Domains: cc.Domains, DNSAddr: "127.0.0.1:25353"}, cc.Installed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, a := range actions {
+				got = append(got, a.String())
+			}
+
+			if diff := cmp.Diff(cc.Actions, got); diff != "" {
+				t.Fatalf("Unexpected actions (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func Test_MacPlan_Content(t *testing.T) {
+	actions, err := MacPlan(MacResolverDir, Config{Domains: []string{"test"}, DNSAddr: ":25353"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `domain test
+nameserver 127.0.0.1
+port 25353
+search_order 1
+timeout 5`
+	if diff := cmp.Diff(want, actions[0].Content); diff != "" {
+		t.Fatalf("Unexpected content (-want +got): %s", diff)
+	}
+}
+
+func Test_MacInstalled(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, MacResolverDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"candy-test", "candy-dev", "corp"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	installed, err := MacInstalled(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Join(dir, "candy-dev"), filepath.Join(dir, "candy-test")}
+	if diff := cmp.Diff(want, installed); diff != "" {
+		t.Fatalf("Unexpected files (-want +got): %s", diff)
+	}
+
+	if got := MacUninstall(installed); len(got) != 3 || got[2].String() != "killall -HUP mDNSResponder" {
+		t.Fatalf("Unexpected actions: %v", got)
+	}
+}
@@ -0,0 +1,355 @@
+// Package resolver plans the split DNS that sends the domains of Candy to
+// its DNS server: the /etc/resolver files on Mac, and the config of the
+// resolver stack that Detect finds on Linux.
+package resolver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/owenthereal/candy/sysconf"
+)
+
+// Stacks that resolve host names
+const (
+	// StackResolved is systemd-resolved managing /etc/resolv.conf
+	StackResolved = "systemd-resolved"
+	// StackNetworkManager is NetworkManager running dnsmasq with dns=dnsmasq
+	StackNetworkManager = "networkmanager-dnsmasq"
+	// StackDnsmasq is a local dnsmasq that /etc/resolv.conf points to,
+	// e.g. through the dnsmasq subscriber of openresolv
+	StackDnsmasq = "dnsmasq"
+	// StackUnbound is a local unbound that /etc/resolv.conf points to,
+	// e.g. through the unbound subscriber of openresolv
+	StackUnbound = "unbound"
+	// StackResolvconf is resolvconf or openresolv writing /etc/resolv.conf
+	// without a local resolver
+	StackResolvconf = "resolvconf"
+	// StackPlain is a plain /etc/resolv.conf
+	StackPlain = "resolv.conf"
+)
+
+const (
+	resolvConf = "/etc/resolv.conf"
+
+	resolvedFile = "/etc/systemd/resolved.conf.d/candy.conf"
+	// legacyResolvedFile is where earlier versions of candy setup wrote
+	// the systemd-resolved config, the directory owned by the distro
+	legacyResolvedFile     = "/usr/lib/systemd/resolved.conf.d/01-candy.conf"
+	networkManagerConf     = "/etc/NetworkManager/NetworkManager.conf"
+	networkManagerConfDir  = "/etc/NetworkManager/conf.d"
+	networkManagerDnsmasq  = "/etc/NetworkManager/dnsmasq.d/candy.conf"
+	dnsmasqConfDir         = "/etc/dnsmasq.d"
+	dnsmasqFile            = "/etc/dnsmasq.d/candy.conf"
+	unboundConfDir         = "/etc/unbound/unbound.conf.d"
+	unboundFile            = "/etc/unbound/unbound.conf.d/candy.conf"
+	resolvconfConf         = "/etc/resolvconf.conf"
+	resolvedStubNameserver = "127.0.0.53"
+
+	header = "# Written by candy setup, sends the domains of Candy to its DNS server\n"
+)
+
+// configuredStacks are the stacks that candy setup writes a file for
+var configuredStacks = []string{StackResolved, StackNetworkManager, StackDnsmasq, StackUnbound}
+
+// stackFiles are the files that candy setup writes for the stacks
+var stackFiles = map[string]string{
+	StackResolved:       resolvedFile,
+	StackNetworkManager: networkManagerDnsmasq,
+	StackDnsmasq:        dnsmasqFile,
+	StackUnbound:        unboundFile,
+}
+
+// stackServices are the services that read stackFiles
+var stackServices = map[string]string{
+	StackResolved:       "systemd-resolved",
+	StackNetworkManager: "NetworkManager",
+	StackDnsmasq:        "dnsmasq",
+	StackUnbound:        "unbound",
+}
+
+type Config struct {
+	// Domains are the top-level domains of Candy
+	Domains []string
+	// DNSAddr is the address of the DNS server of Candy
+	DNSAddr string
+}
+
+// Detect returns the stack that resolves host names on the system under
+// root, which is / except in tests
+func Detect(root string) (string, error) {
+	path := filepath.Join(root, resolvConf)
+
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("error reading %s: %w", resolvConf, err)
+	}
+	// Where the managers of /etc/resolv.conf link it to
+	target, _ := os.Readlink(path)
+	nameservers := parseNameservers(string(content))
+
+	if strings.Contains(target, "/run/systemd/resolve/") || slices.Contains(nameservers, resolvedStubNameserver) {
+		return StackResolved, nil
+	}
+
+	dns, err := networkManagerDNS(root)
+	if err != nil {
+		return "", err
+	}
+	if dns == "dnsmasq" {
+		return StackNetworkManager, nil
+	}
+
+	subscriber, err := resolvconfSubscriber(root)
+	if err != nil {
+		return "", err
+	}
+	if subscriber != "" {
+		return subscriber, nil
+	}
+
+	if fi, err := os.Stat(filepath.Join(root, dnsmasqConfDir)); err == nil && fi.IsDir() && hasLoopback(nameservers) {
+		return StackDnsmasq, nil
+	}
+
+	if fi, err := os.Stat(filepath.Join(root, unboundConfDir)); err == nil && fi.IsDir() && hasLoopback(nameservers) {
+		return StackUnbound, nil
+	}
+
+	if strings.Contains(target, "resolvconf") || strings.Contains(string(content), "resolvconf") {
+		return StackResolvconf, nil
+	}
+
+	return StackPlain, nil
+}
+
+// Plan returns the actions that send the domains to the DNS server with
+// stack, after removing what candy setup wrote for the other stacks
+func Plan(stack string, cfg Config) ([]sysconf.Action, error) {
+	addr, err := serverAddr(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var content string
+	switch stack {
+	case StackResolved:
+		content = resolvedConf(cfg.Domains, addr)
+	case StackNetworkManager, StackDnsmasq:
+		content = dnsmasqConf(cfg.Domains, addr)
+	case StackUnbound:
+		content = unboundConf(cfg.Domains, addr)
+	case StackResolvconf:
+		// resolvconf only writes nameservers to resolv.conf, which take all
+		// queries on port 53. Only a local resolver, such as the dnsmasq or
+		// unbound that openresolv's subscribers configure, routes domains.
+		return nil, fmt.Errorf("%s can't send only %s to %s without a local resolver, set dnsmasq_conf or unbound_conf in %s for a local dnsmasq or unbound, or use systemd-resolved or NetworkManager with dns=dnsmasq", stack, domainList(cfg.Domains), addr, resolvconfConf)
+	case StackPlain:
+		// A nameserver of resolv.conf takes all queries on port 53, while
+		// Candy only answers its domains
+		return nil, fmt.Errorf("%s can't send only %s to %s, use systemd-resolved, NetworkManager with dns=dnsmasq, or a local dnsmasq that /etc/resolv.conf points to", stack, domainList(cfg.Domains), addr)
+	default:
+		return nil, fmt.Errorf("unknown stack %q", stack)
+	}
+
+	actions := []sysconf.Action{{Path: legacyResolvedFile, Remove: true}}
+	for _, s := range configuredStacks {
+		if s != stack {
+			actions = append(actions, sysconf.Action{Path: stackFiles[s], Remove: true})
+		}
+	}
+
+	return append(actions,
+		sysconf.Action{Path: stackFiles[stack], Content: content},
+		sysconf.Action{Cmd: []string{"systemctl", "restart", stackServices[stack]}},
+	), nil
+}
+
+// Uninstall returns the actions that remove what candy setup wrote for any
+// stack, restarting the service of stack to forget the domains
+func Uninstall(stack string) []sysconf.Action {
+	actions := []sysconf.Action{{Path: legacyResolvedFile, Remove: true}}
+	for _, s := range configuredStacks {
+		actions = append(actions, sysconf.Action{Path: stackFiles[s], Remove: true})
+	}
+
+	if service, ok := stackServices[stack]; ok {
+		actions = append(actions, sysconf.Action{Cmd: []string{"systemctl", "restart", service}})
+	}
+
+	return actions
+}
+
+// Explain describes what Plan set up for stack
+func Explain(stack string, cfg Config) string {
+	addr, _ := serverAddr(cfg)
+
+	return fmt.Sprintf("Host names are resolved by %s, which now sends %s to Candy's DNS server at %s as configured in %s.", stack, domainList(cfg.Domains), addr, stackFiles[stack])
+}
+
+// resolvedConf renders the systemd-resolved config. The domains are
+// routing-only (~), so they aren't appended to single-label host names.
+func resolvedConf(domains []string, addr string) string {
+	routes := make([]string, len(domains))
+	for i, d := range domains {
+		routes[i] = "~" + d
+	}
+
+	return fmt.Sprintf("%s[Resolve]\nDNS=%s\nDomains=%s\n", header, addr, strings.Join(routes, " "))
+}
+
+// dnsmasqConf renders the dnsmasq config forwarding the domains
+func dnsmasqConf(domains []string, addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+
+	var b strings.Builder
+	b.WriteString(header)
+	for _, d := range domains {
+		fmt.Fprintf(&b, "server=/%s/%s#%s\n", d, host, port)
+	}
+
+	return b.String()
+}
+
+// unboundConf renders the unbound config forwarding the domains. unbound
+// refuses to query localhost and serves the special-use domains such as
+// .test itself unless told otherwise, and the domains aren't DNSSEC signed.
+func unboundConf(domains []string, addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+
+	var b strings.Builder
+	b.WriteString(header)
+	b.WriteString("server:\n\tdo-not-query-localhost: no\n")
+	for _, d := range domains {
+		fmt.Fprintf(&b, "\tdomain-insecure: \"%s.\"\n\tlocal-zone: \"%s.\" nodefault\n", d, d)
+	}
+	for _, d := range domains {
+		fmt.Fprintf(&b, "forward-zone:\n\tname: \"%s.\"\n\tforward-addr: %s@%s\n", d, host, port)
+	}
+
+	return b.String()
+}
+
+// serverAddr returns the address to send queries to, the loopback address
+// if Candy listens on all addresses
+func serverAddr(cfg Config) (string, error) {
+	if len(cfg.Domains) == 0 {
+		return "", fmt.Errorf("at least one domain is required")
+	}
+
+	host, port, err := net.SplitHostPort(cfg.DNSAddr)
+	if err != nil {
+		return "", fmt.Errorf("error parsing DNS address %s: %w", cfg.DNSAddr, err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// networkManagerDNS returns the dns= of the main section of the
+// NetworkManager config, where conf.d overrides NetworkManager.conf in the
+// order of the file names that Glob sorts
+func networkManagerDNS(root string) (string, error) {
+	files := []string{filepath.Join(root, networkManagerConf)}
+
+	confd, err := filepath.Glob(filepath.Join(root, networkManagerConfDir, "*.conf"))
+	if err != nil {
+		return "", err
+	}
+
+	var dns string
+	for _, file := range append(files, confd...) {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading %s: %w", file, err)
+		}
+
+		section := ""
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				section = line
+				continue
+			}
+
+			key, value, ok := strings.Cut(line, "=")
+			if ok && section == "[main]" && strings.TrimSpace(key) == "dns" {
+				dns = strings.TrimSpace(value)
+			}
+		}
+		f.Close()
+	}
+
+	return dns, nil
+}
+
+// resolvconfSubscriber returns the stack of the local resolver that
+// openresolv configures with a subscriber in resolvconf.conf, if any
+func resolvconfSubscriber(root string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(root, resolvconfConf))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %w", resolvconfConf, err)
+	}
+
+	var stack string
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.Trim(value, `"'`) == "" {
+			continue
+		}
+
+		switch key {
+		case "unbound_conf":
+			return StackUnbound, nil
+		case "dnsmasq_conf":
+			stack = StackDnsmasq
+		}
+	}
+
+	return stack, nil
+}
+
+func parseNameservers(content string) []string {
+	var nameservers []string
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			nameservers = append(nameservers, fields[1])
+		}
+	}
+
+	return nameservers
+}
+
+func hasLoopback(nameservers []string) bool {
+	for _, ns := range nameservers {
+		if ip := net.ParseIP(ns); ip != nil && ip.IsLoopback() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func domainList(domains []string) string {
+	dots := make([]string, len(domains))
+	for i, d := range domains {
+		dots[i] = "." + d
+	}
+
+	return strings.Join(dots, ", ")
+}
@@ -0,0 +1,400 @@
+package resolver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_Detect(t *testing.T) {
+	cases := []struct {
+		Name string
+		// Files are written under the root, a value starting with -> is
+		// the target of a symlink
+		Files map[string]string
+		Dirs  []string
+		Stack string
+	}{
+		{
+			Name: "systemd-resolved stub",
+			Files: map[string]string{
+				"/etc/resolv.conf": "->../run/systemd/resolve/stub-resolv.conf",
+			},
+			Stack: StackResolved,
+		},
+		{
+			Name: "systemd-resolved nameserver",
+			Files: map[string]string{
+				"/etc/resolv.conf": "# Generated by NetworkManager\nnameserver 127.0.0.53\noptions edns0\n",
+			},
+			Stack: StackResolved,
+		},
+		{
+			Name: "NetworkManager with dnsmasq",
+			Files: map[string]string{
+				"/etc/resolv.conf":                         "# Generated by NetworkManager\nnameserver 127.0.1.1\n",
+				"/etc/NetworkManager/NetworkManager.conf":  "[main]\nplugins=ifupdown,keyfile\ndns=default\n",
+				"/etc/NetworkManager/conf.d/10-dns.conf":   "[main]\ndns = dnsmasq\n",
+				"/etc/NetworkManager/conf.d/20-other.conf": "[logging]\ndns=none\n",
+			},
+			Stack: StackNetworkManager,
+		},
+		{
+			Name: "NetworkManager overridden",
+			Files: map[string]string{
+				"/etc/resolv.conf":                        "nameserver 192.168.1.1\n",
+				"/etc/NetworkManager/NetworkManager.conf": "[main]\ndns=dnsmasq\n",
+				"/etc/NetworkManager/conf.d/90-dns.conf":  "[main]\ndns=default\n",
+			},
+			Stack: StackPlain,
+		},
+		{
+			Name: "local dnsmasq",
+			Files: map[string]string{
+				"/etc/resolv.conf": "nameserver 127.0.0.1\n",
+			},
+			Dirs:  []string{"/etc/dnsmasq.d"},
+			Stack: StackDnsmasq,
+		},
+		{
+			Name: "dnsmasq not in resolv.conf",
+			Files: map[string]string{
+				"/etc/resolv.conf": "nameserver 192.168.1.1\n",
+			},
+			Dirs:  []string{"/etc/dnsmasq.d"},
+			Stack: StackPlain,
+		},
+		{
+			Name: "resolvconf",
+			Files: map[string]string{
+				"/etc/resolv.conf": "->/run/resolvconf/resolv.conf",
+			},
+			Stack: StackResolvconf,
+		},
+		{
+			Name: "openresolv",
+			Files: map[string]string{
+				"/etc/resolv.conf": "# Generated by resolvconf\nnameserver 192.168.1.1\n",
+			},
+			Stack: StackResolvconf,
+		},
+		{
+			Name: "openresolv with dnsmasq",
+			Files: map[string]string{
+				"/etc/resolv.conf": "# Generated by resolvconf\nnameserver 127.0.0.1\n",
+			},
+			Dirs:  []string{"/etc/dnsmasq.d"},
+			Stack: StackDnsmasq,
+		},
+		{
+			Name: "openresolv with unbound subscriber",
+			Files: map[string]string{
+				"/etc/resolv.conf":     "# Generated by resolvconf\nnameserver 127.0.0.1\n",
+				"/etc/resolvconf.conf": "name_servers=127.0.0.1\nunbound_conf=/etc/unbound/unbound.conf.d/resolvconf.conf\n",
+			},
+			Stack: StackUnbound,
+		},
+		{
+			Name: "openresolv with dnsmasq subscriber",
+			Files: map[string]string{
+				"/etc/resolv.conf":     "# Generated by resolvconf\nnameserver 127.0.0.1\n",
+				"/etc/resolvconf.conf": "# dnsmasq reads these\nname_servers=127.0.0.1\ndnsmasq_conf=/etc/dnsmasq-conf.conf\ndnsmasq_resolv=/etc/dnsmasq-resolv.conf\n",
+			},
+			Stack: StackDnsmasq,
+		},
+		{
+			Name: "openresolv without subscriber",
+			Files: map[string]string{
+				"/etc/resolv.conf":     "# Generated by resolvconf\nnameserver 192.168.1.1\n",
+				"/etc/resolvconf.conf": "resolv_conf=/etc/resolv.conf\n#unbound_conf=/etc/unbound/resolvconf.conf\n",
+			},
+			Stack: StackResolvconf,
+		},
+		{
+			Name: "local unbound",
+			Files: map[string]string{
+				"/etc/resolv.conf": "nameserver ::1\n",
+			},
+			Dirs:  []string{"/etc/unbound/unbound.conf.d"},
+			Stack: StackUnbound,
+		},
+		{
+			Name:  "no resolv.conf",
+			Stack: StackPlain,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			for _, dir := range cc.Dirs {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, content := range cc.Files {
+				path := filepath.Join(root, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+
+				var err error
+				if target, ok := strings.CutPrefix(content, "->"); ok {
+					err = os.Symlink(target, path)
+				} else {
+					err = os.WriteFile(path, []byte(content), 0o644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stack, err := Detect(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stack != cc.Stack {
+				t.Fatalf("Unexpected stack: want=%s got=%s", cc.Stack, stack)
+			}
+		})
+	}
+}
+
+func Test_Plan(t *testing.T) {
+	cfg := Config{
+		Domains: []string{"test", "dev"},
+		DNSAddr: "127.0.0.1:25353",
+	}
+
+	cases := []struct {
+		Name    string
+		Stack   string
+		Cfg     func(cfg Config) Config
+		Actions []string
+		Content string
+		Err     string
+	}{
+		{
+			Name:  "systemd-resolved",
+			Stack: StackResolved,
+			Actions: []string{
+				"remove /usr/lib/systemd/resolved.conf.d/01-candy.conf",
+				"remove /etc/NetworkManager/dnsmasq.d/candy.conf",
+				"remove /etc/dnsmasq.d/candy.conf",
+				"remove /etc/unbound/unbound.conf.d/candy.conf",
+				"write /etc/systemd/resolved.conf.d/candy.conf",
+				"systemctl restart systemd-resolved",
+			},
+			Content: header + "[Resolve]\nDNS=127.0.0.1:25353\nDomains=~test ~dev\n",
+		},
+		{
+			Name:  "NetworkManager with dnsmasq",
+			Stack: StackNetworkManager,
+			Actions: []string{
+				"remove /usr/lib/systemd/resolved.conf.d/01-candy.conf",
+				"remove /etc/systemd/resolved.conf.d/candy.conf",
+				"remove /etc/dnsmasq.d/candy.conf",
+				"remove /etc/unbound/unbound.conf.d/candy.conf",
+				"write /etc/NetworkManager/dnsmasq.d/candy.conf",
+				"systemctl restart NetworkManager",
+			},
+			Content: header + "server=/test/127.0.0.1#25353\nserver=/dev/127.0.0.1#25353\n",
+		},
+		{
+			Name:  "dnsmasq on all addresses",
+			Stack: StackDnsmasq,
+			Cfg: func(cfg Config) Config {
+				cfg.DNSAddr = ":25353"
+				cfg.Domains = []string{"test"}
+				return cfg
+			},
+			Actions: []string{
+				"remove /usr/lib/systemd/resolved.conf.d/01-candy.conf",
+				"remove /etc/systemd/resolved.conf.d/candy.conf",
+				"remove /etc/NetworkManager/dnsmasq.d/candy.conf",
+				"remove /etc/unbound/unbound.conf.d/candy.conf",
+				"write /etc/dnsmasq.d/candy.conf",
+				"systemctl restart dnsmasq",
+			},
+			Content: header + "server=/test/127.0.0.1#25353\n",
+		},
+		{
+			Name:  "systemd-resolved on IPv6",
+			Stack: StackResolved,
+			Cfg: func(cfg Config) Config {
+				cfg.DNSAddr = "[::1]:25353"
+				cfg.Domains = []string{"test"}
+				return cfg
+			},
+			Actions: []string{
+				"remove /usr/lib/systemd/resolved.conf.d/01-candy.conf",
+				"remove /etc/NetworkManager/dnsmasq.d/candy.conf",
+				"remove /etc/dnsmasq.d/candy.conf",
+				"remove /etc/unbound/unbound.conf.d/candy.conf",
+				"write /etc/systemd/resolved.conf.d/candy.conf",
+				"systemctl restart systemd-resolved",
+			},
+			Content: header + "[Resolve]\nDNS=[::1]:25353\nDomains=~test\n",
+		},
+		{
+			Name:  "unbound",
+			Stack: StackUnbound,
+			Actions: []string{
+				"remove /usr/lib/systemd/resolved.conf.d/01-candy.conf",
+				"remove /etc/systemd/resolved.conf.d/candy.conf",
+				"remove /etc/NetworkManager/dnsmasq.d/candy.conf",
+				"remove /etc/dnsmasq.d/candy.conf",
+				"write /etc/unbound/unbound.conf.d/candy.conf",
+				"systemctl restart unbound",
+			},
+			Content: header + `server:
+	do-not-query-localhost: no
+	domain-insecure: "test."
+	local-zone: "test." nodefault
+	domain-insecure: "dev."
+	local-zone: "dev." nodefault
+forward-zone:
+	name: "test."
+	forward-addr: 127.0.0.1@25353
+forward-zone:
+	name: "dev."
+	forward-addr: 127.0.0.1@25353
+`,
+		},
+		{
+			Name:  "unbound on IPv6",
+			Stack: StackUnbound,
+			Cfg: func(cfg Config) Config {
+				cfg.DNSAddr = "[::1]:25353"
+				cfg.Domains = []string{"test"}
+				return cfg
+			},
+			Actions: []string{
+				"remove /usr/lib/systemd/resolved.conf.d/01-candy.conf",
+				"remove /etc/systemd/resolved.conf.d/candy.conf",
+				"remove /etc/NetworkManager/dnsmasq.d/candy.conf",
+				"remove /etc/dnsmasq.d/candy.conf",
+				"write /etc/unbound/unbound.conf.d/candy.conf",
+				"systemctl restart unbound",
+			},
+			Content: header + "server:\n\tdo-not-query-localhost: no\n\tdomain-insecure: \"test.\"\n\tlocal-zone: \"test.\" nodefault\nforward-zone:\n\tname: \"test.\"\n\tforward-addr: ::1@25353\n",
+		},
+		{
+			Name:  "resolvconf",
+			Stack: StackResolvconf,
+			Err:   "resolvconf can't send only .test, .dev to 127.0.0.1:25353 without a local resolver, set dnsmasq_conf or unbound_conf in /etc/resolvconf.conf for a local dnsmasq or unbound, or use systemd-resolved or NetworkManager with dns=dnsmasq",
+		},
+		{
+			Name:  "plain",
+			Stack: StackPlain,
+			Err:   "resolv.conf can't send only .test, .dev to 127.0.0.1:25353, use systemd-resolved, NetworkManager with dns=dnsmasq, or a local dnsmasq that /etc/resolv.conf points to",
+		},
+		{
+			Name:  "no domains",
+			Stack: StackResolved,
+			Cfg: func(cfg Config) Config {
+				cfg.Domains = nil
+				return cfg
+			},
+			Err: "at least one domain is required",
+		},
+		{
+			Name:  "unknown stack",
+			Stack: "bind",
+			Err:   `unknown stack "bind"`,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := cfg
+			if cc.Cfg != nil {
+				cfg = cc.Cfg(cfg)
+			}
+
+			actions, err := Plan(cc.Stack, cfg)
+			if cc.Err != "" {
+				if err == nil || err.Error() != cc.Err {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				got     []string
+				content string
+			)
+			for _, a := range actions {
+				got = append(got, a.String())
+				if a.Content != "" {
+					content = a.Content
+				}
+			}
+
+			if diff := cmp.Diff(cc.Actions, got); diff != "" {
+				t.Fatalf("Unexpected actions (-want +got): %s", diff)
+			}
+			if diff := cmp.Diff(cc.Content, content); diff != "" {
+				t.Fatalf("Unexpected content (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func Test_Uninstall(t *testing.T) {
+	cases := []struct {
+		Stack   string
+		Actions []string
+	}{
+		{
+			Stack: StackResolved,
+			Actions: []string{
+				"remove /usr/lib/systemd/resolved.conf.d/01-candy.conf",
+				"remove /etc/systemd/resolved.conf.d/candy.conf",
+				"remove /etc/NetworkManager/dnsmasq.d/candy.conf",
+				"remove /etc/dnsmasq.d/candy.conf",
+				"remove /etc/unbound/unbound.conf.d/candy.conf",
+				"systemctl restart systemd-resolved",
+			},
+		},
+		{
+			Stack: StackPlain,
+			Actions: []string{
+				"remove /usr/lib/systemd/resolved.conf.d/01-candy.conf",
+				"remove /etc/systemd/resolved.conf.d/candy.conf",
+				"remove /etc/NetworkManager/dnsmasq.d/candy.conf",
+				"remove /etc/dnsmasq.d/candy.conf",
+				"remove /etc/unbound/unbound.conf.d/candy.conf",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Stack, func(t *testing.T) {
+			t.Parallel()
+
+			var got []string
+			for _, a := range Uninstall(cc.Stack) {
+				got = append(got, a.String())
+			}
+
+			if diff := cmp.Diff(cc.Actions, got); diff != "" {
+				t.Fatalf("Unexpected actions (-want +got): %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package runnable
+
+import (
+	"sync"
+)
+
+// Readier is implemented by runnables that signal when they are ready to
+// serve, e.g. once their listeners are bound
+type Readier interface {
+	// Ready returns a channel that is closed once the runnable is ready
+	Ready() <-chan struct{}
+}
+
+// ReadySignal is a Readier that is signalled once.
+// Signalling again, e.g. after a restart, is a no-op.
+type ReadySignal struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func NewReadySignal() *ReadySignal {
+	return &ReadySignal{
+		ch: make(chan struct{}),
+	}
+}
+
+// Signal marks the runnable as ready
+func (s *ReadySignal) Signal() {
+	s.once.Do(func() {
+		close(s.ch)
+	})
+}
+
+func (s *ReadySignal) Ready() <-chan struct{} {
+	return s.ch
+}
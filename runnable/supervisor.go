@@ -0,0 +1,293 @@
+package runnable
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMinBackoff  = 500 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+	defaultStableAfter = 1 * time.Second
+)
+
+// RestartPolicy tells the supervisor when to restart a runnable that exited
+type RestartPolicy int
+
+const (
+	// RestartNever leaves the runnable stopped
+	RestartNever RestartPolicy = iota
+	// RestartOnFailure restarts the runnable with exponential backoff when it returns an error
+	RestartOnFailure
+	// RestartAlways restarts the runnable with exponential backoff whenever it exits
+	RestartAlways
+)
+
+// State is the state of a supervised runnable
+type State string
+
+const (
+	StateStarting   State = "starting"
+	StateRunning    State = "running"
+	StateBackingOff State = "backing_off"
+	StateStopped    State = "stopped"
+)
+
+// Service is a runnable managed by the supervisor
+type Service struct {
+	Name    string
+	Runable Runable
+	Restart RestartPolicy
+	// Critical stops all the other services when this one fails,
+	// regardless of its restart policy
+	Critical bool
+}
+
+type SupervisorConfig struct {
+	Services []Service
+	// MinBackoff and MaxBackoff bound the delay between restarts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// StableAfter is how long a service has to run before it's considered
+	// running and its backoff is reset
+	StableAfter time.Duration
+	Logger      *zap.Logger
+}
+
+// ServiceStatus is the reported state of a supervised service
+type ServiceStatus struct {
+	State    State  `json:"state"`
+	Restarts int    `json:"restarts"`
+	Error    string `json:"error,omitempty"`
+}
+
+func NewSupervisor(cfg SupervisorConfig) *Supervisor {
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.StableAfter <= 0 {
+		cfg.StableAfter = defaultStableAfter
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop()
+	}
+
+	var (
+		st     = make(map[string]ServiceStatus, len(cfg.Services))
+		exited = make(map[string]*ReadySignal, len(cfg.Services))
+	)
+	for _, svc := range cfg.Services {
+		st[svc.Name] = ServiceStatus{State: StateStopped}
+		exited[svc.Name] = NewReadySignal()
+	}
+
+	return &Supervisor{
+		cfg:    cfg,
+		status: st,
+		ready:  NewReadySignal(),
+		exited: exited,
+	}
+}
+
+// Supervisor runs services independently of each other, restarting them
+// according to their restart policies. Unlike RunWithContext, only the
+// failure of a critical service stops the others.
+type Supervisor struct {
+	cfg SupervisorConfig
+
+	mutex  sync.Mutex
+	status map[string]ServiceStatus
+	ready  *ReadySignal
+	// exited is signalled once the first run of a service is over
+	exited map[string]*ReadySignal
+}
+
+// Ready is closed once all the critical services that are Readiers are
+// ready and the non-critical ones are ready or have exited
+func (s *Supervisor) Ready() <-chan struct{} {
+	return s.ready.Ready()
+}
+
+// waitReady signals Ready once the Readier services have settled. A
+// non-critical service that exits before it's ready, e.g. the DNS server
+// when its port is taken, is restarted with backoff and doesn't hold up
+// the others.
+func (s *Supervisor) waitReady(ctx context.Context) {
+	for _, svc := range s.cfg.Services {
+		r, ok := svc.Runable.(Readier)
+		if !ok {
+			continue
+		}
+
+		var exited <-chan struct{}
+		if !svc.Critical {
+			exited = s.exited[svc.Name].Ready()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.Ready():
+		case <-exited:
+		}
+	}
+
+	s.ready.Signal()
+}
+
+// Run runs the services until ctx is done, a critical service fails or
+// all services are stopped
+func (s *Supervisor) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		errch = make(chan error, len(s.cfg.Services))
+	)
+	readyCtx, readyCancel := context.WithCancel(ctx)
+	readyDone := make(chan struct{})
+	go func() {
+		defer close(readyDone)
+		s.waitReady(readyCtx)
+	}()
+	defer func() {
+		readyCancel()
+		<-readyDone
+	}()
+
+	for _, svc := range s.cfg.Services {
+		svc := svc
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := s.supervise(ctx, svc); err != nil {
+				errch <- err
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errch:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// Status returns the status of each service by name
+func (s *Supervisor) Status() interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := make(map[string]ServiceStatus, len(s.status))
+	for name, st := range s.status {
+		result[name] = st
+	}
+
+	return result
+}
+
+// Running reports whether all the critical services are running. The
+// non-critical ones are left out on purpose: they're restarted on their own
+// and the others keep working without them.
+func (s *Supervisor) Running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, svc := range s.cfg.Services {
+		if svc.Critical && s.status[svc.Name].State != StateRunning {
+			return false
+		}
+	}
+
+	return true
+}
+
+// supervise runs svc until it's stopped for good. It returns the error
+// of a failed critical service.
+func (s *Supervisor) supervise(ctx context.Context, svc Service) error {
+	logger := s.cfg.Logger.With(zap.String("service", svc.Name))
+	backoff := s.cfg.MinBackoff
+
+	for {
+		s.setState(svc.Name, StateStarting, nil, false)
+
+		started := time.Now()
+		stable := time.AfterFunc(s.cfg.StableAfter, func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+
+			if st := s.status[svc.Name]; st.State == StateStarting {
+				st.State = StateRunning
+				s.status[svc.Name] = st
+			}
+		})
+		err := svc.Runable.Run(ctx)
+		stable.Stop()
+		s.exited[svc.Name].Signal()
+
+		if ctx.Err() != nil {
+			s.setState(svc.Name, StateStopped, nil, false)
+			return nil
+		}
+
+		if err != nil && svc.Critical {
+			logger.Error("critical service failed", zap.Error(err))
+			s.setState(svc.Name, StateStopped, err, false)
+			return err
+		}
+
+		if svc.Restart == RestartNever || (err == nil && svc.Restart == RestartOnFailure) {
+			logger.Info("service stopped", zap.Error(err))
+			s.setState(svc.Name, StateStopped, err, false)
+			return nil
+		}
+
+		if time.Since(started) >= s.cfg.StableAfter {
+			backoff = s.cfg.MinBackoff
+		}
+
+		logger.Warn("service exited, restarting", zap.Duration("backoff", backoff), zap.Error(err))
+		s.setState(svc.Name, StateBackingOff, err, true)
+
+		select {
+		case <-ctx.Done():
+			s.setState(svc.Name, StateStopped, err, false)
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > s.cfg.MaxBackoff {
+			backoff = s.cfg.MaxBackoff
+		}
+	}
+}
+
+func (s *Supervisor) setState(name string, state State, err error, restart bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st := s.status[name]
+	st.State = state
+	if err != nil {
+		st.Error = err.Error()
+	} else if state != StateStarting {
+		st.Error = ""
+	}
+	if restart {
+		st.Restarts++
+	}
+	s.status[name] = st
+}
@@ -0,0 +1,307 @@
+package runnable
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type runFunc func(ctx context.Context) error
+
+func (f runFunc) Run(ctx context.Context) error {
+	return f(ctx)
+}
+
+// failing fails the first n runs and blocks afterwards
+func failing(n int32, runs *int32) Runable {
+	return runFunc(func(ctx context.Context) error {
+		if atomic.AddInt32(runs, 1) <= n {
+			return errors.New("failed")
+		}
+
+		<-ctx.Done()
+		return ctx.Err()
+	})
+}
+
+func blocking() Runable {
+	return runFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+}
+
+func Test_Supervisor(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Service    func(runs *int32) Service
+		WantRuns   int32
+		WantStatus ServiceStatus
+		WantErr    bool
+	}{
+		{
+			Name: "restart on failure",
+			Service: func(runs *int32) Service {
+				return Service{Name: "svc", Runable: failing(2, runs), Restart: RestartOnFailure}
+			},
+			WantRuns:   3,
+			WantStatus: ServiceStatus{State: StateRunning, Restarts: 2, Error: "failed"},
+		},
+		{
+			Name: "never restart",
+			Service: func(runs *int32) Service {
+				return Service{Name: "svc", Runable: failing(2, runs), Restart: RestartNever}
+			},
+			WantRuns:   1,
+			WantStatus: ServiceStatus{State: StateStopped, Error: "failed"},
+		},
+		{
+			Name: "always restart",
+			Service: func(runs *int32) Service {
+				return Service{Name: "svc", Runable: runFunc(func(ctx context.Context) error {
+					if atomic.AddInt32(runs, 1) <= 2 {
+						return nil
+					}
+
+					<-ctx.Done()
+					return ctx.Err()
+				}), Restart: RestartAlways}
+			},
+			WantRuns:   3,
+			WantStatus: ServiceStatus{State: StateRunning, Restarts: 2},
+		},
+		{
+			Name: "critical failure",
+			Service: func(runs *int32) Service {
+				return Service{Name: "svc", Runable: failing(2, runs), Restart: RestartOnFailure, Critical: true}
+			},
+			WantRuns:   1,
+			WantStatus: ServiceStatus{State: StateStopped, Error: "failed"},
+			WantErr:    true,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			var runs int32
+			s := NewSupervisor(SupervisorConfig{
+				Services: []Service{
+					cc.Service(&runs),
+					{Name: "other", Runable: blocking()},
+				},
+				MinBackoff:  10 * time.Millisecond,
+				MaxBackoff:  20 * time.Millisecond,
+				StableAfter: 100 * time.Millisecond,
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			errch := make(chan error, 1)
+			go func() {
+				errch <- s.Run(ctx)
+			}()
+
+			time.Sleep(500 * time.Millisecond)
+
+			st := s.Status().(map[string]ServiceStatus)
+			if diff := cmp.Diff(cc.WantStatus, st["svc"]); diff != "" {
+				t.Fatalf("mismatch status (-want +got): %s", diff)
+			}
+
+			if want, got := cc.WantRuns, atomic.LoadInt32(&runs); want != got {
+				t.Fatalf("mismatch runs: want=%d got=%d", want, got)
+			}
+
+			if cc.WantErr {
+				// The other services are stopped as well
+				if diff := cmp.Diff(ServiceStatus{State: StateStopped}, st["other"]); diff != "" {
+					t.Fatalf("mismatch other status (-want +got): %s", diff)
+				}
+
+				select {
+				case err := <-errch:
+					if err == nil || err.Error() != "failed" {
+						t.Fatalf("unexpected error: %v", err)
+					}
+				default:
+					t.Fatal("supervisor is still running")
+				}
+
+				return
+			}
+
+			if diff := cmp.Diff(ServiceStatus{State: StateRunning}, st["other"]); diff != "" {
+				t.Fatalf("mismatch other status (-want +got): %s", diff)
+			}
+
+			cancel()
+			if err := <-errch; !errors.Is(err, context.Canceled) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+type readyRunable struct {
+	*ReadySignal
+	start chan struct{}
+}
+
+func (r readyRunable) Run(ctx context.Context) error {
+	<-r.start
+	r.Signal()
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func Test_Supervisor_Running(t *testing.T) {
+	var runs, stoppedRuns int32
+	s := NewSupervisor(SupervisorConfig{
+		Services: []Service{
+			{Name: "critical", Runable: blocking(), Critical: true},
+			{Name: "other", Runable: failing(100, &runs), Restart: RestartAlways},
+			{Name: "stopped", Runable: failing(1, &stoppedRuns), Restart: RestartNever},
+		},
+		MinBackoff:  10 * time.Millisecond,
+		StableAfter: 100 * time.Millisecond,
+	})
+
+	if s.Running() {
+		t.Fatal("unexpected running before Run")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- s.Run(ctx)
+	}()
+
+	// Only critical services count, the others keep failing or are stopped
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Running() {
+		if time.Now().After(deadline) {
+			t.Fatal("error wait time out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-errch
+
+	if s.Running() {
+		t.Fatal("unexpected running after Run")
+	}
+}
+
+func Test_Supervisor_Ready(t *testing.T) {
+	r := readyRunable{ReadySignal: NewReadySignal(), start: make(chan struct{})}
+
+	s := NewSupervisor(SupervisorConfig{
+		Services: []Service{
+			{Name: "ready", Runable: r},
+			{Name: "other", Runable: blocking()},
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- s.Run(ctx)
+	}()
+
+	select {
+	case <-s.Ready():
+		t.Fatal("unexpected ready")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(r.start)
+
+	select {
+	case <-s.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("error wait time out")
+	}
+
+	cancel()
+	<-errch
+}
+
+// failingReadier fails every run before it's ready
+type failingReadier struct {
+	*ReadySignal
+}
+
+func (r failingReadier) Run(ctx context.Context) error {
+	return errors.New("failed")
+}
+
+func Test_Supervisor_Ready_Failed(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Critical  bool
+		WantReady bool
+	}{
+		{
+			Name:      "non-critical",
+			WantReady: true,
+		},
+		{
+			Name:     "critical",
+			Critical: true,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			r := readyRunable{ReadySignal: NewReadySignal(), start: make(chan struct{})}
+			close(r.start)
+
+			s := NewSupervisor(SupervisorConfig{
+				Services: []Service{
+					{Name: "ready", Runable: r, Critical: true},
+					{Name: "failing", Runable: failingReadier{NewReadySignal()}, Restart: RestartAlways, Critical: cc.Critical},
+				},
+				MinBackoff: 10 * time.Millisecond,
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			errch := make(chan error, 1)
+			go func() {
+				errch <- s.Run(ctx)
+			}()
+
+			select {
+			case <-s.Ready():
+				if !cc.WantReady {
+					t.Fatal("unexpected ready")
+				}
+			case <-time.After(500 * time.Millisecond):
+				if cc.WantReady {
+					t.Fatal("error wait time out")
+				}
+			}
+
+			cancel()
+			<-errch
+		})
+	}
+}
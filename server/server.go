@@ -2,25 +2,74 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"reflect"
+	"sync"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/owenthereal/candy"
 	"github.com/owenthereal/candy/caddy"
 	"github.com/owenthereal/candy/dns"
 	"github.com/owenthereal/candy/runnable"
+	"github.com/owenthereal/candy/status"
+	"github.com/owenthereal/candy/tcp"
 	"github.com/owenthereal/candy/watch"
 	"go.uber.org/zap"
 )
 
 type Config struct {
-	HostRoot   string   `mapstructure:"host-root"`
-	Domain     []string `mapstructure:"domain"`
-	HttpAddr   string   `mapstructure:"http-addr"`
-	HttpsAddr  string   `mapstructure:"https-addr"`
-	AdminAddr  string   `mapstructure:"admin-addr"`
-	DnsAddr    string   `mapstructure:"dns-addr"`
-	DnsLocalIp bool     `mapstructure:"dns-local-ip"`
-	Debug      bool     `mapstructure:"debug"`
+	HostRoot          string        `mapstructure:"host-root"`
+	StateDir          string        `mapstructure:"state-dir"`
+	Domain            []string      `mapstructure:"domain"`
+	HttpAddr          string        `mapstructure:"http-addr"`
+	HttpsAddr         string        `mapstructure:"https-addr"`
+	HttpsProtocols    []string      `mapstructure:"https-protocols"`
+	HttpMode          string        `mapstructure:"http-mode"`
+	HstsMaxAge        int           `mapstructure:"hsts-max-age"`
+	AdminAddr         string        `mapstructure:"admin-addr"`
+	DnsAddr           string        `mapstructure:"dns-addr"`
+	DnsLocalIp        bool          `mapstructure:"dns-local-ip"`
+	DnsLocalIf        string        `mapstructure:"dns-local-ip-interface"`
+	DnsPTR            bool          `mapstructure:"dns-ptr"`
+	DnsLog            bool          `mapstructure:"dns-log"`
+	DnsDoHAddr        string        `mapstructure:"dns-doh-addr"`
+	DnsDoTAddr        string        `mapstructure:"dns-dot-addr"`
+	DnsUpstream       []string      `mapstructure:"dns-upstream"`
+	TcpSNIAddr        string        `mapstructure:"tcp-sni-addr"`
+	TcpIp             string        `mapstructure:"tcp-ip"`
+	MDNS              bool          `mapstructure:"mdns"`
+	MDNSSuffix        bool          `mapstructure:"mdns-host-suffix"`
+	WatchDebounce     time.Duration `mapstructure:"watch-debounce"`
+	WatchPoll         bool          `mapstructure:"watch-poll"`
+	WatchPollInterval time.Duration `mapstructure:"watch-poll-interval"`
+	WatchMaxRetries   int           `mapstructure:"watch-max-retries"`
+	TLSCertFile       string        `mapstructure:"tls-cert-file"`
+	TLSKeyFile        string        `mapstructure:"tls-key-file"`
+	TLSCACertFile     string        `mapstructure:"tls-ca-cert-file"`
+	TLSCAKeyFile      string        `mapstructure:"tls-ca-key-file"`
+	Debug             bool          `mapstructure:"debug"`
+}
+
+// TLS returns where the certificates of the apps that don't configure
+// their own come from
+func (c Config) TLS() candy.TLS {
+	return candy.TLS{
+		CertFile:   c.TLSCertFile,
+		KeyFile:    c.TLSKeyFile,
+		CACertFile: c.TLSCACertFile,
+		CAKeyFile:  c.TLSCAKeyFile,
+	}
+}
+
+// HTTPS returns how the apps that don't configure their own enforce HTTPS
+func (c Config) HTTPS() candy.HTTPS {
+	return candy.HTTPS{
+		HTTP:       c.HttpMode,
+		HSTSMaxAge: c.HstsMaxAge,
+	}
 }
 
 func (c Config) Validate() error {
@@ -40,6 +89,12 @@ func (c Config) Validate() error {
 		return fmt.Errorf("--https-addr is required")
 	}
 
+	if len(c.HttpsProtocols) > 0 {
+		if err := caddy.ValidateProtocols(c.HttpsProtocols); err != nil {
+			return fmt.Errorf("invalid --https-protocols: %w", err)
+		}
+	}
+
 	if c.AdminAddr == "" {
 		return fmt.Errorf("--admin-addr is required")
 	}
@@ -48,47 +103,301 @@ func (c Config) Validate() error {
 		return fmt.Errorf("--dns-addr is required")
 	}
 
+	if err := c.TLS().Validate(); err != nil {
+		return fmt.Errorf("invalid --tls-* settings: %w", err)
+	}
+
+	if err := c.HTTPS().Validate(); err != nil {
+		return fmt.Errorf("invalid --http-mode or --hsts-max-age: %w", err)
+	}
+
 	return nil
 }
 
 func New(cfg Config) *Server {
-	return &Server{cfg: cfg}
+	return &Server{
+		cfg:       cfg,
+		requested: cfg,
+		ready:     runnable.NewReadySignal(),
+	}
 }
 
 type Server struct {
-	cfg Config
+	cfg   Config
+	ready *runnable.ReadySignal
+
+	mutex sync.Mutex
+	// requested is the config last passed to New or Reconfigure, so that a
+	// setting waiting for a restart is only warned about when it changes
+	requested  Config
+	supervisor *runnable.Supervisor
+	caddySvr   candy.ProxyServer
+	dnsSvr     candy.DNSServer
+	tcpProxy   candy.TCPProxy
+}
+
+// Ready is closed once the proxy and the watcher are ready, and the DNS
+// server and the other enabled services are ready or have failed
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready.Ready()
+}
+
+// Running reports whether the critical services are running
+func (s *Server) Running() bool {
+	s.mutex.Lock()
+	supervisor := s.supervisor
+	s.mutex.Unlock()
+
+	return supervisor != nil && supervisor.Running()
+}
+
+// Reconfigure applies the changes of cfg to the running server. Domains and
+// HTTP/HTTPS listener addresses are applied live, other changed settings
+// are logged as requiring a restart. mDNS names are under .local whatever
+// the domain, so the mDNS server is left as is.
+func (s *Server) Reconfigure(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	logger := candy.Log().Named("server")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.caddySvr == nil || s.dnsSvr == nil || s.tcpProxy == nil {
+		return fmt.Errorf("server is not running")
+	}
+
+	domainChanged := !reflect.DeepEqual(s.cfg.Domain, cfg.Domain)
+	if domainChanged || s.cfg.HttpAddr != cfg.HttpAddr || s.cfg.HttpsAddr != cfg.HttpsAddr {
+		if err := s.caddySvr.Reconfigure(cfg.Domain, cfg.HttpAddr, cfg.HttpsAddr); err != nil {
+			return fmt.Errorf("error reconfiguring Caddy server: %w", err)
+		}
+
+		if domainChanged {
+			s.dnsSvr.SetTLDs(cfg.Domain)
+
+			s.tcpProxy.SetTLDs(cfg.Domain)
+			if err := s.tcpProxy.Reload(); err != nil {
+				logger.Error("error reloading TCP proxy", zap.Error(err))
+			}
+		}
+
+		s.cfg.Domain = cfg.Domain
+		s.cfg.HttpAddr = cfg.HttpAddr
+		s.cfg.HttpsAddr = cfg.HttpsAddr
+
+		logger.Info("applied config changes", zap.Strings("domain", cfg.Domain), zap.String("http-addr", cfg.HttpAddr), zap.String("https-addr", cfg.HttpsAddr))
+	}
+
+	if settings := restartSettings(s.requested, cfg); len(settings) > 0 {
+		logger.Warn("restart required to apply config changes", zap.Strings("settings", settings))
+	}
+	s.requested = cfg
+
+	return nil
+}
+
+// restartSettings returns the names of the settings changed from requested
+// to cfg that are only applied by a restart
+func restartSettings(requested, cfg Config) []string {
+	// Applied live by Reconfigure
+	requested.Domain = cfg.Domain
+	requested.HttpAddr = cfg.HttpAddr
+	requested.HttpsAddr = cfg.HttpsAddr
+
+	return changedSettings(requested, cfg)
+}
+
+// changedSettings returns the names of the settings that differ
+func changedSettings(a, b Config) []string {
+	var (
+		settings []string
+		va       = reflect.ValueOf(a)
+		vb       = reflect.ValueOf(b)
+	)
+
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			settings = append(settings, va.Type().Field(i).Tag.Get("mapstructure"))
+		}
+	}
+
+	return settings
 }
 
 func (s *Server) Run(ctx context.Context) error {
 	logger := candy.Log().Named("server")
 
+	cleanup, err := prepareStateDir(s.cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	storageDir := s.cfg.CaddyStorageDir()
+	status.Register("state", stateStatus(s.cfg, storageDir))
+	defer status.Unregister("state")
+
+	var mdnsHostname string
+	if s.cfg.MDNS && s.cfg.MDNSSuffix {
+		if mdnsHostname, err = candy.MDNSHostname(); err != nil {
+			return err
+		}
+	}
+
+	// Lets the DNS server trust the client addresses of the DNS-over-HTTPS
+	// requests that Caddy proxies
+	dohToken, err := randomToken()
+	if err != nil {
+		return err
+	}
+
 	caddySvr := caddy.New(caddy.Config{
-		HTTPAddr:  s.cfg.HttpAddr,
-		HTTPSAddr: s.cfg.HttpsAddr,
-		AdminAddr: s.cfg.AdminAddr,
-		TLDs:      s.cfg.Domain,
-		HostRoot:  s.cfg.HostRoot,
-		Logger:    logger.Named("caddy"),
-		Debug:     s.cfg.Debug,
+		HTTPAddr:       s.cfg.HttpAddr,
+		HTTPSAddr:      s.cfg.HttpsAddr,
+		HTTPSProtocols: s.cfg.HttpsProtocols,
+		AdminAddr:      s.cfg.AdminAddr,
+		TLDs:           s.cfg.Domain,
+		HostRoot:       s.cfg.HostRoot,
+		StorageDir:     storageDir,
+		DoHAddr:        s.cfg.DnsDoHAddr,
+		DoHToken:       dohToken,
+		TLS:            s.cfg.TLS(),
+		HTTPS:          s.cfg.HTTPS(),
+		MDNS:           s.cfg.MDNS,
+		MDNSHostname:   mdnsHostname,
+		Logger:         logger.Named("caddy"),
+		Debug:          s.cfg.Debug,
+	})
+
+	// Caddy can't be restarted in-process and the proxy is useless without it
+	services := []runnable.Service{
+		{Name: "caddy", Runable: caddySvr, Restart: runnable.RestartNever, Critical: true},
+	}
+
+	var localIPs *dns.LocalIPTracker
+	if s.cfg.DnsLocalIp || s.cfg.MDNS {
+		localIPs = dns.NewLocalIPTracker(dns.LocalIPConfig{
+			Interface: s.cfg.DnsLocalIf,
+			Logger:    logger.Named("localip"),
+		})
+		status.Register("local_ip", localIPs.Status)
+		defer status.Unregister("local_ip")
+
+		services = append(services, runnable.Service{Name: "local_ip", Runable: localIPs, Restart: runnable.RestartAlways})
+	}
+
+	dnsSvr := dns.New(dns.Config{
+		Addr:           s.cfg.DnsAddr,
+		TLDs:           s.cfg.Domain,
+		LocalIP:        s.cfg.DnsLocalIp,
+		LocalIPTracker: localIPs,
+		PTR:            s.cfg.DnsPTR,
+		QueryLog:       s.cfg.DnsLog,
+		DoHAddr:        s.cfg.DnsDoHAddr,
+		DoHToken:       dohToken,
+		DoTAddr:        s.cfg.DnsDoTAddr,
+		Upstreams:      s.cfg.DnsUpstream,
+		GetCertificate: caddy.GetCertificate,
+		Logger:         logger.Named("dns"),
 	})
 
-	dns := dns.New(dns.Config{
-		Addr:    s.cfg.DnsAddr,
-		TLDs:    s.cfg.Domain,
-		LocalIP: s.cfg.DnsLocalIp,
-		Logger:  logger.Named("dns"),
+	tcpProxy := tcp.New(tcp.Config{
+		SNIAddr:  s.cfg.TcpSNIAddr,
+		PortIP:   s.cfg.TcpIp,
+		TLDs:     s.cfg.Domain,
+		HostRoot: s.cfg.HostRoot,
+		Logger:   logger.Named("tcp"),
 	})
 
+	s.mutex.Lock()
+	s.caddySvr, s.dnsSvr, s.tcpProxy = caddySvr, dnsSvr, tcpProxy
+	s.mutex.Unlock()
+
+	services = append(services,
+		runnable.Service{Name: "dns", Runable: dnsSvr, Restart: runnable.RestartOnFailure},
+		runnable.Service{Name: "tcp", Runable: tcpProxy, Restart: runnable.RestartOnFailure},
+	)
+
+	var mdns candy.MDNSServer
+	if s.cfg.MDNS {
+		mdns = dns.NewMDNS(dns.MDNSConfig{
+			HostRoot:       s.cfg.HostRoot,
+			HostSuffix:     s.cfg.MDNSSuffix,
+			LocalIPTracker: localIPs,
+			Logger:         logger.Named("mdns"),
+		})
+		services = append(services, runnable.Service{Name: "mdns", Runable: mdns, Restart: runnable.RestartOnFailure})
+	}
+
 	watchLogger := logger.Named("watch")
 	watcher := watch.New(watch.Config{
-		HostRoot: s.cfg.HostRoot,
-		HandleFunc: func() {
+		HostRoot:     s.cfg.HostRoot,
+		Debounce:     s.cfg.WatchDebounce,
+		Poll:         s.cfg.WatchPoll,
+		PollInterval: s.cfg.WatchPollInterval,
+		// The host root is created at startup, keep it that way
+		Recreate:   true,
+		MaxRetries: s.cfg.WatchMaxRetries,
+		HandleFunc: func(events []fsnotify.Event) {
+			var changes []string
+			for _, evt := range events {
+				changes = append(changes, evt.String())
+			}
+			watchLogger.Info("reloading apps", zap.Strings("changes", changes))
+
 			if err := caddySvr.Reload(); err != nil {
 				watchLogger.Error("error reloading Caddy server", zap.Error(err))
 			}
+
+			if err := tcpProxy.Reload(); err != nil {
+				watchLogger.Error("error reloading TCP proxy", zap.Error(err))
+			}
+
+			if mdns != nil {
+				if err := mdns.Reload(); err != nil {
+					watchLogger.Error("error reloading mDNS server", zap.Error(err))
+				}
+			}
 		},
 		Logger: watchLogger,
 	})
+	// The watcher retries on its own and only gives up according to --watch-max-retries
+	services = append(services, runnable.Service{Name: "watch", Runable: watcher, Restart: runnable.RestartNever, Critical: true})
+
+	supervisor := runnable.NewSupervisor(runnable.SupervisorConfig{
+		Services: services,
+		Logger:   logger.Named("supervisor"),
+	})
+	status.Register("services", supervisor.Status)
+	defer status.Unregister("services")
+
+	s.mutex.Lock()
+	s.supervisor = supervisor
+	s.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-supervisor.Ready():
+			logger.Info("server is ready")
+			s.ready.Signal()
+		case <-ctx.Done():
+		}
+	}()
+
+	return supervisor.Run(ctx)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating token: %w", err)
+	}
 
-	return runnable.RunWithContext(ctx, []runnable.Runable{caddySvr, dns, watcher})
+	return hex.EncodeToString(b), nil
 }
@@ -1,11 +1,24 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -14,17 +27,31 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
 	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/ca"
+	"github.com/owenthereal/candy/caddy"
+	"github.com/owenthereal/candy/runnable"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func Test_Server(t *testing.T) {
+	// A local CA in Caddy's default storage would be used instead of the state dir
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
 	var (
 		hostRoot  = t.TempDir()
+		stateDir  = t.TempDir()
 		httpAddr  = randomAddr(t)
 		httpsAddr = randomAddr(t)
 		adminAddr = randomAddr(t)
 		dnsAddr   = randomAddr(t)
+		dohAddr   = randomAddr(t)
+		dotAddr   = randomAddr(t)
 		tlds      = []string{"go-test"}
 	)
 
@@ -33,13 +60,18 @@ func Test_Server(t *testing.T) {
 	}
 
 	svr := New(Config{
-		HostRoot:  hostRoot,
-		Domain:    tlds,
-		HttpAddr:  httpAddr,
-		HttpsAddr: httpsAddr,
-		AdminAddr: adminAddr,
-		DnsAddr:   dnsAddr,
-		Debug:     true,
+		HostRoot:       hostRoot,
+		StateDir:       stateDir,
+		Domain:         tlds,
+		HttpAddr:       httpAddr,
+		HttpsAddr:      httpsAddr,
+		HttpsProtocols: []string{caddy.ProtocolHTTP1, caddy.ProtocolHTTP3},
+		AdminAddr:      adminAddr,
+		DnsAddr:        dnsAddr,
+		DnsPTR:         true,
+		DnsDoHAddr:     dohAddr,
+		DnsDoTAddr:     dotAddr,
+		Debug:          true,
 	})
 	errch := make(chan error)
 
@@ -55,6 +87,14 @@ func Test_Server(t *testing.T) {
 		errch <- err
 	}()
 
+	select {
+	case <-svr.Ready():
+	case err := <-errch:
+		t.Fatalf("server shut down: %s", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("error wait time out")
+	}
+
 	http := &http.Client{
 		Timeout: 2 * time.Second,
 	}
@@ -117,7 +157,7 @@ func Test_Server(t *testing.T) {
 
 			gotSubjects := strings.TrimSpace(string(b))
 
-			if diff := cmp.Diff(`["app.go-test"]`, gotSubjects); diff != "" {
+			if diff := cmp.Diff(`["app.go-test","candy.go-test"]`, gotSubjects); diff != "" {
 				return fmt.Errorf("Unexpected tls subjects (-want +got): %s", diff)
 			}
 
@@ -144,6 +184,178 @@ func Test_Server(t *testing.T) {
 		}
 	})
 
+	t.Run("reverse dns", func(t *testing.T) {
+		// The loopback address is shared with everything else on the host
+		m := new(dns.Msg)
+		m.SetQuestion("1.0.0.127.in-addr.arpa.", dns.TypePTR)
+
+		r, _, err := new(dns.Client).Exchange(m, dnsAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Rcode != dns.RcodeNameError || len(r.Answer) != 0 {
+			t.Fatalf("Unexpected reply: %s", r)
+		}
+	})
+
+	t.Run("dns over tls", func(t *testing.T) {
+		roots := rootCAs(t, adminAddr)
+
+		m := new(dns.Msg)
+		m.SetQuestion("app.go-test.", dns.TypeA)
+
+		c := &dns.Client{
+			Net: "tcp-tls",
+			TLSConfig: &tls.Config{
+				ServerName: "candy.go-test",
+				RootCAs:    roots,
+			},
+		}
+		r, _, err := c.Exchange(m, dotAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.Answer) != 1 {
+			t.Fatalf("Unexpected answers: %v", r.Answer)
+		}
+		if a, ok := r.Answer[0].(*dns.A); !ok || a.A.String() != "127.0.0.1" {
+			t.Fatalf("Unexpected answer: %v", r.Answer[0])
+		}
+	})
+
+	t.Run("dns over https", func(t *testing.T) {
+		roots := rootCAs(t, adminAddr)
+
+		m := new(dns.Msg)
+		m.SetQuestion("app.go-test.", dns.TypeA)
+
+		waitUntil(t, 5*time.Second, 10, func() error {
+			r, err := queryDoH(httpsAddr, "candy.go-test", roots, m)
+			if err != nil {
+				return err
+			}
+
+			if len(r.Answer) != 1 {
+				return fmt.Errorf("Unexpected answers: %v", r.Answer)
+			}
+			if a, ok := r.Answer[0].(*dns.A); !ok || a.A.String() != "127.0.0.1" {
+				return fmt.Errorf("Unexpected answer: %v", r.Answer[0])
+			}
+
+			return nil
+		})
+	})
+
+	t.Run("status", func(t *testing.T) {
+		st, err := caddy.Status(context.Background(), adminAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var dnsStatus struct {
+			Names map[string]uint64 `json:"names"`
+		}
+		if err := json.Unmarshal(st["dns"], &dnsStatus); err != nil {
+			t.Fatal(err)
+		}
+
+		if dnsStatus.Names["app.go-test."] == 0 {
+			t.Fatalf("Unexpected dns status: %s", st["dns"])
+		}
+
+		var stateStatus struct {
+			Dir string `json:"dir"`
+			PID int    `json:"pid"`
+		}
+		if err := json.Unmarshal(st["state"], &stateStatus); err != nil {
+			t.Fatal(err)
+		}
+
+		if stateStatus.Dir != stateDir || stateStatus.PID != os.Getpid() {
+			t.Fatalf("Unexpected state status: %s", st["state"])
+		}
+	})
+
+	t.Run("https protocols", func(t *testing.T) {
+		st, err := caddy.Status(context.Background(), adminAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var proxyStatus struct {
+			HTTPSProtocols []string `json:"https_protocols"`
+			HTTPSListeners []string `json:"https_listeners"`
+		}
+		if err := json.Unmarshal(st["proxy"], &proxyStatus); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"tcp/" + httpsAddr, "udp/" + httpsAddr}, proxyStatus.HTTPSListeners); diff != "" {
+			t.Fatalf("Unexpected https listeners (-want +got): %s", diff)
+		}
+
+		roots := rootCAs(t, adminAddr)
+
+		// HTTP/2 is disabled
+		conn, err := tls.Dial("tcp", httpsAddr, &tls.Config{
+			ServerName: "app.go-test",
+			RootCAs:    roots,
+			NextProtos: []string{"h2", "http/1.1"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if got := conn.ConnectionState().NegotiatedProtocol; got != "http/1.1" {
+			t.Fatalf("Unexpected negotiated protocol: %s", got)
+		}
+
+		proto, err := http3Proto(httpsAddr, roots, "https://app.go-test/config/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if proto != "HTTP/3.0" {
+			t.Fatalf("Unexpected protocol: %s", proto)
+		}
+	})
+
+	t.Run("state dir", func(t *testing.T) {
+		b, err := os.ReadFile(filepath.Join(stateDir, "candy.pid"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := strconv.Itoa(os.Getpid()), strings.TrimSpace(string(b)); want != got {
+			t.Fatalf("Unexpected pid: want=%s got=%s", want, got)
+		}
+
+		// Caddy's local CA is stored in the state dir
+		if _, err := os.Stat(filepath.Join(stateDir, "caddy", "pki", "authorities", "local", "root.crt")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/metrics", adminAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(b), `candy_dns_queries_total{name="app.go-test.",qtype="A",rcode="NOERROR"}`) {
+			t.Fatalf("Missing dns metrics: %s", b)
+		}
+	})
+
 	t.Run("add new domain", func(t *testing.T) {
 		if err := os.WriteFile(filepath.Join(hostRoot, "app2"), []byte(adminAddr), 0o644); err != nil {
 			t.Fatal(err)
@@ -178,7 +390,7 @@ func Test_Server(t *testing.T) {
 
 			gotSubjects := strings.TrimSpace(string(b))
 
-			if diff := cmp.Diff(`["app.go-test","app2.go-test"]`, gotSubjects); diff != "" {
+			if diff := cmp.Diff(`["app.go-test","app2.go-test","candy.go-test"]`, gotSubjects); diff != "" {
 				return fmt.Errorf("Unexpected tls subjects (-want +got): %s", diff)
 			}
 
@@ -186,140 +398,947 @@ func Test_Server(t *testing.T) {
 		})
 	})
 
-	t.Run("remove host root", func(t *testing.T) {
-		if err := os.RemoveAll(hostRoot); err != nil {
+	t.Run("invalid app", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(hostRoot, "bad"), []byte("localhost:abc"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// An app file that can't be parsed
+		if err := os.WriteFile(filepath.Join(hostRoot, "broken"), []byte(`{"addr": `), 0o644); err != nil {
 			t.Fatal(err)
 		}
 
-		select {
-		case <-time.After(5 * time.Second):
-			t.Fatal("error wait time out")
-		case err := <-errch:
-			if want, got := fmt.Sprintf("host root %s was removed", hostRoot), err.Error(); want != got {
-				t.Fatalf("unexpected error: want=%s got=%s", want, got)
+		waitUntil(t, 500*time.Millisecond, 20, func() error {
+			st, err := caddy.Status(context.Background(), adminAddr)
+			if err != nil {
+				return err
+			}
+
+			var proxyStatus struct {
+				ErroredApps []struct {
+					Host string `json:"host"`
+					File string `json:"file"`
+				} `json:"errored_apps"`
+			}
+			if err := json.Unmarshal(st["proxy"], &proxyStatus); err != nil {
+				return err
+			}
+
+			if len(proxyStatus.ErroredApps) != 2 || proxyStatus.ErroredApps[0].File != "broken" || proxyStatus.ErroredApps[1].Host != "bad.go-test" {
+				return fmt.Errorf("Unexpected proxy status: %s", st["proxy"])
 			}
+
+			return nil
+		})
+
+		if err := os.Remove(filepath.Join(hostRoot, "broken")); err != nil {
+			t.Fatal(err)
 		}
-	})
-}
 
-func Test_Server_Shutdown(t *testing.T) {
-	var (
-		hostRoot = t.TempDir()
-		tlds     = []string{"go-test"}
-	)
+		// The valid apps are still served
+		resp, err := http.Get(fmt.Sprintf("http://%s/config/apps/tls/automation/policies/0/subjects", adminAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
 
-	cases := []struct {
-		Name       string
-		Config     Config
-		WantErrMsg string
-	}{
-		{
-			Name: "invalid dns addr",
-			Config: Config{
-				HostRoot:  hostRoot,
-				Domain:    tlds,
-				HttpAddr:  randomAddr(t),
-				HttpsAddr: randomAddr(t),
-				AdminAddr: randomAddr(t),
-				DnsAddr:   "invalid-addr",
-			},
-			WantErrMsg: "address invalid-addr: missing port in address",
-		},
-		{
-			Name: "invalid http addr",
-			Config: Config{
-				HostRoot:  hostRoot,
-				Domain:    tlds,
-				HttpAddr:  "",
-				HttpsAddr: randomAddr(t),
-				AdminAddr: randomAddr(t),
-				DnsAddr:   randomAddr(t),
-			},
-			WantErrMsg: "loading new config: loading http app module: http: invalid configuration: invalid listener address '': missing port in address",
-		},
-		{
-			Name: "invalid admin addr",
-			Config: Config{
-				HostRoot:  hostRoot,
-				Domain:    tlds,
-				HttpAddr:  randomAddr(t),
-				HttpsAddr: randomAddr(t),
-				AdminAddr: "invalid-addr",
-				DnsAddr:   randomAddr(t),
-			},
-			WantErrMsg: "loading new config: starting caddy administration endpoint: listen tcp: lookup invalid-addr",
-		},
-		{
-			Name: "invalid host root",
-			Config: Config{
-				HostRoot:  "/invalid-host-root",
-				Domain:    tlds,
-				HttpAddr:  randomAddr(t),
-				HttpsAddr: randomAddr(t),
-				AdminAddr: randomAddr(t),
-				DnsAddr:   randomAddr(t),
-			},
-			WantErrMsg: "no such file or directory",
-		},
-	}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	for _, c := range cases {
-		c := c
-		t.Run(c.Name, func(t *testing.T) {
-			errch := make(chan error)
-			srv := New(c.Config)
+		if diff := cmp.Diff(`["app.go-test","app2.go-test","candy.go-test"]`, strings.TrimSpace(string(b))); diff != "" {
+			t.Fatalf("Unexpected tls subjects (-want +got): %s", diff)
+		}
+	})
 
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
+	t.Run("own certificates", func(t *testing.T) {
+		var (
+			certDir         = t.TempDir()
+			caCert, caKey   = writeCA(t, certDir)
+			ownCert, ownKey = writeCertificate(t, certDir, "own.go-test", caCert, caKey)
+		)
 
-			go func() {
-				err := srv.Run(ctx)
+		apps := map[string]string{
+			"corp":  fmt.Sprintf(`{"addr": %q, "tls": {"ca_cert_file": %q, "ca_key_file": %q}}`, adminAddr, filepath.Join(certDir, "ca.crt"), filepath.Join(certDir, "ca.key")),
+			"own":   fmt.Sprintf(`{"addr": %q, "tls": {"cert_file": %q, "key_file": %q}}`, adminAddr, ownCert, ownKey),
+			"wrong": fmt.Sprintf(`{"addr": %q, "tls": {"cert_file": %q, "key_file": %q}}`, adminAddr, ownCert, ownKey),
+		}
+		for name, data := range apps {
+			if err := os.WriteFile(filepath.Join(hostRoot, name), []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(caCert)
+
+		c := httpsClient(httpsAddr, roots)
+		for _, host := range []string{"corp.go-test", "own.go-test"} {
+			waitUntil(t, 500*time.Millisecond, 20, func() error {
+				resp, err := c.Get(fmt.Sprintf("https://%s/", host))
 				if err != nil {
-					candy.Log().Error("error running server", zap.Error(err))
+					return err
 				}
 
-				errch <- err
-			}()
+				return resp.Body.Close()
+			})
+		}
 
-			select {
-			case <-time.After(10 * time.Second):
-				t.Fatal("error wait time out")
-			case err := <-errch:
-				if want, got := c.WantErrMsg, err.Error(); !strings.Contains(got, want) {
-					t.Fatalf("got error does not contain want string: want=%s, got=%s", want, got)
-				}
+		// The certificate of own.go-test isn't valid for wrong.go-test
+		waitUntil(t, 500*time.Millisecond, 20, func() error {
+			st, err := caddy.Status(context.Background(), adminAddr)
+			if err != nil {
+				return err
 			}
-		})
-	}
-}
 
-func randomAddr(t *testing.T) string {
-	return "127.0.0.1:" + randomPort(t)
-}
+			var proxyStatus struct {
+				ErroredApps []struct {
+					Host string `json:"host"`
+				} `json:"errored_apps"`
+			}
+			if err := json.Unmarshal(st["proxy"], &proxyStatus); err != nil {
+				return err
+			}
 
-func randomPort(t *testing.T) string {
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer listener.Close()
+			var errored []string
+			for _, app := range proxyStatus.ErroredApps {
+				errored = append(errored, app.Host)
+			}
+			if diff := cmp.Diff([]string{"bad.go-test", "wrong.go-test"}, errored); diff != "" {
+				return fmt.Errorf("Unexpected errored apps (-want +got): %s", diff)
+			}
 
-	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
-}
+			return nil
+		})
+	})
 
-func waitUntil(tb testing.TB, waitInterval time.Duration, times int, fn func() error) {
-	tb.Helper()
+	t.Run("client auth", func(t *testing.T) {
+		upstream := headerEchoServer(t, "X-Client-Verified", "X-Client-Cert-Subject")
 
-	var err error
-	for tries := 0; tries < times; tries++ {
-		err = fn()
-		if err == nil {
-			return
+		if err := os.WriteFile(filepath.Join(hostRoot, "mtls"), []byte(fmt.Sprintf(`{"addr": %q, "client_auth": {"mode": "require"}}`, upstream)), 0o644); err != nil {
+			t.Fatal(err)
 		}
 
-		tb.Logf("waiting, got error: %s", err)
-		time.Sleep(waitInterval)
-	}
+		authority, err := ca.Load(filepath.Join(stateDir, "caddy"))
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	tb.Fatal(err)
+		cert, key, err := authority.IssueClient("alice", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roots := rootCAs(t, adminAddr)
+
+		// Without a client certificate
+		c := httpsClient(httpsAddr, roots)
+		waitUntil(t, 500*time.Millisecond, 20, func() error {
+			resp, err := c.Get("https://mtls.go-test/")
+			if err == nil {
+				resp.Body.Close()
+				return fmt.Errorf("Unexpected response without client certificate: %d", resp.StatusCode)
+			}
+
+			// The handshake fails once the app is loaded
+			if !strings.Contains(err.Error(), "certificate required") {
+				return err
+			}
+
+			return nil
+		})
+
+		c = httpsClient(httpsAddr, roots, tls.Certificate{
+			Certificate: [][]byte{cert.Raw},
+			PrivateKey:  key,
+		})
+		waitUntil(t, 500*time.Millisecond, 20, func() error {
+			resp, err := c.Get("https://mtls.go-test/")
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+
+			if diff := cmp.Diff("SUCCESS CN=alice", string(b)); diff != "" {
+				return fmt.Errorf("Unexpected client headers (-want +got): %s", diff)
+			}
+
+			return nil
+		})
+
+		// Plain HTTP can't authenticate clients
+		resp, err := http.Do(hostRequest(t, httpAddr, "mtls.go-test", "X-Client-Verified", "SUCCESS"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 403 {
+			t.Fatalf("Unexpected status over HTTP: %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("upstream protocols", func(t *testing.T) {
+		apps := map[string]string{
+			"grpc": fmt.Sprintf(`{"addr": %q, "protocol": "h2c"}`, upstreamServer(t, candy.UpstreamH2C)),
+			"h2":   fmt.Sprintf(`{"addr": %q, "protocol": "h2"}`, upstreamServer(t, candy.UpstreamH2)),
+		}
+		for name, data := range apps {
+			if err := os.WriteFile(filepath.Join(hostRoot, name), []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c := httpsClient(httpsAddr, rootCAs(t, adminAddr))
+		for _, host := range []string{"grpc.go-test", "h2.go-test"} {
+			waitUntil(t, 500*time.Millisecond, 20, func() error {
+				resp, err := c.Get(fmt.Sprintf("https://%s/", host))
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					return err
+				}
+
+				if got := string(b); got != "HTTP/2.0" {
+					return fmt.Errorf("Unexpected upstream protocol of %s: %s", host, got)
+				}
+
+				return nil
+			})
+		}
+
+		// Streams are flushed as they come
+		resp, err := c.Get("https://grpc.go-test/stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "data: 1\n" {
+			t.Fatalf("Unexpected event: %q", line)
+		}
+
+		// Plain text HTTP/2 clients, e.g. gRPC without TLS
+		proto, err := h2cProto(httpAddr, "http://grpc.go-test/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proto != "HTTP/2.0" {
+			t.Fatalf("Unexpected protocol: %s", proto)
+		}
+	})
+
+	t.Run("https policy", func(t *testing.T) {
+		upstream := headerEchoServer(t)
+
+		apps := map[string]string{
+			"secure": fmt.Sprintf(`{"addr": %q, "https": {"http": "redirect", "hsts_max_age": 3600}}`, upstream),
+			"plain":  fmt.Sprintf(`{"addr": %q, "https": {"http": "serve"}}`, upstream),
+		}
+		for name, data := range apps {
+			if err := os.WriteFile(filepath.Join(hostRoot, name), []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, httpPort, _ := net.SplitHostPort(httpAddr)
+		_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+
+		waitUntil(t, 500*time.Millisecond, 20, func() error {
+			resp, err := roundTrip(hostRequest(t, httpAddr, "secure.go-test:"+httpPort, "Accept", "*/*"))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if want := "https://secure.go-test:" + httpsPort + "/"; resp.StatusCode != 308 || resp.Header.Get("Location") != want {
+				return fmt.Errorf("Unexpected redirect: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+			}
+
+			return nil
+		})
+
+		c := httpsClient(httpsAddr, rootCAs(t, adminAddr))
+		waitUntil(t, 500*time.Millisecond, 20, func() error {
+			resp, err := c.Get("https://secure.go-test/")
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if diff := cmp.Diff("max-age=3600", resp.Header.Get("Strict-Transport-Security")); diff != "" {
+				return fmt.Errorf("Unexpected HSTS header (-want +got): %s", diff)
+			}
+
+			return nil
+		})
+
+		// Apps that need plain HTTP are left alone
+		resp, err := roundTrip(hostRequest(t, httpAddr, "plain.go-test", "Accept", "*/*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("Unexpected status over HTTP: %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("remove host root", func(t *testing.T) {
+		if err := os.RemoveAll(hostRoot); err != nil {
+			t.Fatal(err)
+		}
+
+		waitUntil(t, 500*time.Millisecond, 20, func() error {
+			_, err := os.Stat(hostRoot)
+			return err
+		})
+
+		if err := os.WriteFile(filepath.Join(hostRoot, "app3"), []byte(adminAddr), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		waitUntil(t, 500*time.Millisecond, 20, func() error {
+			select {
+			case err := <-errch:
+				t.Fatalf("server shut down: %s", err)
+			default:
+			}
+
+			resp, err := http.Get(fmt.Sprintf("http://%s/config/apps/tls/automation/policies/0/subjects", adminAddr))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+
+			gotSubjects := strings.TrimSpace(string(b))
+
+			if diff := cmp.Diff(`["app3.go-test","candy.go-test"]`, gotSubjects); diff != "" {
+				return fmt.Errorf("Unexpected tls subjects (-want +got): %s", diff)
+			}
+
+			return nil
+		})
+	})
+
+	t.Run("reconfigure domain", func(t *testing.T) {
+		cfg := svr.cfg
+		cfg.Domain = []string{"go-test2"}
+		if err := svr.Reconfigure(cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return net.Dial("udp", dnsAddr)
+			},
+		}
+
+		ips, err := r.LookupHost(context.Background(), "app3.go-test2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"127.0.0.1"}, ips); diff != "" {
+			t.Fatalf("Unexpected IPs (-want +got): %s", diff)
+		}
+
+		if _, err := r.LookupHost(context.Background(), "app3.go-test"); err == nil {
+			t.Fatal("expected old domain not to resolve")
+		}
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/config/apps/tls/automation/policies/0/subjects", adminAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(`["app3.go-test2","candy.go-test2"]`, strings.TrimSpace(string(b))); diff != "" {
+			t.Fatalf("Unexpected tls subjects (-want +got): %s", diff)
+		}
+	})
+
+	t.Run("rotate ca", func(t *testing.T) {
+		storageDir := filepath.Join(stateDir, "caddy")
+
+		old, err := ca.Load(storageDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ca.Remove(storageDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := caddy.ReloadCA(context.Background(), adminAddr); err != nil {
+			t.Fatal(err)
+		}
+
+		rotated, err := ca.Load(storageDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ca.Fingerprint(old.Root) == ca.Fingerprint(rotated.Root) {
+			t.Fatal("expected a new root certificate")
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(rotated.Root)
+
+		m := new(dns.Msg)
+		m.SetQuestion("app3.go-test2.", dns.TypeA)
+
+		// The app certificates are issued by the new CA
+		waitUntil(t, 1*time.Second, 10, func() error {
+			_, err := queryDoH(httpsAddr, "candy.go-test2", roots, m)
+			return err
+		})
+	})
+}
+
+func Test_Server_Shutdown(t *testing.T) {
+	var (
+		hostRoot = t.TempDir()
+		tlds     = []string{"go-test"}
+		// The watcher creates a missing host root, which can't be done
+		// under a file
+		file = filepath.Join(t.TempDir(), "file")
+	)
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Name       string
+		Config     Config
+		WantErrMsg string
+	}{
+		{
+			Name: "invalid http addr",
+			Config: Config{
+				HostRoot:  hostRoot,
+				Domain:    tlds,
+				HttpAddr:  "",
+				HttpsAddr: randomAddr(t),
+				AdminAddr: randomAddr(t),
+				DnsAddr:   randomAddr(t),
+			},
+			WantErrMsg: "invalid Caddy config: loading http app module: http: invalid configuration: invalid listener address '': missing port in address",
+		},
+		{
+			Name: "invalid admin addr",
+			Config: Config{
+				HostRoot:  hostRoot,
+				Domain:    tlds,
+				HttpAddr:  randomAddr(t),
+				HttpsAddr: randomAddr(t),
+				AdminAddr: "invalid-addr",
+				DnsAddr:   randomAddr(t),
+			},
+			WantErrMsg: "loading new config: starting caddy administration endpoint: listen tcp: lookup invalid-addr",
+		},
+		{
+			Name: "invalid host root",
+			Config: Config{
+				HostRoot:  filepath.Join(file, "hosts"),
+				Domain:    tlds,
+				HttpAddr:  randomAddr(t),
+				HttpsAddr: randomAddr(t),
+				AdminAddr: randomAddr(t),
+				DnsAddr:   randomAddr(t),
+			},
+			WantErrMsg: "not a directory",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			errch := make(chan error)
+			srv := New(c.Config)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go func() {
+				err := srv.Run(ctx)
+				if err != nil {
+					candy.Log().Error("error running server", zap.Error(err))
+				}
+
+				errch <- err
+			}()
+
+			select {
+			case <-time.After(10 * time.Second):
+				t.Fatal("error wait time out")
+			case err := <-errch:
+				if want, got := c.WantErrMsg, err.Error(); !strings.Contains(got, want) {
+					t.Fatalf("got error does not contain want string: want=%s, got=%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_Server_NonCriticalFailure(t *testing.T) {
+	adminAddr := randomAddr(t)
+
+	srv := New(Config{
+		HostRoot:  t.TempDir(),
+		Domain:    []string{"go-test"},
+		HttpAddr:  randomAddr(t),
+		HttpsAddr: randomAddr(t),
+		AdminAddr: adminAddr,
+		DnsAddr:   "invalid-addr",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errch := make(chan error)
+	go func() {
+		errch <- srv.Run(ctx)
+	}()
+
+	// The DNS server is restarted while the proxy keeps running
+	waitUntil(t, 500*time.Millisecond, 20, func() error {
+		select {
+		case err := <-errch:
+			t.Fatalf("server shut down: %s", err)
+		default:
+		}
+
+		st, err := caddy.Status(context.Background(), adminAddr)
+		if err != nil {
+			return err
+		}
+
+		var services map[string]runnable.ServiceStatus
+		if err := json.Unmarshal(st["services"], &services); err != nil {
+			return err
+		}
+
+		if st := services["dns"]; st.Restarts == 0 || !strings.Contains(st.Error, "address invalid-addr: missing port in address") {
+			return fmt.Errorf("unexpected dns status: %+v", st)
+		}
+
+		if st := services["caddy"]; st.State != runnable.StateRunning {
+			return fmt.Errorf("unexpected caddy status: %+v", st)
+		}
+
+		return nil
+	})
+
+	cancel()
+	if err := <-errch; !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// writeCA writes a CA certificate and key to dir as ca.crt and ca.key
+func writeCA(t *testing.T, dir string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Corp CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	return writeKeyPair(t, dir, "ca", tmpl, nil, nil)
+}
+
+// writeCertificate writes a certificate for host issued by ca to dir and
+// returns the paths of the certificate and key
+func writeCertificate(t *testing.T, dir, host string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (string, string) {
+	t.Helper()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	writeKeyPair(t, dir, host, tmpl, ca, caKey)
+
+	return filepath.Join(dir, host+".crt"), filepath.Join(dir, host+".key")
+}
+
+func writeKeyPair(t *testing.T, dir, name string, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*pem.Block{
+		name + ".crt": {Type: "CERTIFICATE", Bytes: der},
+		name + ".key": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	}
+	for file, block := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return cert, key
+}
+
+func rootCAs(t *testing.T, adminAddr string) *x509.CertPool {
+	t.Helper()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/pki/ca/local", adminAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var ca struct {
+		RootCert string `json:"root_certificate"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ca); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(ca.RootCert)) {
+		t.Fatal("error parsing root certificate")
+	}
+
+	return pool
+}
+
+func queryDoH(httpsAddr, host string, roots *x509.CertPool, m *dns.Msg) (*dns.Msg, error) {
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	c := httpsClient(httpsAddr, roots)
+
+	resp, err := c.Get(fmt.Sprintf("https://%s/dns-query?dns=%s", host, base64.RawURLEncoding.EncodeToString(b)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// headerEchoServer responds with the values of the request headers
+// separated by spaces and returns its address
+func headerEchoServer(t *testing.T, headers ...string) string {
+	t.Helper()
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var values []string
+		for _, h := range headers {
+			values = append(values, r.Header.Get(h))
+		}
+
+		fmt.Fprint(w, strings.Join(values, " "))
+	}))
+	t.Cleanup(svr.Close)
+
+	return svr.Listener.Addr().String()
+}
+
+// hostRequest builds a plain HTTP request to host served at addr with the
+// given header
+func hostRequest(t *testing.T, addr, host, header, value string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/", addr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	req.Header.Set(header, value)
+
+	return req
+}
+
+// upstreamServer starts an upstream speaking protocol that responds with
+// the protocol of the request, or streams events at /stream, and returns its
+// address
+func upstreamServer(t *testing.T, protocol string) string {
+	t.Helper()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stream" {
+			fmt.Fprint(w, r.Proto)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	})
+
+	var svr *httptest.Server
+	switch protocol {
+	case candy.UpstreamH2C:
+		svr = httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	case candy.UpstreamH2:
+		svr = httptest.NewUnstartedServer(handler)
+		svr.EnableHTTP2 = true
+		svr.StartTLS()
+	default:
+		svr = httptest.NewServer(handler)
+	}
+	t.Cleanup(svr.Close)
+
+	return svr.Listener.Addr().String()
+}
+
+// h2cProto gets url over plain text HTTP/2 from the server listening on
+// httpAddr and returns the protocol of the response
+func h2cProto(httpAddr, url string) (string, error) {
+	c := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial("tcp", httpAddr)
+			},
+		},
+	}
+
+	resp, err := c.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return resp.Proto, nil
+}
+
+// http3Proto gets url over HTTP/3 from the server listening on httpsAddr and
+// returns the protocol of the response
+func http3Proto(httpsAddr string, roots *x509.CertPool, url string) (string, error) {
+	rt := &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{
+			RootCAs: roots,
+		},
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return quic.DialAddrEarly(ctx, httpsAddr, tlsCfg, cfg)
+		},
+	}
+	defer rt.Close()
+
+	c := &http.Client{
+		Timeout:   2 * time.Second,
+		Transport: rt,
+	}
+
+	resp, err := c.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return resp.Proto, nil
+}
+
+// roundTrip sends req without following redirects
+func roundTrip(req *http.Request) (*http.Response, error) {
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// httpsClient connects to httpsAddr for any host and trusts roots
+func httpsClient(httpsAddr string, roots *x509.CertPool, certs ...tls.Certificate) *http.Client {
+	return &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("tcp", httpsAddr)
+			},
+			TLSClientConfig: &tls.Config{
+				RootCAs:      roots,
+				Certificates: certs,
+			},
+		},
+	}
+}
+
+func randomAddr(t *testing.T) string {
+	return "127.0.0.1:" + randomPort(t)
+}
+
+func randomPort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func waitUntil(tb testing.TB, waitInterval time.Duration, times int, fn func() error) {
+	tb.Helper()
+
+	var err error
+	for tries := 0; tries < times; tries++ {
+		err = fn()
+		if err == nil {
+			return
+		}
+
+		tb.Logf("waiting, got error: %s", err)
+		time.Sleep(waitInterval)
+	}
+
+	tb.Fatal(err)
+}
+
+func Test_restartSettings(t *testing.T) {
+	requested := Config{
+		Domain:   []string{"test"},
+		HttpAddr: "127.0.0.1:80",
+		DnsAddr:  "127.0.0.1:25353",
+	}
+
+	cases := []struct {
+		Name string
+		Cfg  func(cfg Config) Config
+		Want []string
+	}{
+		{
+			Name: "unchanged",
+			Cfg:  func(cfg Config) Config { return cfg },
+		},
+		{
+			Name: "live settings",
+			Cfg: func(cfg Config) Config {
+				cfg.Domain = []string{"test2"}
+				cfg.HttpAddr = "127.0.0.1:8080"
+				return cfg
+			},
+		},
+		{
+			Name: "restart settings",
+			Cfg: func(cfg Config) Config {
+				cfg.Domain = []string{"test2"}
+				cfg.DnsAddr = "127.0.0.1:35353"
+				cfg.MDNS = true
+				return cfg
+			},
+			Want: []string{"dns-addr", "mdns"},
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			if diff := cmp.Diff(cc.Want, restartSettings(requested, cc.Cfg(requested))); diff != "" {
+				t.Fatalf("mismatch settings (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func Test_Config_CaddyStorageDir(t *testing.T) {
+	dataDir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", dataDir)
+	defaultDir := filepath.Join(dataDir, "caddy")
+
+	stateDir := t.TempDir()
+	cfg := Config{StateDir: stateDir}
+
+	if want, got := defaultDir, (Config{}).CaddyStorageDir(); want != got {
+		t.Fatalf("mismatch storage without state dir: want=%s got=%s", want, got)
+	}
+
+	// A new CA goes to the state dir
+	if want, got := filepath.Join(stateDir, "caddy"), cfg.CaddyStorageDir(); want != got {
+		t.Fatalf("mismatch storage without CA: want=%s got=%s", want, got)
+	}
+
+	// A CA users trust already is kept
+	if err := os.MkdirAll(filepath.Dir(ca.RootFile(defaultDir)), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ca.RootFile(defaultDir), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := defaultDir, cfg.CaddyStorageDir(); want != got {
+		t.Fatalf("mismatch storage with default CA: want=%s got=%s", want, got)
+	}
+
+	// Unless the state dir holds the storage already
+	if err := os.Mkdir(filepath.Join(stateDir, "caddy"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := filepath.Join(stateDir, "caddy"), cfg.CaddyStorageDir(); want != got {
+		t.Fatalf("mismatch storage with state dir storage: want=%s got=%s", want, got)
+	}
 }
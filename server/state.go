@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/owenthereal/candy/ca"
+)
+
+// Layout of the state directory
+const (
+	stateCaddyDir = "caddy"
+	statePIDFile  = "candy.pid"
+	stateRunDir   = "run"
+)
+
+// CaddyStorageDir returns where Caddy stores its CA and certificates. It's
+// <state-dir>/caddy, unless that doesn't exist yet and Caddy's default
+// storage already holds a local CA, which users have trusted. Without a
+// state directory it's Caddy's default storage.
+func (c Config) CaddyStorageDir() string {
+	if c.StateDir == "" {
+		return ca.DefaultStorageDir()
+	}
+
+	dir := filepath.Join(c.StateDir, stateCaddyDir)
+	if _, err := os.Stat(dir); err == nil {
+		return dir
+	}
+	if _, err := os.Stat(ca.RootFile(ca.DefaultStorageDir())); err == nil {
+		return ca.DefaultStorageDir()
+	}
+
+	return dir
+}
+
+// SocketPath returns the path of a unix socket of the running Candy
+func (c Config) SocketPath(name string) string {
+	dir := os.TempDir()
+	if c.StateDir != "" {
+		dir = filepath.Join(c.StateDir, stateRunDir)
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("candy-%s.sock", name))
+}
+
+// PIDFile returns the path of the pid file of the running Candy
+func (c Config) PIDFile() string {
+	if c.StateDir == "" {
+		return ""
+	}
+
+	return filepath.Join(c.StateDir, statePIDFile)
+}
+
+// prepareStateDir creates the state directory and writes the pid file.
+// The returned func removes the pid file.
+func prepareStateDir(cfg Config) (func(), error) {
+	if cfg.StateDir == "" {
+		return func() {}, nil
+	}
+
+	// The state dir holds the CA keys
+	for _, dir := range []string{cfg.StateDir, filepath.Join(cfg.StateDir, stateRunDir)} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("error creating state directory %s: %w", dir, err)
+		}
+	}
+
+	pidFile := cfg.PIDFile()
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return nil, fmt.Errorf("error writing pid file %s: %w", pidFile, err)
+	}
+
+	return func() {
+		_ = os.Remove(pidFile)
+	}, nil
+}
+
+func stateStatus(cfg Config, storageDir string) func() interface{} {
+	return func() interface{} {
+		return struct {
+			Dir          string `json:"dir,omitempty"`
+			CaddyStorage string `json:"caddy_storage"`
+			PIDFile      string `json:"pid_file,omitempty"`
+			PID          int    `json:"pid"`
+		}{
+			Dir:          cfg.StateDir,
+			CaddyStorage: storageDir,
+			PIDFile:      cfg.PIDFile(),
+			PID:          os.Getpid(),
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Package status collects the state of the running Candy components.
+// It is served by the Caddy admin API and printed by `candy status`.
+package status
+
+import (
+	"sync"
+)
+
+// Provider returns the current status of a component.
+// The result must be JSON-marshallable.
+type Provider func() interface{}
+
+var (
+	providers      = make(map[string]Provider)
+	providersMutex sync.RWMutex
+)
+
+// Register registers the status provider of a component under name
+func Register(name string, p Provider) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+
+	providers[name] = p
+}
+
+// Unregister removes the status provider of a component
+func Unregister(name string) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+
+	delete(providers, name)
+}
+
+// Report returns the status of all registered components keyed by name
+func Report() map[string]interface{} {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+
+	result := make(map[string]interface{}, len(providers))
+	for name, p := range providers {
+		result[name] = p()
+	}
+
+	return result
+}
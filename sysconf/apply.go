@@ -0,0 +1,62 @@
+package sysconf
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Apply changes the system as planned. Failing commands that are meant to
+// remove what may not exist are logged without output.
+func Apply(actions []Action, logger *zap.Logger) error {
+	for _, a := range actions {
+		switch {
+		case a.Remove:
+			err := os.Remove(a.Path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			logger.Info("removed file", zap.String("file", a.Path))
+		case a.Path != "":
+			if b, err := os.ReadFile(a.Path); err == nil && string(b) == a.Content {
+				logger.Info("file unchanged", zap.String("file", a.Path))
+				continue
+			}
+
+			logger.Info("writing file", zap.String("file", a.Path))
+			if err := os.MkdirAll(filepath.Dir(a.Path), 0o755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(a.Path, []byte(a.Content), 0o644); err != nil {
+				return err
+			}
+		default:
+			cmd := exec.Command(a.Cmd[0], a.Cmd[1:]...)
+			cmd.Stdin = strings.NewReader(a.Stdin)
+
+			if a.IgnoreError {
+				if err := cmd.Run(); err != nil {
+					logger.Debug("ignoring failed command", zap.String("cmd", a.String()), zap.Error(err))
+				}
+				continue
+			}
+
+			logger.Info("running command", zap.String("cmd", a.String()))
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("error running %s: %w", a, err)
+			}
+		}
+	}
+
+	return nil
+}
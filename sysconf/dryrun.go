@@ -0,0 +1,101 @@
+package sysconf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// DryRun prints what Apply would change: a diff of every file that is
+// written or removed, and every command with its input
+func DryRun(w io.Writer, actions []Action) error {
+	for _, a := range actions {
+		switch {
+		case a.Path != "":
+			b, err := os.ReadFile(a.Path)
+			exists := err == nil
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			switch {
+			case a.Remove && !exists:
+				continue
+			case !a.Remove && exists && string(b) == a.Content:
+				fmt.Fprintf(w, "= %s (unchanged)\n", a.Path)
+				continue
+			}
+
+			from, to := a.Path, a.Path
+			if !exists {
+				from = "/dev/null"
+			}
+			if a.Remove {
+				to = "/dev/null"
+			}
+
+			fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to)
+			for _, line := range diffLines(splitLines(string(b)), splitLines(a.Content)) {
+				fmt.Fprintln(w, line)
+			}
+		default:
+			fmt.Fprintf(w, "$ %s\n", a)
+			for _, line := range splitLines(a.Stdin) {
+				fmt.Fprintf(w, "  %s\n", line)
+			}
+		}
+	}
+
+	return nil
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the lines of a and b prefixed with " " if they are in
+// both, "-" if only in a and "+" if only in b, by their longest common
+// subsequence. The files are small enough for the quadratic table.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var (
+		lines []string
+		i, j  int
+	)
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,68 @@
+package sysconf
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_DryRun(t *testing.T) {
+	dir := t.TempDir()
+
+	var (
+		changed   = filepath.Join(dir, "changed")
+		unchanged = filepath.Join(dir, "unchanged")
+		removed   = filepath.Join(dir, "removed")
+		created   = filepath.Join(dir, "created")
+		missing   = filepath.Join(dir, "missing")
+	)
+	for file, content := range map[string]string{
+		changed:   "domain test\nnameserver 127.0.0.1\nport 25353\n",
+		unchanged: "same\n",
+		removed:   "old\n",
+	} {
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	err := DryRun(&out, []Action{
+		{Path: changed, Content: "domain test\nnameserver 127.0.0.1\nport 25354\ntimeout 5\n"},
+		{Path: unchanged, Content: "same\n"},
+		{Path: removed, Remove: true},
+		{Path: missing, Remove: true},
+		{Path: created, Content: "new"},
+		{Cmd: []string{"nft", "-f", "-"}, Stdin: "table ip candy {}\n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "--- " + changed + "\n" +
+		"+++ " + changed + "\n" +
+		" domain test\n" +
+		" nameserver 127.0.0.1\n" +
+		"-port 25353\n" +
+		"+port 25354\n" +
+		"+timeout 5\n" +
+		"= " + unchanged + " (unchanged)\n" +
+		"--- " + removed + "\n" +
+		"+++ /dev/null\n" +
+		"-old\n" +
+		"--- /dev/null\n" +
+		"+++ " + created + "\n" +
+		"+new\n" +
+		"$ nft -f -\n" +
+		"  table ip candy {}\n"
+	if diff := cmp.Diff(want, out.String()); diff != "" {
+		t.Fatalf("Unexpected output (-want +got): %s", diff)
+	}
+
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected file %s: %v", created, err)
+	}
+}
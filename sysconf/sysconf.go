@@ -0,0 +1,31 @@
+// Package sysconf describes the changes that candy setup makes to the
+// system, so that they are planned by pure functions and applied in one
+// place.
+package sysconf
+
+import "strings"
+
+// Action is a change to the system: a file that is written or removed, or
+// a command that is run
+type Action struct {
+	Path    string
+	Content string
+	Remove  bool
+
+	Cmd   []string
+	Stdin string
+	// IgnoreError ignores the failure of Cmd, e.g. when removing what
+	// was never set up
+	IgnoreError bool
+}
+
+func (a Action) String() string {
+	switch {
+	case a.Remove:
+		return "remove " + a.Path
+	case a.Path != "":
+		return "write " + a.Path
+	default:
+		return strings.Join(a.Cmd, " ")
+	}
+}
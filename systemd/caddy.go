@@ -0,0 +1,36 @@
+package systemd
+
+import (
+	"context"
+	"net"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	// Caddy listens on systemd/<name> with the passed stream socket, and
+	// serves HTTP/3 on the datagram socket of the same name
+	caddy.RegisterNetwork(Network, caddyListener)
+	caddy.RegisterNetwork(Network+"gram", caddyListener)
+	caddyhttp.RegisterNetworkHTTP3(Network, Network+"gram")
+}
+
+func caddyListener(ctx context.Context, network, addr string, cfg net.ListenConfig) (any, error) {
+	s, err := Activated()
+	if err != nil {
+		return nil, err
+	}
+
+	// Caddy joins the name with a port
+	name, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		name = addr
+	}
+
+	if network == Network+"gram" {
+		return s.PacketConn(name)
+	}
+
+	return s.Listener(name)
+}
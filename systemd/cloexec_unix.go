@@ -0,0 +1,10 @@
+//go:build unix
+
+package systemd
+
+import "syscall"
+
+// closeOnExec keeps a passed socket from leaking into child processes
+func closeOnExec(fd uintptr) {
+	syscall.CloseOnExec(int(fd))
+}
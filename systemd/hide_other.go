@@ -0,0 +1,8 @@
+//go:build !unix
+
+package systemd
+
+// HideNotifySocket does nothing without systemd
+func HideNotifySocket() error {
+	return nil
+}
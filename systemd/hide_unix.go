@@ -0,0 +1,41 @@
+//go:build unix
+
+package systemd
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// HideNotifySocket re-executes the process without NOTIFY_SOCKET, keeping
+// it for Notify in CANDY_NOTIFY_SOCKET. The embedded Caddy reads
+// NOTIFY_SOCKET when it's initialized, before main runs, and would report
+// READY=1 as soon as its config is loaded instead of once all services are
+// ready. The process keeps its PID and the sockets passed by systemd.
+func HideNotifySocket() error {
+	socket, ok := os.LookupEnv("NOTIFY_SOCKET")
+	if !ok {
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding executable: %w", err)
+	}
+
+	if err := os.Setenv(notifySocketEnv, socket); err != nil {
+		return err
+	}
+	if err := os.Unsetenv("NOTIFY_SOCKET"); err != nil {
+		return err
+	}
+
+	err = syscall.Exec(exe, os.Args, os.Environ())
+
+	// Still running, so Caddy keeps notifying
+	_ = os.Setenv("NOTIFY_SOCKET", socket)
+	_ = os.Unsetenv(notifySocketEnv)
+
+	return fmt.Errorf("error re-executing %s: %w", exe, err)
+}
@@ -0,0 +1,150 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Network is the network of the sockets passed by socket activation. Their
+// addresses are systemd/<name>, where name is the FileDescriptorName= of
+// the socket unit, e.g. systemd/https.
+const Network = "systemd"
+
+// listenFdsStart is the first file descriptor passed by socket activation
+const listenFdsStart = 3
+
+var (
+	socketsOnce sync.Once
+	sockets     Sockets
+	socketsErr  error
+)
+
+// Sockets are the sockets passed by socket activation by their names. A
+// name can have a stream and a datagram socket, e.g. DNS over TCP and UDP.
+type Sockets map[string][]*os.File
+
+// Activated returns the sockets passed to this process by socket
+// activation with LISTEN_FDS and LISTEN_FDNAMES, or nil if there are none.
+// They are read once and the environment is cleared so that child
+// processes don't take them as their own.
+func Activated() (Sockets, error) {
+	socketsOnce.Do(func() {
+		sockets, socketsErr = parseSockets(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+
+	return sockets, socketsErr
+}
+
+func parseSockets(pid, fds, names string) (Sockets, error) {
+	if fds == "" {
+		return nil, nil
+	}
+
+	// Like sd_listen_fds, the sockets are only taken if they're passed to
+	// this very process, not inherited from a parent that was passed them
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+	if len(fdNames) != 0 && len(fdNames) != n {
+		return nil, fmt.Errorf("LISTEN_FDNAMES %q doesn't name %d sockets", names, n)
+	}
+
+	s := make(Sockets)
+	for i := 0; i < n; i++ {
+		name := "unknown" // systemd's default name
+		if len(fdNames) != 0 {
+			name = fdNames[i]
+		}
+
+		fd := uintptr(listenFdsStart + i)
+		closeOnExec(fd)
+		s[name] = append(s[name], os.NewFile(fd, Network+"/"+name))
+	}
+
+	return s, nil
+}
+
+// Listener returns a listener on the stream socket of name. Each listener
+// has its own file descriptor, so closing it leaves the socket open for
+// the next one, e.g. after a config reload.
+func (s Sockets) Listener(name string) (net.Listener, error) {
+	for _, f := range s[name] {
+		if ln, err := net.FileListener(f); err == nil {
+			return ln, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no stream socket named %q passed by socket activation", name)
+}
+
+// PacketConn returns a packet connection on the datagram socket of name,
+// with its own file descriptor like Listener
+func (s Sockets) PacketConn(name string) (net.PacketConn, error) {
+	for _, f := range s[name] {
+		if pc, err := net.FilePacketConn(f); err == nil {
+			return pc, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no datagram socket named %q passed by socket activation", name)
+}
+
+// HasPacketConn reports whether name has a datagram socket
+func (s Sockets) HasPacketConn(name string) bool {
+	pc, err := s.PacketConn(name)
+	if err != nil {
+		return false
+	}
+	_ = pc.Close()
+
+	return true
+}
+
+// Listen listens on addr, or on the socket passed by socket activation if
+// addr is systemd/<name>
+func Listen(network, addr string) (net.Listener, error) {
+	name, ok := strings.CutPrefix(addr, Network+"/")
+	if !ok {
+		return net.Listen(network, addr)
+	}
+
+	s, err := Activated()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Listener(name)
+}
+
+// ListenPacket is Listen for datagram sockets
+func ListenPacket(network, addr string) (net.PacketConn, error) {
+	name, ok := strings.CutPrefix(addr, Network+"/")
+	if !ok {
+		return net.ListenPacket(network, addr)
+	}
+
+	s, err := Activated()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.PacketConn(name)
+}
@@ -0,0 +1,237 @@
+package systemd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_parseSockets(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	cases := []struct {
+		Name  string
+		PID   string
+		FDs   string
+		Names string
+		Err   string
+	}{
+		{
+			Name: "not activated",
+		},
+		{
+			Name: "another process",
+			PID:  "1",
+			FDs:  "1",
+		},
+		{
+			Name: "no pid",
+			FDs:  "1",
+		},
+		{
+			Name: "invalid fds",
+			PID:  pid,
+			FDs:  "-1",
+			Err:  `invalid LISTEN_FDS "-1"`,
+		},
+		{
+			Name:  "unnamed fds",
+			PID:   pid,
+			FDs:   "2",
+			Names: "http",
+			Err:   `LISTEN_FDNAMES "http" doesn't name 2 sockets`,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := parseSockets(cc.PID, cc.FDs, cc.Names)
+			if cc.Err != "" {
+				if err == nil || err.Error() != cc.Err {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s != nil {
+				t.Fatalf("Unexpected sockets: %v", s)
+			}
+		})
+	}
+}
+
+// Test_Activated passes sockets to a child process like systemd does and
+// checks that it serves on them
+func Test_Activated(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sockets can't be passed to child processes on Windows")
+	}
+
+	if os.Getenv("CANDY_TEST_ACTIVATED") == "1" {
+		serveActivated()
+		return
+	}
+
+	httpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsPc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsLn, err := net.Listen("tcp", dnsPc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []*os.File
+	for _, s := range []interface{ File() (*os.File, error) }{
+		httpLn.(*net.TCPListener),
+		dnsPc.(*net.UDPConn),
+		dnsLn.(*net.TCPListener),
+	} {
+		f, err := s.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^Test_Activated$")
+	cmd.Env = append(os.Environ(),
+		"CANDY_TEST_ACTIVATED=1",
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES=http:dns:dns",
+	)
+	cmd.ExtraFiles = files
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the child serves on the sockets from now on
+	for _, f := range files {
+		f.Close()
+	}
+	httpLn.Close()
+	dnsLn.Close()
+	defer dnsPc.Close()
+
+	for _, addr := range []string{httpLn.Addr().String(), dnsLn.Addr().String()} {
+		if got := exchange(t, "tcp", addr); got != "tcp "+addr {
+			t.Fatalf("Unexpected response: %s", got)
+		}
+	}
+	if got := exchange(t, "udp", dnsPc.LocalAddr().String()); got != "udp" {
+		t.Fatalf("Unexpected response: %s", got)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("child process failed: %s\n%s", err, out.String())
+	}
+}
+
+func exchange(t *testing.T, network, addr string) string {
+	t.Helper()
+
+	conn, err := net.DialTimeout(network, addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	return string(b[:n])
+}
+
+// serveActivated answers one connection on each passed socket with its
+// network. It runs in the child process of Test_Activated.
+func serveActivated() {
+	fail := func(err error) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if os.Getenv("LISTEN_FDS") == "" {
+		fail(fmt.Errorf("LISTEN_FDS must be set"))
+	}
+	// systemd sets the pid of the child it starts, which the parent test
+	// can't know beforehand
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	s, err := Activated()
+	if err != nil {
+		fail(err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		fail(fmt.Errorf("LISTEN_FDS must be cleared"))
+	}
+
+	// Closing a listener, e.g. on a config reload, leaves the socket open
+	ln, err := s.Listener("http")
+	if err != nil {
+		fail(err)
+	}
+	ln.Close()
+
+	for _, name := range []string{"http", "dns"} {
+		ln, err := Listen("tcp", Network+"/"+name)
+		if err != nil {
+			fail(err)
+		}
+
+		conn, err := ln.Accept()
+		if err != nil {
+			fail(err)
+		}
+		_, _ = conn.Write([]byte("tcp " + ln.Addr().String()))
+		conn.Close()
+		ln.Close()
+	}
+
+	pc, err := ListenPacket("udp", Network+"/dns")
+	if err != nil {
+		fail(err)
+	}
+	defer pc.Close()
+
+	b := make([]byte, 64)
+	_, addr, err := pc.ReadFrom(b)
+	if err != nil {
+		fail(err)
+	}
+	if _, err := pc.WriteTo([]byte("udp"), addr); err != nil {
+		fail(err)
+	}
+
+	if _, err := s.Listener("https"); err == nil {
+		fail(fmt.Errorf("Unexpected listener for https"))
+	}
+}
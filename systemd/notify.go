@@ -0,0 +1,151 @@
+// Package systemd implements the sd_notify protocol so that Candy can run
+// as a Type=notify systemd unit with a watchdog, and socket activation so
+// that it can serve on sockets owned by systemd.
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	StateReady    = "READY=1"
+	StateStopping = "STOPPING=1"
+	StateWatchdog = "WATCHDOG=1"
+
+	// notifySocketEnv keeps NOTIFY_SOCKET for Candy once HideNotifySocket
+	// removed it from the environment
+	notifySocketEnv = "CANDY_NOTIFY_SOCKET"
+)
+
+// Notify sends state to the service manager. It returns false without an
+// error if the process isn't run by systemd with NOTIFY_SOCKET set.
+func Notify(state string) (bool, error) {
+	socket := notifySocket()
+	if socket == "" {
+		return false, nil
+	}
+
+	// Abstract sockets start with @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("error connecting to notify socket %s: %w", socket, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("error notifying %s: %w", state, err)
+	}
+
+	return true, nil
+}
+
+func notifySocket() string {
+	if socket := os.Getenv(notifySocketEnv); socket != "" {
+		return socket
+	}
+
+	return os.Getenv("NOTIFY_SOCKET")
+}
+
+// WatchdogInterval returns the watchdog timeout configured with WatchdogSec=,
+// or zero if the watchdog isn't enabled for this process
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil // meant for another process
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+type NotifierConfig struct {
+	// Ready is closed once the service is ready
+	Ready <-chan struct{}
+	// Running reports whether the service is healthy. The watchdog is only
+	// pinged while it is, so that systemd restarts a service that's stuck.
+	Running func() bool
+	Logger  *zap.Logger
+}
+
+// NewNotifier returns a runnable that notifies systemd once the service is
+// ready and pings the watchdog while it runs
+func NewNotifier(cfg NotifierConfig) *Notifier {
+	return &Notifier{cfg: cfg}
+}
+
+type Notifier struct {
+	cfg NotifierConfig
+}
+
+func (n *Notifier) Run(ctx context.Context) error {
+	if notifySocket() == "" {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	n.cfg.Logger.Info("starting systemd notifier")
+	defer n.cfg.Logger.Info("shutting down systemd notifier")
+
+	interval, err := WatchdogInterval()
+	if err != nil {
+		n.cfg.Logger.Error("error reading watchdog interval", zap.Error(err))
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.cfg.Ready:
+	}
+
+	n.notify(StateReady)
+	defer n.notify(StateStopping)
+
+	if interval <= 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	// Ping twice per timeout as recommended by sd_watchdog_enabled(3)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if n.cfg.Running != nil && !n.cfg.Running() {
+				n.cfg.Logger.Warn("not pinging the watchdog, critical services aren't running")
+				continue
+			}
+
+			n.notify(StateWatchdog)
+		}
+	}
+}
+
+func (n *Notifier) notify(state string) {
+	if _, err := Notify(state); err != nil {
+		n.cfg.Logger.Error("error notifying systemd", zap.String("state", state), zap.Error(err))
+	}
+}
@@ -0,0 +1,129 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+)
+
+func Test_Notifier(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+	t.Setenv("WATCHDOG_USEC", "100000")
+
+	ready := make(chan struct{})
+	n := NewNotifier(NotifierConfig{
+		Ready:  ready,
+		Logger: zap.NewNop(),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- n.Run(ctx)
+	}()
+
+	close(ready)
+
+	var states []string
+	for len(states) < 3 {
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 64)
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, string(b[:n]))
+	}
+
+	if diff := cmp.Diff([]string{StateReady, StateWatchdog, StateWatchdog}, states); diff != "" {
+		t.Fatalf("mismatch states (-want +got): %s", diff)
+	}
+
+	cancel()
+	<-errch
+
+	b := make([]byte, 64)
+	n2, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := StateStopping, string(b[:n2]); want != got {
+		t.Fatalf("mismatch state: want=%s got=%s", want, got)
+	}
+}
+
+func Test_Notifier_NotRunning(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Where HideNotifySocket keeps the socket
+	t.Setenv(notifySocketEnv, socket)
+	t.Setenv("NOTIFY_SOCKET", "")
+	t.Setenv("WATCHDOG_USEC", "100000")
+
+	var running atomic.Bool
+	ready := make(chan struct{})
+	close(ready)
+	n := NewNotifier(NotifierConfig{
+		Ready:   ready,
+		Running: running.Load,
+		Logger:  zap.NewNop(),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- n.Run(ctx)
+	}()
+
+	read := func(timeout time.Duration) (string, error) {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 64)
+		n, err := conn.Read(b)
+		return string(b[:n]), err
+	}
+
+	if state, err := read(5 * time.Second); err != nil || state != StateReady {
+		t.Fatalf("mismatch state: want=%s got=%s err=%v", StateReady, state, err)
+	}
+
+	// No pings while the critical services aren't running
+	if state, err := read(300 * time.Millisecond); err == nil {
+		t.Fatalf("unexpected state: %s", state)
+	}
+
+	running.Store(true)
+	if state, err := read(5 * time.Second); err != nil || state != StateWatchdog {
+		t.Fatalf("mismatch state: want=%s got=%s err=%v", StateWatchdog, state, err)
+	}
+
+	cancel()
+	<-errch
+}
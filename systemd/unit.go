@@ -0,0 +1,191 @@
+package systemd
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// ServiceName is the name of the user unit that runs Candy
+const ServiceName = "candy.service"
+
+// UnitConfig is what the user units of Candy are rendered from
+type UnitConfig struct {
+	// Binary is the candy executable
+	Binary string
+	// Args are the arguments of Binary, e.g. run --config ~/.candyconfig
+	Args []string
+	// Sockets starts Candy by socket activation on HTTPAddr, HTTPSAddr and
+	// DNSAddr, and on a datagram socket for HTTP/3 if HTTP3
+	Sockets   bool
+	HTTPAddr  string
+	HTTPSAddr string
+	HTTP3     bool
+	DNSAddr   string
+}
+
+// socket is a socket unit named candy-<Name>.socket
+type socket struct {
+	Name     string
+	Stream   string
+	Datagram string
+}
+
+func (s socket) unitName() string {
+	return "candy-" + s.Name + ".socket"
+}
+
+func (cfg UnitConfig) sockets() []socket {
+	if !cfg.Sockets {
+		return nil
+	}
+
+	https := socket{Name: "https", Stream: cfg.HTTPSAddr}
+	if cfg.HTTP3 {
+		https.Datagram = cfg.HTTPSAddr
+	}
+
+	return []socket{
+		{Name: "http", Stream: cfg.HTTPAddr},
+		https,
+		{Name: "dns", Stream: cfg.DNSAddr, Datagram: cfg.DNSAddr},
+	}
+}
+
+// UnitNames returns the names of the units, the service first
+func UnitNames(cfg UnitConfig) []string {
+	names := []string{ServiceName}
+	for _, s := range cfg.sockets() {
+		names = append(names, s.unitName())
+	}
+
+	return names
+}
+
+// Units renders the unit files by their names
+func Units(cfg UnitConfig) map[string]string {
+	units := map[string]string{
+		ServiceName: serviceUnit(cfg),
+	}
+	for _, s := range cfg.sockets() {
+		units[s.unitName()] = socketUnit(s)
+	}
+
+	return units
+}
+
+func serviceUnit(cfg UnitConfig) string {
+	var b strings.Builder
+
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=Candy, a zero-config reverse proxy server\n")
+	b.WriteString("Documentation=https://github.com/owenthereal/candy\n")
+
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=notify\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", execLine(append([]string{cfg.Binary}, cfg.Args...)))
+	if sockets := cfg.sockets(); len(sockets) > 0 {
+		var names []string
+		for _, s := range sockets {
+			names = append(names, s.unitName())
+		}
+		fmt.Fprintf(&b, "Sockets=%s\n", strings.Join(names, " "))
+	}
+	b.WriteString("Restart=on-failure\n")
+	b.WriteString("WatchdogSec=30s\n")
+
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=default.target\n")
+
+	return b.String()
+}
+
+func socketUnit(s socket) string {
+	var b strings.Builder
+
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=Candy %s socket\n", strings.ToUpper(s.Name))
+
+	b.WriteString("\n[Socket]\n")
+	fmt.Fprintf(&b, "ListenStream=%s\n", s.Stream)
+	if s.Datagram != "" {
+		fmt.Fprintf(&b, "ListenDatagram=%s\n", s.Datagram)
+	}
+	// Candy adopts the sockets by these names
+	fmt.Fprintf(&b, "FileDescriptorName=%s\n", s.Name)
+	fmt.Fprintf(&b, "Service=%s\n", ServiceName)
+
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=sockets.target\n")
+
+	return b.String()
+}
+
+// execLine quotes args for ExecStart=, escaping specifiers and variables
+func execLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		arg = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(arg)
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\") {
+			arg = `"` + arg + `"`
+		}
+		quoted[i] = arg
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// UnitState is the state of a unit as reported by systemctl show
+type UnitState struct {
+	Name          string `json:"name"`
+	LoadState     string `json:"load_state"`
+	ActiveState   string `json:"active_state"`
+	SubState      string `json:"sub_state"`
+	UnitFileState string `json:"unit_file_state"`
+}
+
+// ShowProperties are the properties to pass to systemctl show for
+// ParseUnitStates
+var ShowProperties = []string{"Id", "LoadState", "ActiveState", "SubState", "UnitFileState"}
+
+// ParseUnitStates parses the output of systemctl show --property with
+// ShowProperties, one block of properties per unit in the order of the
+// units passed to it
+func ParseUnitStates(out string) []UnitState {
+	var (
+		states []UnitState
+		state  UnitState
+	)
+
+	flush := func() {
+		if state != (UnitState{}) {
+			states = append(states, state)
+		}
+		state = UnitState{}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			flush()
+			continue
+		}
+
+		switch key {
+		case "Id":
+			state.Name = value
+		case "LoadState":
+			state.LoadState = value
+		case "ActiveState":
+			state.ActiveState = value
+		case "SubState":
+			state.SubState = value
+		case "UnitFileState":
+			state.UnitFileState = value
+		}
+	}
+	flush()
+
+	return states
+}
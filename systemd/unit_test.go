@@ -0,0 +1,123 @@
+package systemd
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata")
+
+func Test_Units(t *testing.T) {
+	cases := []struct {
+		Name string
+		Cfg  UnitConfig
+	}{
+		{
+			Name: "service",
+			Cfg: UnitConfig{
+				Binary: "/home/jane/go/bin/candy",
+				Args:   []string{"run", "--config", "/home/jane/.candyconfig"},
+			},
+		},
+		{
+			Name: "quoted",
+			Cfg: UnitConfig{
+				Binary: "/home/jane/my apps/candy",
+				Args:   []string{"run", "--config", "/home/jane/.candyconfig", "--host-root=/home/jane/50% off", "--domain=test,$HOST"},
+			},
+		},
+		{
+			Name: "sockets",
+			Cfg: UnitConfig{
+				Binary:    "/usr/local/bin/candy",
+				Args:      []string{"run", "--config", "/home/jane/.candyconfig"},
+				Sockets:   true,
+				HTTPAddr:  "127.0.0.1:28080",
+				HTTPSAddr: "127.0.0.1:28443",
+				HTTP3:     true,
+				DNSAddr:   "127.0.0.1:25353",
+			},
+		},
+		{
+			Name: "sockets-without-http3",
+			Cfg: UnitConfig{
+				Binary:    "/usr/local/bin/candy",
+				Args:      []string{"run", "--config", "/home/jane/.candyconfig"},
+				Sockets:   true,
+				HTTPAddr:  "127.0.0.1:28080",
+				HTTPSAddr: "127.0.0.1:28443",
+				DNSAddr:   "127.0.0.1:25353",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			units := Units(cc.Cfg)
+
+			var names []string
+			for _, name := range UnitNames(cc.Cfg) {
+				if _, ok := units[name]; !ok {
+					t.Fatalf("Missing unit %s", name)
+				}
+				names = append(names, name)
+			}
+			if len(names) != len(units) {
+				t.Fatalf("Unexpected units: %v", units)
+			}
+
+			dir := filepath.Join("testdata", "units", cc.Name)
+			for name, content := range units {
+				golden := filepath.Join(dir, name)
+
+				if *update {
+					if err := os.MkdirAll(dir, 0o755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(golden, []byte(content), 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(string(want), content); diff != "" {
+					t.Fatalf("Unexpected %s, rerun with -update if intended (-want +got): %s", name, diff)
+				}
+			}
+		})
+	}
+}
+
+func Test_ParseUnitStates(t *testing.T) {
+	out := `Id=candy.service
+LoadState=loaded
+ActiveState=active
+SubState=running
+UnitFileState=enabled
+
+Id=candy-http.socket
+LoadState=not-found
+ActiveState=inactive
+SubState=dead
+UnitFileState=
+`
+
+	want := []UnitState{
+		{Name: "candy.service", LoadState: "loaded", ActiveState: "active", SubState: "running", UnitFileState: "enabled"},
+		{Name: "candy-http.socket", LoadState: "not-found", ActiveState: "inactive", SubState: "dead"},
+	}
+	if diff := cmp.Diff(want, ParseUnitStates(out)); diff != "" {
+		t.Fatalf("Unexpected states (-want +got): %s", diff)
+	}
+}
@@ -0,0 +1,280 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/runnable"
+	"github.com/owenthereal/candy/status"
+	"go.uber.org/zap"
+	"inet.af/tcpproxy"
+)
+
+type Config struct {
+	// SNIAddr is where TLS connections are routed to the apps by their
+	// server name (disabled if empty)
+	SNIAddr string
+	// PortIP is the IP the dedicated ports of the apps listen on (127.0.0.1 if empty)
+	PortIP   string
+	TLDs     []string
+	HostRoot string
+	Logger   *zap.Logger
+}
+
+func New(cfg Config) candy.TCPProxy {
+	if cfg.PortIP == "" {
+		cfg.PortIP = "127.0.0.1"
+	}
+
+	return &tcpProxy{
+		cfg: cfg,
+		apps: candy.NewAppService(candy.AppServiceConfig{
+			TLDs:     cfg.TLDs,
+			HostRoot: cfg.HostRoot,
+		}),
+		ports: make(map[int]*portProxy),
+		ready: runnable.NewReadySignal(),
+	}
+}
+
+type tcpProxy struct {
+	cfg   Config
+	apps  *candy.AppService
+	ready *runnable.ReadySignal
+
+	mutex   sync.Mutex
+	running bool
+	// sni are the upstreams of the hosts routed by SNI
+	sni map[string]string
+	// ports are the running proxies of the dedicated ports
+	ports   map[int]*portProxy
+	routes  []route
+	errored []appError
+}
+
+// portProxy proxies a dedicated port to an upstream
+type portProxy struct {
+	Addr  string
+	proxy *tcpproxy.Proxy
+}
+
+// appError is an app whose connections can't be proxied
+type appError struct {
+	Host  string `json:"host"`
+	Addr  string `json:"addr"`
+	Error string `json:"error"`
+}
+
+// route is a proxied app
+type route struct {
+	Host   string `json:"host"`
+	Addr   string `json:"addr"`
+	Listen string `json:"listen,omitempty"`
+	SNI    bool   `json:"sni,omitempty"`
+}
+
+// Status reports the routes and the apps that can't be proxied
+func (p *tcpProxy) Status() interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return struct {
+		SNIAddr     string     `json:"sni_addr,omitempty"`
+		Routes      []route    `json:"routes,omitempty"`
+		ErroredApps []appError `json:"errored_apps,omitempty"`
+	}{
+		SNIAddr:     p.cfg.SNIAddr,
+		Routes:      p.routes,
+		ErroredApps: p.errored,
+	}
+}
+
+// Ready is closed once the routes of the apps are set up
+func (p *tcpProxy) Ready() <-chan struct{} {
+	return p.ready.Ready()
+}
+
+func (p *tcpProxy) Run(ctx context.Context) error {
+	p.cfg.Logger.Info("starting TCP proxy", zap.Any("cfg", p.cfg))
+	defer p.cfg.Logger.Info("shutting down TCP proxy")
+
+	status.Register("tcp", p.Status)
+	defer status.Unregister("tcp")
+
+	if p.cfg.SNIAddr != "" {
+		sniProxy := &tcpproxy.Proxy{}
+		sniProxy.AddSNIRouteFunc(p.cfg.SNIAddr, p.sniTarget)
+		if err := sniProxy.Start(); err != nil {
+			return fmt.Errorf("error listening on %s: %w", p.cfg.SNIAddr, err)
+		}
+		defer sniProxy.Close()
+	}
+
+	p.mutex.Lock()
+	p.running = true
+	p.mutex.Unlock()
+
+	defer p.closePorts()
+
+	if err := p.Reload(); err != nil {
+		p.cfg.Logger.Error("error loading TCP routes", zap.Error(err))
+	}
+	p.ready.Signal()
+
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+// SetTLDs changes the top-level domains that the apps are routed under.
+// It takes effect on the next reload.
+func (p *tcpProxy) SetTLDs(tlds []string) {
+	p.apps.SetTLDs(tlds)
+}
+
+// Reload routes the TCP apps in the host root. The dedicated ports whose
+// upstream is unchanged keep their connections.
+func (p *tcpProxy) Reload() error {
+	apps, _, err := p.apps.FindApps()
+	if err != nil {
+		return fmt.Errorf("error loading apps: %w", err)
+	}
+
+	var (
+		sni     = make(map[string]string)
+		ports   = make(map[int]string)
+		errored []appError
+	)
+	for _, app := range apps {
+		if app.TCP.IsZero() {
+			continue
+		}
+
+		// Server names are looked up in lower case
+		if app.TCP.SNI {
+			sni[strings.ToLower(app.Host)] = app.Addr
+		}
+
+		if port := app.TCP.Port; port != 0 {
+			// An app file is served under every TLD with the same port
+			if addr, ok := ports[port]; ok && addr != app.Addr {
+				errored = append(errored, appError{Host: app.Host, Addr: app.Addr, Error: fmt.Sprintf("port %d is taken by another app", port)})
+				continue
+			}
+			ports[port] = app.Addr
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.running {
+		return nil
+	}
+
+	p.sni = sni
+
+	var routes []route
+	for _, app := range apps {
+		if app.TCP.SNI {
+			routes = append(routes, route{Host: app.Host, Addr: app.Addr, SNI: true})
+		}
+	}
+
+	for port, pp := range p.ports {
+		if ports[port] != pp.Addr {
+			p.cfg.Logger.Info("closing TCP port", zap.Int("port", port), zap.String("addr", pp.Addr))
+			_ = pp.proxy.Close()
+			delete(p.ports, port)
+		}
+	}
+
+	for port, addr := range ports {
+		if _, ok := p.ports[port]; ok {
+			continue
+		}
+
+		pp, err := p.listen(port, addr)
+		if err != nil {
+			p.cfg.Logger.Error("error listening on TCP port", zap.Int("port", port), zap.String("addr", addr), zap.Error(err))
+			for _, app := range apps {
+				if app.TCP.Port == port && app.Addr == addr {
+					errored = append(errored, appError{Host: app.Host, Addr: app.Addr, Error: err.Error()})
+				}
+			}
+			continue
+		}
+
+		p.cfg.Logger.Info("listening on TCP port", zap.Int("port", port), zap.String("addr", addr))
+		p.ports[port] = pp
+	}
+
+	for _, app := range apps {
+		if pp, ok := p.ports[app.TCP.Port]; ok && pp.Addr == app.Addr {
+			routes = append(routes, route{Host: app.Host, Addr: app.Addr, Listen: p.portAddr(app.TCP.Port)})
+		}
+	}
+
+	sort.Slice(errored, func(i, j int) bool {
+		return errored[i].Host < errored[j].Host
+	})
+	p.routes = routes
+	p.errored = errored
+
+	return nil
+}
+
+func (p *tcpProxy) listen(port int, addr string) (*portProxy, error) {
+	proxy := &tcpproxy.Proxy{}
+	proxy.AddRoute(p.portAddr(port), p.dialProxy(addr))
+	if err := proxy.Start(); err != nil {
+		return nil, err
+	}
+
+	return &portProxy{Addr: addr, proxy: proxy}, nil
+}
+
+func (p *tcpProxy) closePorts() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.running = false
+	for port, pp := range p.ports {
+		_ = pp.proxy.Close()
+		delete(p.ports, port)
+	}
+}
+
+// sniTarget routes a TLS connection to the upstream of its server name
+func (p *tcpProxy) sniTarget(ctx context.Context, sniName string) (tcpproxy.Target, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	addr, ok := p.sni[strings.ToLower(sniName)]
+	if !ok {
+		p.cfg.Logger.Debug("no TCP app for server name", zap.String("sni", sniName))
+		return nil, false
+	}
+
+	return p.dialProxy(addr), true
+}
+
+func (p *tcpProxy) dialProxy(addr string) *tcpproxy.DialProxy {
+	return &tcpproxy.DialProxy{
+		Addr: addr,
+		OnDialError: func(src net.Conn, err error) {
+			p.cfg.Logger.Error("error dialing TCP app", zap.String("addr", addr), zap.Error(err))
+			_ = src.Close()
+		},
+	}
+}
+
+func (p *tcpProxy) portAddr(port int) string {
+	return net.JoinHostPort(p.cfg.PortIP, strconv.Itoa(port))
+}
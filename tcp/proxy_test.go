@@ -0,0 +1,195 @@
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+)
+
+func Test_Proxy(t *testing.T) {
+	var (
+		hostRoot = t.TempDir()
+		sniAddr  = randomAddr(t)
+		port     = randomPort(t)
+		echoAddr = echoServer(t)
+	)
+
+	tlsSvr := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(tlsSvr.Close)
+
+	apps := map[string]string{
+		"db":   `{"addr": "` + echoAddr + `", "tcp": {"port": ` + strconv.Itoa(port) + `}}`,
+		"db2":  `{"addr": "127.0.0.1:1", "tcp": {"port": ` + strconv.Itoa(port) + `}}`,
+		"web":  `{"addr": "` + tlsSvr.Listener.Addr().String() + `", "tcp": {"sni": true}}`,
+		"Mail": `{"addr": "` + tlsSvr.Listener.Addr().String() + `", "tcp": {"sni": true}}`,
+		"http": `8080`,
+	}
+	for name, data := range apps {
+		if err := os.WriteFile(filepath.Join(hostRoot, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proxy := New(Config{
+		SNIAddr:  sniAddr,
+		TLDs:     []string{"test"},
+		HostRoot: hostRoot,
+		Logger:   zap.NewNop(),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- proxy.Run(ctx)
+	}()
+
+	select {
+	case <-proxy.Ready():
+	case err := <-errch:
+		t.Fatalf("proxy shut down: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("error wait time out")
+	}
+
+	portAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	t.Run("dedicated port", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", portAddr, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff("ping", string(b)); diff != "" {
+			t.Fatalf("Unexpected echo (-want +got): %s", diff)
+		}
+	})
+
+	t.Run("sni", func(t *testing.T) {
+		// Server names match regardless of the case of the app file
+		for _, name := range []string{"web.test", "WEB.test", "mail.test"} {
+			conn, err := tls.Dial("tcp", sniAddr, &tls.Config{
+				ServerName:         name,
+				InsecureSkipVerify: true,
+			})
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+
+			// The TLS connection is passed through to the app
+			if !conn.ConnectionState().PeerCertificates[0].Equal(tlsSvr.Certificate()) {
+				t.Fatalf("%s: Unexpected certificate", name)
+			}
+			conn.Close()
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		st := proxy.(*tcpProxy).Status()
+
+		want := struct {
+			SNIAddr     string     `json:"sni_addr,omitempty"`
+			Routes      []route    `json:"routes,omitempty"`
+			ErroredApps []appError `json:"errored_apps,omitempty"`
+		}{
+			SNIAddr: sniAddr,
+			Routes: []route{
+				{Host: "Mail.test", Addr: tlsSvr.Listener.Addr().String(), SNI: true},
+				{Host: "web.test", Addr: tlsSvr.Listener.Addr().String(), SNI: true},
+				{Host: "db.test", Addr: echoAddr, Listen: portAddr},
+			},
+			ErroredApps: []appError{
+				{Host: "db2.test", Addr: "127.0.0.1:1", Error: "port " + strconv.Itoa(port) + " is taken by another app"},
+			},
+		}
+		if diff := cmp.Diff(want, st); diff != "" {
+			t.Fatalf("Unexpected status (-want +got): %s", diff)
+		}
+	})
+
+	t.Run("remove app", func(t *testing.T) {
+		for _, name := range []string{"db", "db2"} {
+			if err := os.Remove(filepath.Join(hostRoot, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := proxy.Reload(); err != nil {
+			t.Fatal(err)
+		}
+
+		if conn, err := net.DialTimeout("tcp", portAddr, time.Second); err == nil {
+			conn.Close()
+			t.Fatal("Unexpected listener on removed app port")
+		}
+	})
+
+	cancel()
+	if err := <-errch; err != context.Canceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// echoServer starts a TCP server that echoes what it receives and returns
+// its address
+func echoServer(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func randomAddr(t *testing.T) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(randomPort(t)))
+}
+
+func randomPort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -2,56 +2,176 @@ package watch
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/owenthereal/candy"
+	"github.com/owenthereal/candy/runnable"
 	"go.uber.org/zap"
 )
 
-type HandleFunc func()
+const (
+	defaultPollInterval  = 2 * time.Second
+	defaultRetryInterval = 1 * time.Second
+)
+
+// HandleFunc handles a coalesced batch of changes in the host root
+type HandleFunc func(events []fsnotify.Event)
 
 type Config struct {
-	HostRoot   string
-	HandleFunc HandleFunc
-	Logger     *zap.Logger
+	HostRoot string
+	// Debounce is how long the watcher waits for a burst of events to settle
+	// before calling HandleFunc once for all of them
+	Debounce time.Duration
+	// Poll polls the host root for changes instead of using filesystem
+	// notifications, e.g. for network filesystems. The watcher also falls
+	// back to polling when filesystem notifications are unavailable.
+	Poll         bool
+	PollInterval time.Duration
+	// Recreate creates the host root when it's missing at start or removed
+	// instead of failing or waiting for it to reappear
+	Recreate bool
+	// MaxRetries is the number of consecutive failures, e.g. a missing host
+	// root or a notification error, after which the watcher gives up.
+	// Zero retries forever.
+	MaxRetries    int
+	RetryInterval time.Duration
+	HandleFunc    HandleFunc
+	Logger        *zap.Logger
 }
 
 func New(cfg Config) candy.Watcher {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultRetryInterval
+	}
+
 	return &watcher{
-		cfg: cfg,
+		cfg:   cfg,
+		ready: runnable.NewReadySignal(),
 	}
 }
 
 type watcher struct {
-	cfg Config
+	cfg   Config
+	ready *runnable.ReadySignal
+}
+
+// Ready is closed once the host root is watched
+func (f *watcher) Ready() <-chan struct{} {
+	return f.ready.Ready()
 }
 
 func (f *watcher) Run(ctx context.Context) error {
-	f.cfg.Logger.Info("starting Watcher", zap.String("HostRoot", f.cfg.HostRoot))
+	f.cfg.Logger.Info("starting Watcher", zap.String("HostRoot", f.cfg.HostRoot), zap.Duration("Debounce", f.cfg.Debounce), zap.Bool("Poll", f.cfg.Poll))
 	defer f.cfg.Logger.Info("shutting down Watcher")
 
-	if _, err := os.Stat(f.cfg.HostRoot); err != nil {
+	if err := f.ensureHostRoot(); err != nil {
 		return err
 	}
 
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
+	queue := newEventQueue()
+
+	var (
+		wg                sync.WaitGroup
+		handleCtx, cancel = context.WithCancel(ctx)
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f.handleEvents(handleCtx, queue)
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	var (
+		failures int
+		resumed  bool
+	)
+	for {
+		err := f.watch(ctx, queue, resumed, func() {
+			failures = 0
+			f.ready.Signal()
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		failures++
+		if f.cfg.MaxRetries > 0 && failures > f.cfg.MaxRetries {
+			return fmt.Errorf("giving up watching host root %s after %d retries: %w", f.cfg.HostRoot, f.cfg.MaxRetries, err)
+		}
+
+		f.cfg.Logger.Warn("error watching host root, retrying", zap.String("dir", f.cfg.HostRoot), zap.Int("failures", failures), zap.Duration("interval", f.cfg.RetryInterval), zap.Error(err))
+		resumed = true
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(f.cfg.RetryInterval):
+		}
 	}
-	defer watcher.Close()
+}
 
-	if err := watcher.Add(f.cfg.HostRoot); err != nil {
+// watch watches the host root until ctx is done or watching fails.
+// started is called once the host root is watched. If resumed, changes
+// may have been missed in between and the apps are reloaded.
+func (f *watcher) watch(ctx context.Context, queue *eventQueue, resumed bool, started func()) error {
+	if err := f.ensureHostRoot(); err != nil {
 		return err
 	}
 
+	resume := func() {
+		started()
+		if resumed {
+			queue.push(fsnotify.Event{Name: f.cfg.HostRoot, Op: fsnotify.Create})
+		}
+	}
+
+	if f.cfg.Poll {
+		return f.poll(ctx, queue, resume)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		err = watcher.Add(f.cfg.HostRoot)
+	}
+	if err != nil {
+		// e.g. inotify limits are reached or the filesystem doesn't support it
+		f.cfg.Logger.Warn("filesystem notifications unavailable, falling back to polling", zap.String("dir", f.cfg.HostRoot), zap.Duration("interval", f.cfg.PollInterval), zap.Error(err))
+		return f.poll(ctx, queue, resume)
+	}
+
+	resume()
+
+	var (
+		burst     []fsnotify.Event
+		debounce  *time.Timer
+		debounceC <-chan time.Time
+	)
+	defer func() {
+		if debounce != nil {
+			debounce.Stop()
+		}
+		// Don't lose the changes seen so far
+		queue.push(burst...)
+	}()
+
 	for {
 		select {
 		case event, ok := <-watcher.Events:
 			if !ok {
-				return nil
+				return fmt.Errorf("watcher closed")
 			}
 
 			// Ignoring chmod
@@ -62,14 +182,28 @@ func (f *watcher) Run(ctx context.Context) error {
 			f.cfg.Logger.Info("watched dir changed", zap.String("dir", f.cfg.HostRoot), zap.Any("evt", event))
 
 			// Host root is removed
-			if event.Op&fsnotify.Remove == fsnotify.Remove && filepath.Clean(event.Name) == filepath.Clean(f.cfg.HostRoot) {
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && filepath.Clean(event.Name) == filepath.Clean(f.cfg.HostRoot) {
 				return fmt.Errorf("host root %s was removed", f.cfg.HostRoot)
 			}
 
-			f.cfg.HandleFunc()
+			if f.cfg.Debounce <= 0 {
+				queue.push(event)
+				continue
+			}
+
+			burst = append(burst, event)
+			if debounce != nil {
+				debounce.Stop()
+			}
+			debounce = time.NewTimer(f.cfg.Debounce)
+			debounceC = debounce.C
+		case <-debounceC:
+			queue.push(burst...)
+			burst = nil
+			debounceC = nil
 		case err, ok := <-watcher.Errors:
 			if !ok {
-				return nil
+				return fmt.Errorf("watcher closed")
 			}
 
 			return err
@@ -78,3 +212,153 @@ func (f *watcher) Run(ctx context.Context) error {
 		}
 	}
 }
+
+// ensureHostRoot checks that the host root exists and recreates it if configured
+func (f *watcher) ensureHostRoot() error {
+	_, err := os.Stat(f.cfg.HostRoot)
+	if err == nil || !errors.Is(err, os.ErrNotExist) || !f.cfg.Recreate {
+		return err
+	}
+
+	f.cfg.Logger.Info("recreating host root", zap.String("dir", f.cfg.HostRoot))
+
+	return os.MkdirAll(f.cfg.HostRoot, 0o755)
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// poll compares snapshots of the host root every poll interval
+func (f *watcher) poll(ctx context.Context, queue *eventQueue, started func()) error {
+	prev, err := f.snapshot()
+	if err != nil {
+		return err
+	}
+
+	started()
+
+	ticker := time.NewTicker(f.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			cur, err := f.snapshot()
+			if errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("host root %s was removed", f.cfg.HostRoot)
+			}
+			if err != nil {
+				return err
+			}
+
+			events := diffSnapshots(f.cfg.HostRoot, prev, cur)
+			for _, event := range events {
+				f.cfg.Logger.Info("watched dir changed", zap.String("dir", f.cfg.HostRoot), zap.Any("evt", event))
+			}
+			queue.push(events...)
+
+			prev = cur
+		}
+	}
+}
+
+func (f *watcher) snapshot() (map[string]fileState, error) {
+	entries, err := os.ReadDir(f.cfg.HostRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]fileState, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed in between
+		}
+
+		result[entry.Name()] = fileState{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+	}
+
+	return result, nil
+}
+
+func diffSnapshots(dir string, prev, cur map[string]fileState) []fsnotify.Event {
+	var events []fsnotify.Event
+
+	for name, state := range cur {
+		old, ok := prev[name]
+		switch {
+		case !ok:
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Create})
+		case old != state:
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Write})
+		}
+	}
+
+	for name := range prev {
+		if _, ok := cur[name]; !ok {
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+		}
+	}
+
+	return events
+}
+
+// handleEvents calls HandleFunc with the queued events one batch at a time
+func (f *watcher) handleEvents(ctx context.Context, queue *eventQueue) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-queue.ready:
+			if events := queue.pop(); len(events) > 0 {
+				f.cfg.HandleFunc(events)
+			}
+		}
+	}
+}
+
+// eventQueue coalesces the events that arrive while HandleFunc is running
+// into at most one pending batch
+type eventQueue struct {
+	mutex  sync.Mutex
+	events []fsnotify.Event
+	ready  chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *eventQueue) push(events ...fsnotify.Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	q.events = append(q.events, events...)
+	q.mutex.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default: // a batch is already pending
+	}
+}
+
+func (q *eventQueue) pop() []fsnotify.Event {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	events := q.events
+	q.events = nil
+
+	return events
+}
@@ -0,0 +1,350 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+func Test_Watcher_Debounce(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		batches = make(chan []fsnotify.Event, 10)
+	)
+
+	w := New(Config{
+		HostRoot: dir,
+		Debounce: 200 * time.Millisecond,
+		HandleFunc: func(events []fsnotify.Event) {
+			batches <- events
+		},
+		Logger: zap.NewNop(),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errch := make(chan error)
+	go func() {
+		errch <- w.Run(ctx)
+	}()
+
+	// Wait for the watcher to start
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("app%d", i)), []byte("8080"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case events := <-batches:
+		if len(events) < 5 {
+			t.Fatalf("unexpected events in batch: %v", events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("error wait time out")
+	}
+
+	select {
+	case events := <-batches:
+		t.Fatalf("unexpected batch: %v", events)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	cancel()
+	<-errch
+}
+
+func Test_Watcher_Coalesce(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		block   = make(chan struct{})
+		mutex   sync.Mutex
+		batches [][]fsnotify.Event
+	)
+
+	w := New(Config{
+		HostRoot: dir,
+		HandleFunc: func(events []fsnotify.Event) {
+			mutex.Lock()
+			batches = append(batches, events)
+			first := len(batches) == 1
+			mutex.Unlock()
+
+			if first {
+				<-block
+			}
+		},
+		Logger: zap.NewNop(),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errch := make(chan error)
+	go func() {
+		errch <- w.Run(ctx)
+	}()
+
+	// Wait for the watcher to start
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("app%d", i)), []byte("8080"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	close(block)
+	time.Sleep(500 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(batches) != 2 {
+		t.Fatalf("unexpected batches: want=2 got=%d: %v", len(batches), batches)
+	}
+
+	cancel()
+	<-errch
+}
+
+func Test_Watcher_Poll(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		batches = make(chan []fsnotify.Event, 10)
+	)
+
+	w := New(Config{
+		HostRoot:     dir,
+		Poll:         true,
+		PollInterval: 50 * time.Millisecond,
+		HandleFunc: func(events []fsnotify.Event) {
+			batches <- events
+		},
+		Logger: zap.NewNop(),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errch := make(chan error)
+	go func() {
+		errch <- w.Run(ctx)
+	}()
+
+	// Wait for the watcher to start
+	time.Sleep(100 * time.Millisecond)
+
+	app := filepath.Join(dir, "app")
+	if err := os.WriteFile(app, []byte("8080"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case events := <-batches:
+		if want, got := (fsnotify.Event{Name: app, Op: fsnotify.Create}), events[0]; want != got {
+			t.Fatalf("unexpected event: want=%s got=%s", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("error wait time out")
+	}
+
+	cancel()
+	<-errch
+}
+
+func Test_Watcher_HostRootRemoved(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Poll     bool
+		Recreate bool
+	}{
+		{
+			Name:     "recreate",
+			Recreate: true,
+		},
+		{
+			Name: "reappear",
+		},
+		{
+			Name: "reappear polling",
+			Poll: true,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				dir     = filepath.Join(t.TempDir(), "root")
+				batches = make(chan []fsnotify.Event, 10)
+			)
+
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			w := New(Config{
+				HostRoot:      dir,
+				Poll:          cc.Poll,
+				PollInterval:  50 * time.Millisecond,
+				Recreate:      cc.Recreate,
+				RetryInterval: 50 * time.Millisecond,
+				HandleFunc: func(events []fsnotify.Event) {
+					batches <- events
+				},
+				Logger: zap.NewNop(),
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			errch := make(chan error, 1)
+			go func() {
+				errch <- w.Run(ctx)
+			}()
+
+			// Wait for the watcher to start
+			time.Sleep(100 * time.Millisecond)
+
+			if err := os.RemoveAll(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			if !cc.Recreate {
+				time.Sleep(200 * time.Millisecond)
+				if err := os.Mkdir(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Host root is watched again and apps are reloaded
+			select {
+			case <-batches:
+			case err := <-errch:
+				t.Fatalf("unexpected error: %s", err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("error wait time out")
+			}
+
+			if _, err := os.Stat(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			cancel()
+			<-errch
+		})
+	}
+}
+
+func Test_Watcher_MaxRetries(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "root")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New(Config{
+		HostRoot:      dir,
+		MaxRetries:    2,
+		RetryInterval: 50 * time.Millisecond,
+		HandleFunc:    func(events []fsnotify.Event) {},
+		Logger:        zap.NewNop(),
+	})
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- w.Run(context.Background())
+	}()
+
+	// Wait for the watcher to start
+	time.Sleep(100 * time.Millisecond)
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errch:
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("error wait time out")
+	}
+}
+
+func Test_Watcher_MissingHostRoot(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Recreate bool
+		WantErr  bool
+	}{
+		{
+			Name:     "recreate",
+			Recreate: true,
+		},
+		{
+			Name:    "fail",
+			WantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		cc := c
+		t.Run(cc.Name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := filepath.Join(t.TempDir(), "root")
+
+			w := New(Config{
+				HostRoot:   dir,
+				Recreate:   cc.Recreate,
+				HandleFunc: func(events []fsnotify.Event) {},
+				Logger:     zap.NewNop(),
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			errch := make(chan error, 1)
+			go func() {
+				errch <- w.Run(ctx)
+			}()
+
+			select {
+			case <-w.Ready():
+				if cc.WantErr {
+					t.Fatal("want error, watcher started")
+				}
+			case err := <-errch:
+				if !cc.WantErr || !errors.Is(err, os.ErrNotExist) {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			case <-time.After(5 * time.Second):
+				t.Fatal("error wait time out")
+			}
+
+			if _, err := os.Stat(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			cancel()
+			<-errch
+		})
+	}
+}